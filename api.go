@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//DefaultRecentBlocks is the number of blocks returned by GET /api/blocks when no limit is given
+const DefaultRecentBlocks = 20
+
+/*APIWriteTimeout is how long a call to the API may take to answer. It does not apply to
+GET /api/export, which streams the whole ledger and can take much longer on a long chain*/
+var APIWriteTimeout = 10 * time.Second
+
+/*APIServer exposes a local HTTP/JSON API so that till software can make transactions and
+query the chain without the terminal UI. All calls go through the same ChainSubscription
+and Ledger methods that the UI uses
+
+	POST /api/transactions          {"card_id": 7, "amount": -5.5}
+	GET  /api/transactions/<hash>   status of a transaction
+	GET  /api/cards/<card_id>       balance on a card
+	GET  /api/cards/<card_id>/history?limit=<n>  statement of a card with its last n transactions
+	GET  /api/blocks?limit=<n>      most recent blocks of the chain
+	GET  /api/export?format=csv     the ledger as csv or jsonl, filtered by from, to, card and terminal
+	GET  /api/peers                 peer directory built from the presence records of the peers
+	GET  /api/peers/health          liveness of the peers: last heard, height, lag behind us and state
+	GET  /api/network               whether the terminal is online, isolated or partitioned
+	GET  /api/metrics               messages on the topic dropped as invalid, rate limited or repeated
+*/
+type APIServer struct {
+	cs  *ChainSubscription
+	srv *http.Server
+}
+
+//transactionRequest is the body of POST /api/transactions
+type transactionRequest struct {
+	CardId int     `json:"card_id"`
+	Amount float32 `json:"amount"`
+}
+
+//transactionStatus is returned for a submitted or looked up transaction
+type transactionStatus struct {
+	Status        string `json:"status"`
+	Index         int    `json:"index"`
+	Confirmations int    `json:"confirmations"`
+	Block         *Block `json:"block,omitempty"`
+}
+
+type balanceResponse struct {
+	CardId  int     `json:"card_id"`
+	Balance float32 `json:"balance"`
+}
+
+//networkResponse is returned for GET /api/network. Since and LastSync are omitted until they happen
+type networkResponse struct {
+	State    string     `json:"state"`
+	Since    *time.Time `json:"since,omitempty"`
+	Index    int        `json:"index"`
+	LastSync *time.Time `json:"last_sync,omitempty"`
+}
+
+//metricsResponse is returned for GET /api/metrics
+type metricsResponse struct {
+	DroppedMessages DroppedMessages `json:"dropped_messages"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+//NewAPIServer creates an API server for the chain listening on addr (e.g. 127.0.0.1:8080)
+func NewAPIServer(cs *ChainSubscription, addr string) *APIServer {
+	api := &APIServer{cs: cs}
+
+	mux := http.NewServeMux()
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, http.TimeoutHandler(handler, APIWriteTimeout, `{"error":"timed out"}`))
+	}
+	handle("/api/transactions", api.handleTransactions)
+	handle("/api/transactions/", api.handleTransactionStatus)
+	handle("/api/cards/", api.handleCard)
+	handle("/api/blocks", api.handleBlocks)
+	handle("/api/peers", api.handlePeers)
+	handle("/api/peers/health", api.handlePeerHealth)
+	handle("/api/network", api.handleNetwork)
+	handle("/api/metrics", api.handleMetrics)
+	//the server has no write timeout, so that a long export is not cut off part way through
+	mux.HandleFunc("/api/export", api.handleExport)
+
+	api.srv = &http.Server{
+		Addr:        addr,
+		Handler:     mux,
+		ReadTimeout: 10 * time.Second,
+	}
+	return api
+}
+
+//ListenAndServe serves the API until Close is called
+func (api *APIServer) ListenAndServe() error {
+	log.Printf("Starting API server on %s", api.srv.Addr)
+	err := api.srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+//Close stops the API server
+func (api *APIServer) Close() error {
+	return api.srv.Close()
+}
+
+func (api *APIServer) handleTransactions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "only POST is supported")
+		return
+	}
+
+	var req transactionRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	block, err := api.cs.SubmitTransaction(req.CardId, req.Amount)
+	switch err {
+	case nil:
+		writeJSON(w, http.StatusCreated, api.status(block))
+	case ErrInvalidCard, ErrZeroAmount:
+		writeError(w, http.StatusBadRequest, err.Error())
+	case ErrCashDeduction, ErrRetailCredit:
+		writeError(w, http.StatusForbidden, err.Error())
+	case ErrInvalidTransaction:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+	case ErrRateLimited:
+		writeError(w, http.StatusTooManyRequests, err.Error())
+	default:
+		log.Printf("Error submitting transaction from API: %s", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (api *APIServer) handleTransactionStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+
+	hash := strings.TrimPrefix(r.URL.Path, "/api/transactions/")
+	block := api.cs.Ledger.FindBlock(hash)
+	if block == nil {
+		writeJSON(w, http.StatusNotFound, transactionStatus{Status: "unknown", Index: -1})
+		return
+	}
+	writeJSON(w, http.StatusOK, api.status(block))
+}
+
+func (api *APIServer) handleCard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/cards/"), "/")
+	cardId, err := strconv.Atoi(parts[0])
+	if err != nil || cardId < 1 {
+		writeError(w, http.StatusBadRequest, ErrInvalidCard.Error())
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		writeJSON(w, http.StatusOK, balanceResponse{CardId: cardId, Balance: api.cs.Ledger.Balance(cardId)})
+	case len(parts) == 2 && parts[1] == "history":
+		limit := 0
+		if l := r.URL.Query().Get("limit"); l != "" {
+			limit, err = strconv.Atoi(l)
+			if err != nil || limit < 1 {
+				writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, api.cs.Ledger.CardHistory(cardId, limit))
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (api *APIServer) handleBlocks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+
+	limit := DefaultRecentBlocks
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, http.StatusOK, api.cs.Ledger.RecentBlocks(limit))
+}
+
+func (api *APIServer) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	contentType := map[string]string{"csv": "text/csv", "jsonl": "application/x-ndjson"}[format]
+	if contentType == "" {
+		writeError(w, http.StatusBadRequest, ErrExportFormat.Error())
+		return
+	}
+
+	cardId := 0
+	if c := query.Get("card"); c != "" {
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, ErrInvalidCard.Error())
+			return
+		}
+		cardId = n
+	}
+	filter, err := ParseExportFilter(query.Get("from"), query.Get("to"), cardId, query.Get("terminal"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	ew, err := NewExportWriter(w, format, filter)
+	if err != nil {
+		log.Printf("Error writing export: %s", err)
+		return
+	}
+	err = ExportLedger(ew, api.cs.Ledger)
+	if err != nil {
+		//the status has gone out with the first rows already, so the export just stops
+		log.Printf("Error writing export: %s", err)
+	}
+}
+
+func (api *APIServer) handlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+	writeJSON(w, http.StatusOK, api.cs.PeerStatuses())
+}
+
+func (api *APIServer) handlePeerHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+	writeJSON(w, http.StatusOK, api.cs.PeerHealth())
+}
+
+func (api *APIServer) handleNetwork(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+	state, since := api.cs.NetworkState()
+	resp := networkResponse{State: state, Index: api.cs.Ledger.Latest().Index}
+	if !since.IsZero() {
+		resp.Since = &since
+	}
+	if lastSync := api.cs.LastSync(); !lastSync.IsZero() {
+		resp.LastSync = &lastSync
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (api *APIServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+	writeJSON(w, http.StatusOK, metricsResponse{DroppedMessages: api.cs.DroppedMessages()})
+}
+
+//status reports how deep a block is in the local chain. It is pending until ConfirmationDepth blocks follow it, like on the dashboard
+func (api *APIServer) status(block *Block) transactionStatus {
+	confirmations := api.cs.Ledger.Latest().Index - block.Index
+	return transactionStatus{
+		Status:        confirmationStatus(confirmations),
+		Index:         block.Index,
+		Confirmations: confirmations,
+		Block:         block,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Error writing API response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, errorResponse{Error: msg})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+//localTopic stands in for the topic of a terminal without any peers. What is published goes nowhere
+type localTopic struct{}
+
+func (localTopic) Publish(ctx context.Context, data []byte, opts ...pubsub.PubOpt) error {
+	return nil
+}
+
+func (localTopic) ListPeers() []peer.ID {
+	return nil
+}
+
+//newLocalTerminal makes a terminal of the given type with an in-memory ledger and no peers
+func newLocalTerminal(t *testing.T, typePos string) *ChainSubscription {
+	t.Helper()
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	_, self := newPeerId(t)
+	return &ChainSubscription{
+		Ledger:    NewLedger(""),
+		ctx:       context.Background(),
+		topic:     localTopic{},
+		filter:    newMessageFilter(self),
+		self:      self,
+		typePos:   typePos,
+		topicName: testChainName,
+		nickName:  typePos + "-till",
+	}
+}
+
+//apiCall makes a request to the API and decodes the JSON response into v, if v is not nil
+func apiCall(t *testing.T, srv *httptest.Server, method string, path string, body string, v interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAPITransactions(t *testing.T) {
+	cash := httptest.NewServer(NewAPIServer(newLocalTerminal(t, "cash"), "").srv.Handler)
+	defer cash.Close()
+	retail := httptest.NewServer(NewAPIServer(newLocalTerminal(t, "retail"), "").srv.Handler)
+	defer retail.Close()
+
+	var created transactionStatus
+	if code := apiCall(t, cash, "POST", "/api/transactions", `{"card_id": 7, "amount": 20}`, &created); code != http.StatusCreated {
+		t.Fatalf("expected %d for a credit on a cash terminal, got %d", http.StatusCreated, code)
+	}
+	//a new transaction is pending until ConfirmationDepth blocks follow it
+	if created.Status != TxPending || created.Confirmations != 0 || created.Index != 1 || created.Block == nil || created.Block.Amount != 20 {
+		t.Errorf("unexpected status %+v", created)
+	}
+	var status transactionStatus
+	if code := apiCall(t, cash, "GET", "/api/transactions/"+created.Block.Hash, "", &status); code != http.StatusOK || status.Index != 1 {
+		t.Errorf("transaction not found by its hash: %d %+v", code, status)
+	}
+	for i := 0; i < ConfirmationDepth; i++ {
+		if code := apiCall(t, cash, "GET", "/api/transactions/"+created.Block.Hash, "", &status); status.Status != TxPending {
+			t.Errorf("transaction %s with %d confirmations: %d", status.Status, status.Confirmations, code)
+		}
+		apiCall(t, cash, "POST", "/api/transactions", `{"card_id": 8, "amount": 1}`, nil)
+	}
+	if apiCall(t, cash, "GET", "/api/transactions/"+created.Block.Hash, "", &status); status.Status != TxConfirmed || status.Confirmations != ConfirmationDepth {
+		t.Errorf("transaction %s with %d confirmations", status.Status, status.Confirmations)
+	}
+	var balance balanceResponse
+	if apiCall(t, cash, "GET", "/api/cards/7", "", &balance); balance.Balance != 20 {
+		t.Errorf("expected a balance of 20 on card 7, got %f", balance.Balance)
+	}
+
+	//every error of SubmitTransaction has its own status code
+	calls := []struct {
+		name   string
+		srv    *httptest.Server
+		method string
+		body   string
+		code   int
+	}{
+		{"wrong method", cash, "GET", "", http.StatusMethodNotAllowed},
+		{"garbage", cash, "POST", `{"card_id":`, http.StatusBadRequest},
+		{"invalid card", cash, "POST", `{"card_id": 0, "amount": 5}`, http.StatusBadRequest},
+		{"zero amount", cash, "POST", `{"card_id": 7, "amount": 0}`, http.StatusBadRequest},
+		{"deduction on cash", cash, "POST", `{"card_id": 7, "amount": -5}`, http.StatusForbidden},
+		{"credit on retail", retail, "POST", `{"card_id": 7, "amount": 5}`, http.StatusForbidden},
+		{"insufficient balance", retail, "POST", `{"card_id": 7, "amount": -5}`, http.StatusUnprocessableEntity},
+	}
+	for _, c := range calls {
+		var resp errorResponse
+		if code := apiCall(t, c.srv, c.method, "/api/transactions", c.body, &resp); code != c.code || len(resp.Error) == 0 {
+			t.Errorf("%s: expected %d with an error, got %d %+v", c.name, c.code, code, resp)
+		}
+	}
+
+	//a till that goes over the transaction limit is told to slow down
+	code := http.StatusCreated
+	for i := 0; i < 2*int(TransactionLimit.Burst) && code == http.StatusCreated; i++ {
+		code = apiCall(t, cash, "POST", "/api/transactions", `{"card_id": 8, "amount": 1}`, nil)
+	}
+	if code != http.StatusTooManyRequests {
+		t.Errorf("expected %d over the transaction limit, got %d", http.StatusTooManyRequests, code)
+	}
+}
+
+func TestAPIExportIsNotTimedOut(t *testing.T) {
+	cs := newLocalTerminal(t, "cash")
+	const blocks = 2 * SyncBatchSize
+	for i := 0; i < blocks; i++ {
+		if err := cs.Ledger.Append(nextBlock(cs.Ledger.Latest(), i%5+1, 10, "till")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//no other call could answer in time, but the export is not held to the timeout
+	timeout := APIWriteTimeout
+	APIWriteTimeout = time.Nanosecond
+	defer func() { APIWriteTimeout = timeout }()
+	srv := httptest.NewServer(NewAPIServer(cs, "").srv.Handler)
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/api/export?format=csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || len(rows) != blocks+1 {
+		t.Errorf("expected %d rows and a header, got %d with status %d", blocks, len(rows)-1, resp.StatusCode)
+	}
+}
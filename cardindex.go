@@ -0,0 +1,95 @@
+package main
+
+import "sort"
+
+//cardPosting records that a block touched a card, and the balance on the card right after it
+type cardPosting struct {
+	Index   int
+	Balance float32
+}
+
+//CardPostingLimit is how many of the latest transactions on each card the ledger indexes
+const CardPostingLimit = 1024
+
+//appendPosting adds a posting to those of a card, dropping the oldest ones past CardPostingLimit
+func appendPosting(postings []cardPosting, p cardPosting) []cardPosting {
+	postings = append(postings, p)
+	if len(postings) >= 2*CardPostingLimit {
+		postings = append(make([]cardPosting, 0, 2*CardPostingLimit), postings[len(postings)-CardPostingLimit:]...)
+	}
+	return postings
+}
+
+//CardTransaction is one line of a card statement
+type CardTransaction struct {
+	Index      int     `json:"index"`
+	Timestamp  string  `json:"timestamp"`
+	Terminal   string  `json:"terminal"`
+	TerminalId string  `json:"terminal_id"`
+	Amount     float32 `json:"amount"`
+	Balance    float32 `json:"balance"`
+	Hash       string  `json:"hash"`
+}
+
+/*CardStatement lists the latest transactions on a card, oldest first, with the running
+balance after each. OpeningBalance is the balance before the first transaction listed*/
+type CardStatement struct {
+	CardId         int               `json:"card_id"`
+	OpeningBalance float32           `json:"opening_balance"`
+	Balance        float32           `json:"balance"`
+	Transactions   []CardTransaction `json:"transactions"`
+}
+
+/*CardHistory returns the statement of a card with its last n transactions, or all of them
+if n <= 0. The ledger indexes the blocks of every card as they are applied, so only the
+blocks listed are read from the store. Only the latest CardPostingLimit transactions or more
+are indexed, and a pruned ledger only has the transactions since its latest checkpoint*/
+func (l *Ledger) CardHistory(cardId int, n int) CardStatement {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	postings := l.cards[cardId]
+	if n > 0 && len(postings) > n {
+		postings = postings[len(postings)-n:]
+	}
+
+	statement := CardStatement{
+		CardId:         cardId,
+		OpeningBalance: l.balance[cardId],
+		Balance:        l.balance[cardId],
+		Transactions:   make([]CardTransaction, 0, len(postings)),
+	}
+	for _, p := range postings {
+		blk, ok, err := l.store.Block(p.Index)
+		if err != nil || !ok {
+			continue
+		}
+		statement.Transactions = append(statement.Transactions, CardTransaction{
+			Index:      blk.Index,
+			Timestamp:  blk.Timestamp,
+			Terminal:   blk.SenderNick,
+			TerminalId: blk.Sender,
+			Amount:     blk.Amount,
+			Balance:    p.Balance,
+			Hash:       blk.Hash,
+		})
+	}
+	if len(statement.Transactions) > 0 {
+		first := statement.Transactions[0]
+		statement.OpeningBalance = first.Balance - first.Amount
+	}
+	return statement
+}
+
+//BalanceAfter returns the balance on a card right after the block at index, and false if that block did not touch the card
+func (l *Ledger) BalanceAfter(cardId int, index int) (float32, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	postings := l.cards[cardId]
+	i := sort.Search(len(postings), func(i int) bool { return postings[i].Index >= index })
+	if i < len(postings) && postings[i].Index == index {
+		return postings[i].Balance, true
+	}
+	return 0, false
+}
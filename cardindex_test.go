@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestCardHistory(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	chain := testChain()
+	l := NewLedger("")
+	if err := l.Replace(chain); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append(nextBlock(l.Latest(), 1, -4.5, "canteen")); err != nil {
+		t.Fatal(err)
+	}
+
+	statement := l.CardHistory(1, 0)
+	if len(statement.Transactions) != 3 || statement.OpeningBalance != 0 || statement.Balance != 60 {
+		t.Fatalf("unexpected statement %+v", statement)
+	}
+	for i, expected := range []struct {
+		index   int
+		balance float32
+	}{{1, 100}, {3, 64.5}, {5, 60}} {
+		tx := statement.Transactions[i]
+		if tx.Index != expected.index || tx.Balance != expected.balance {
+			t.Errorf("transaction %d: block %d with balance %f, expected block %d with %f", i, tx.Index, tx.Balance, expected.index, expected.balance)
+		}
+	}
+	if last := statement.Transactions[2]; last.Terminal != "canteen" || last.Amount != -4.5 {
+		t.Errorf("unexpected last transaction %+v", last)
+	}
+
+	if balance, ok := l.BalanceAfter(1, 3); !ok || balance != 64.5 {
+		t.Errorf("balance after block 3 is %f, %v, expected 64.5", balance, ok)
+	}
+	if _, ok := l.BalanceAfter(1, 4); ok {
+		t.Error("found a balance on card 1 after a block that did not touch it")
+	}
+
+	statement = l.CardHistory(1, 2)
+	if len(statement.Transactions) != 2 || statement.OpeningBalance != 100 {
+		t.Errorf("expected the last 2 transactions from a balance of 100, got %+v", statement)
+	}
+	if statement = l.CardHistory(9, 0); len(statement.Transactions) != 0 || statement.Balance != 0 {
+		t.Errorf("unexpected statement for unused card %+v", statement)
+	}
+
+	//a pruned ledger starts the history at its checkpoint
+	setCheckpointInterval(t, 4)
+	pruned := NewLedger("")
+	pruned.EnablePruning()
+	if err := pruned.Replace(snapshotLedger(l).Chain); err != nil {
+		t.Fatal(err)
+	}
+	statement = pruned.CardHistory(1, 0)
+	if len(statement.Transactions) != 1 || statement.OpeningBalance != 64.5 || statement.Balance != 60 {
+		t.Errorf("unexpected statement from pruned ledger %+v", statement)
+	}
+}
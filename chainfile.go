@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*ReadChainFile loads a ledger persisted by a terminal in the Chains folder. Each block is
+written as JSON on a line of its own. Chain files of older terminals, with a Block.pretty()
+line per block followed by a blank line, are read too*/
+func ReadChainFile(path string) ([]Block, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var chain []Block
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		block, err := parseBlock(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, lineNo, err)
+		}
+		chain = append(chain, block)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%s: no blocks found", path)
+	}
+	return chain, nil
+}
+
+/*parseBlock reads a block back from a line of a chain file. JSON escapes every character, so
+a block always reads back exactly as it was written*/
+func parseBlock(line string) (Block, error) {
+	var block Block
+	if strings.HasPrefix(line, "{") {
+		err := json.Unmarshal([]byte(line), &block)
+		return block, err
+	}
+	return parsePrettyBlock(line)
+}
+
+/*parsePrettyBlock reads a block back from the output of Block.pretty(), as written by older
+terminals. Fields that hold "; " cannot be told apart from the separators, which is why
+chain files are now written as JSON*/
+func parsePrettyBlock(line string) (Block, error) {
+	var block Block
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimSuffix(line, ";"), "; ") {
+		kv := strings.SplitN(field, ":", 2)
+		if len(kv) != 2 {
+			return block, fmt.Errorf("malformed field %q", field)
+		}
+		fields[kv[0]] = strings.TrimSpace(kv[1])
+	}
+
+	for _, key := range []string{"Index", "Prev Hash", "Card ID", "Amount", "Timestamp", "Hash", "Sender", "SenderNick"} {
+		if _, ok := fields[key]; !ok {
+			return block, fmt.Errorf("missing field %q", key)
+		}
+	}
+
+	var err error
+	block.Index, err = strconv.Atoi(fields["Index"])
+	if err != nil {
+		return block, fmt.Errorf("invalid index: %s", err)
+	}
+	block.CardId, err = strconv.Atoi(fields["Card ID"])
+	if err != nil {
+		return block, fmt.Errorf("invalid card id: %s", err)
+	}
+	amount, err := strconv.ParseFloat(fields["Amount"], 32)
+	if err != nil {
+		return block, fmt.Errorf("invalid amount: %s", err)
+	}
+	block.Amount = float32(amount)
+	block.PrevHash = fields["Prev Hash"]
+	block.Timestamp = fields["Timestamp"]
+	block.Hash = fields["Hash"]
+	block.Sender = fields["Sender"]
+	block.SenderNick = fields["SenderNick"]
+	return block, nil
+}
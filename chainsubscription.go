@@ -5,47 +5,122 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/libp2p/go-libp2p-core/crypto"
 	peer "github.com/libp2p/go-libp2p-peer"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 )
 
-const BlockChainSizeLimit = 1024
+//SyncWaitTime is how long a new terminal waits for gossipsub to find its peers before syncing
+var SyncWaitTime = 3 * time.Second
+
+/*SyncAttempts is how often a new terminal syncs before giving up while the chain it is sent
+cannot be taken, e.g. because most peers do not vouch for its checkpoint yet*/
+var SyncAttempts = 3
+
+//ResyncTimeout is how long Resync waits for the chain from the best peer before giving up
+var ResyncTimeout = 30 * time.Second
+
+//SyncBatchSize is the most blocks sent in one chain message. Longer chains are synced in several
+const SyncBatchSize = 512
+
+//errors returned when a transaction made on this terminal is rejected
+var (
+	ErrInvalidCard        = errors.New("invalid card id")
+	ErrZeroAmount         = errors.New("amount must be non-zero")
+	ErrCashDeduction      = errors.New("amount cannot be deducted from card on a cash type PoS terminal")
+	ErrRetailCredit       = errors.New("amount cannot be added to card on a retail type PoS terminal")
+	ErrInvalidTransaction = errors.New("insufficient balance on card, card invalid or other internal problem")
+)
+
+//errors returned by Resync
+var (
+	ErrSyncInProgress = errors.New("a sync is already in progress")
+	ErrSyncTimeout    = errors.New("timed out waiting for the chain from the best peer")
+	ErrSyncNoPeers    = errors.New("no peer answered the sync")
+)
+
+/*chainTopic is the part of a pubsub topic that a ChainSubscription publishes to. It is
+satisfied by *pubsub.Topic, and by the simulated network in the tests*/
+type chainTopic interface {
+	Publish(ctx context.Context, data []byte, opts ...pubsub.PubOpt) error
+	ListPeers() []peer.ID
+}
 
 //this object is the subscription to a topic
 type ChainSubscription struct {
-	Blocks    chan *Block
-	Chain     []Block
+	Ledger    *Ledger
 	ctx       context.Context
+	cancel    context.CancelFunc
 	ps        *pubsub.PubSub
-	topic     *pubsub.Topic
+	topic     chainTopic
 	sub       *pubsub.Subscription
+	filter    *messageFilter
 	self      peer.ID
 	typePos   string
 	topicName string
 	nickName  string
-	balance   map[int]float32
+
+	//key is the peer key of self, which signs the checkpoints we send
+	key crypto.PrivKey
+
+	//goroutines counts the goroutines of the subscription, which Close waits for
+	goroutines sync.WaitGroup
+
+	//state of a sync started by Resync while the terminal is running
+	syncMu      sync.Mutex
+	syncIndices map[string]int
+	syncHashes  map[string]string
+	syncPeer    string
+	syncFull    bool
+	syncDone    chan error
+	lastSync    time.Time
+	//stage holds a chain that is to replace ours while its batches come in, see applyChainPage
+	stage *ChainStage
+
+	//the checkpoint each peer vouched for in its reply to our last index request, nil if it sent none
+	votesMu         sync.Mutex
+	checkpointVotes map[string]*Checkpoint
+
+	//what we have heard of our peers, see PeerStatuses
+	peersMu sync.Mutex
+	peers   map[string]*PeerStatus
+
+	//whether we are cut off from the network, see WatchNetwork
+	netMu    sync.Mutex
+	netState string
+	netSince time.Time
 }
 
 /*this struct is for sending request messages
 Type -->
-		 1 - Request Index
-		 2 - Request BlockChain
+		 1 - Request Index (and the hash of the block at Index, if Index > 0)
+		 2 - Request BlockChain (the blocks from Index on, if Index > 0, or from the latest checkpoint, if Index is -1)
 		 3 - Return Index Message
 		 4 - Return BlockChain Message
+		 5 - Presence Announcement (see PresenceRecord)
 */
 type SpecialMessage struct {
 	Type       int
 	Timestamp  string
 	Sender     string
 	SenderNick string
+	//SenderType is the role of the sender, cash or retail
+	SenderType string
 	Receiver   string
 	Index      int
+	Hash       string
 	Blockchain []Block
+	//Checkpoint is set when Blockchain starts at the block of a checkpoint instead of at genesis
+	Checkpoint *Checkpoint
+	//Presence is set on presence announcements
+	Presence *PresenceRecord
 }
 
 //this struct represents a single block of the block chain
@@ -85,8 +160,17 @@ func GetGenesisBlock() Block {
 }
 
 /*SubscribeToChain tries to subscribe to the topic and returns a ChainSubscription object
-on success*/
-func SubscribeToChain(ctx context.Context, ps *pubsub.PubSub, self peer.ID, topicName string, nickName string, typePos string) (*ChainSubscription, error) {
+on success. The ledger is synced with the longest chain on the network before returning,
+unless ctx is done first, e.g. when the terminal is stopped while it syncs. key is the peer
+key of self*/
+func SubscribeToChain(ctx context.Context, ps *pubsub.PubSub, self peer.ID, key crypto.PrivKey, topicName string, nickName string, typePos string, ledger *Ledger) (*ChainSubscription, error) {
+	//drop invalid and excess messages in the router, before they are delivered or forwarded
+	filter := newMessageFilter(self)
+	err := ps.RegisterTopicValidator(topicName, filter.validate)
+	if err != nil {
+		return nil, err
+	}
+
 	//join the topic ps
 	topic, err := ps.Join(topicName)
 	if err != nil {
@@ -99,45 +183,125 @@ func SubscribeToChain(ctx context.Context, ps *pubsub.PubSub, self peer.ID, topi
 		return nil, err
 	}
 
+	//the subscription stops on its own context, so that Close can stop it before the terminal shuts down
+	ctx, cancel := context.WithCancel(ctx)
 	cs := &ChainSubscription{
 		ctx:       ctx,
+		cancel:    cancel,
 		ps:        ps,
 		topic:     topic,
 		sub:       sub,
+		filter:    filter,
 		topicName: topicName,
 		self:      self,
+		key:       key,
 		nickName:  nickName,
 		typePos:   typePos,
-		Blocks:    make(chan *Block, BlockChainSizeLimit),
-		Chain:     make([]Block, 0, BlockChainSizeLimit),
-		balance:   make(map[int]float32),
+		Ledger:    ledger,
+	}
+	genesis := cs.Ledger.Latest()
+	log.Printf("Added genesis block %s\n", genesis.pretty())
+
+	select {
+	case <-time.After(SyncWaitTime):
+	case <-ctx.Done():
+		cancel()
+		return nil, ctx.Err()
 	}
-	genesisBlock := GetGenesisBlock()
-	cs.Chain = append(cs.Chain, genesisBlock)
-	log.Printf("Added genesis block %s\n", cs.PrintChain())
-
-	time.Sleep(3 * time.Second)
 
 	//Sync the blockchain for newly signed up host
+	maxLengthChain, err := cs.initialSync()
+	for attempt := 1; err != nil && maxLengthChain >= 0 && attempt < SyncAttempts; attempt++ {
+		log.Printf("Could not sync the chain: %s. Syncing again in %s", err, SyncWaitTime)
+		select {
+		case <-time.After(SyncWaitTime):
+			maxLengthChain, err = cs.initialSync()
+		case <-ctx.Done():
+		}
+	}
+	if ctx.Err() != nil {
+		cancel()
+		return nil, ctx.Err()
+	}
+	if maxLengthChain < 0 && err != nil {
+		log.Printf("Problem querying other peer indices: %s", err)
+		cancel()
+		return nil, err
+	}
+	//sync calling complete. With no peers to sync with, or a chain we could not take, there is nothing to record
+	if err != nil {
+		log.Printf("Could not sync the chain: %s", err)
+	} else if maxLengthChain >= 0 {
+		cs.synced()
+	}
+	cs.spawn(cs.readBlocks)
+	return cs, nil
+}
+
+/*initialSync runs a round of the sync of a new terminal: it asks every peer for its index and
+takes the chain of the best peer if it is ahead of ours. It returns the index of the best peer,
+-1 if no peer answered or the index replies could not be read*/
+func (cs *ChainSubscription) initialSync() (int, error) {
+	imported := cs.Ledger.UnconfirmedImport()
 	cs.RequestIndices()
-	maxIndexPeer, maxLengthChain, err := cs.ReadIndices()
+	maxIndexPeer, maxLengthChain, importedHash, err := cs.ReadIndices()
 	if err != nil {
-		panic("Problem querying other peer indices")
+		return -1, err
 	}
 
 	log.Printf("maxIndexPeer is %s with chain of length %d", maxIndexPeer, maxLengthChain)
-	if maxLengthChain > 0 {
+	from := cs.fullSyncFrom()
+	//a chain resumed from the chain file only needs the blocks after its tip, if the peer holds the tip too
+	resumed := imported == nil && cs.Ledger.Latest().Index > 0
+	if resumed {
+		from = cs.Ledger.Latest().Index
+	}
+	fullSync := false
+	if imported != nil && maxLengthChain >= imported.Index {
+		//a chain seeded from a snapshot only needs the newer blocks if the network agrees with it
+		if importedHash == imported.Hash {
+			log.Printf("Network confirmed imported block %d", imported.Index)
+			cs.Ledger.ConfirmImport()
+			from = imported.Index + 1
+		} else {
+			log.Printf("Imported block %d has hash %s, network has %q. Syncing the full chain", imported.Index, imported.Hash, importedHash)
+			fullSync = true
+		}
+	}
+	if maxLengthChain > cs.Ledger.Latest().Index || fullSync {
 		log.Printf("Requesting chain from %s", maxIndexPeer)
-		cs.RequestMaxBlockChain(maxIndexPeer)
+		cs.RequestMaxBlockChain(maxIndexPeer, from)
 		log.Printf("Request message sent to %s", maxIndexPeer)
 		log.Printf("Attempting to receive chain from %s", maxIndexPeer)
-		cs.ReadChain()
+		err = cs.ReadChain()
+		if err != nil && resumed && cs.ctx.Err() == nil {
+			log.Printf("Block %d is not on the chain of %s. Syncing the full chain", from, maxIndexPeer)
+			cs.RequestMaxBlockChain(maxIndexPeer, cs.fullSyncFrom())
+			err = cs.ReadChain()
+		}
 		log.Printf("Received chain")
-		log.Printf(cs.PrintChain())
+		log.Printf("Chain is at block %d", cs.Ledger.Latest().Index)
 	}
-	//sync calling complete
-	go cs.readBlocks()
-	return cs, nil
+	return maxLengthChain, err
+}
+
+//spawn runs fn in a goroutine of the subscription, which Close waits for
+func (cs *ChainSubscription) spawn(fn func()) {
+	cs.goroutines.Add(1)
+	go func() {
+		defer cs.goroutines.Done()
+		fn()
+	}()
+}
+
+/*Close stops the subscription. It cancels its context and waits for its goroutines to return,
+so that nothing is appended to the ledger once Close has returned and the ledger can be
+closed. The ledger itself is left open*/
+func (cs *ChainSubscription) Close() {
+	if cs.cancel != nil {
+		cs.cancel()
+	}
+	cs.goroutines.Wait()
 }
 
 //Publish a message to the topic
@@ -156,118 +320,122 @@ func (cs *ChainSubscription) ListPeers() []peer.ID {
 	return cs.ps.ListPeers(cs.topicName)
 }
 
-func (cs *ChainSubscription) ValidateBlockAddition(newBlock *Block) bool {
-	prevBlock := cs.GetLatestBlock()
-	log.Printf("Validating block: %s\n", newBlock.pretty())
-	if newBlock.Index != prevBlock.Index+1 {
-		log.Printf("invalid index of new block")
-		return false
-	}
-	if newBlock.PrevHash != prevBlock.Hash {
-		log.Printf("problem with prev hash")
-		return false
-	}
-	if calculateBlockHash(*newBlock) != newBlock.Hash {
-		log.Printf("hash calculation problem")
-		return false
-	}
-	if cs.balance[newBlock.CardId]+newBlock.Amount < 0.0 {
-		log.Printf("insufficient balance")
-		return false
+/*SubmitTransaction checks a transaction against the terminal type and the chain, then
+publishes it and appends it to the local chain. Every front end (UI, API) makes
+transactions through this function*/
+func (cs *ChainSubscription) SubmitTransaction(cardId int, amount float32) (*Block, error) {
+	err := cs.checkTransaction(cardId, amount)
+	if err != nil {
+		return nil, err
 	}
-	if newBlock.CardId < 1 {
-		log.Printf("invalid card id")
-		return false
+	if cs.filter != nil && !cs.filter.allowTransaction(time.Now()) {
+		return nil, ErrRateLimited
 	}
 
-	return true
-}
-
-//get the most recent block in the chain
-func (cs *ChainSubscription) GetLatestBlock() *Block {
-	return &cs.Chain[len(cs.Chain)-1]
+	block, err := cs.Ledger.AppendNew(cardId, amount, cs.self.Pretty(), cs.nickName, cs.Publish)
+	switch err {
+	case nil:
+		return block, nil
+	case ErrBlockIndex, ErrPrevHash, ErrBlockHash, ErrInsufficientBalance, ErrInvalidCard:
+		log.Printf("%s", err)
+		return nil, ErrInvalidTransaction
+	default:
+		return nil, err
+	}
 }
 
-//print the chain (all the blocks in the chain)
-func (cs *ChainSubscription) PrintChain() string {
-	var res string = ""
-	for _, blk := range cs.Chain {
-		res += blk.pretty()
-		res += "\n"
+//checkTransaction checks a transaction against the terminal type, before it is checked against the chain
+func (cs *ChainSubscription) checkTransaction(cardId int, amount float32) error {
+	if cardId < 1 {
+		return ErrInvalidCard
+	}
+	if amount == 0 {
+		return ErrZeroAmount
+	}
+	if amount < 0 && cs.typePos == "cash" {
+		return ErrCashDeduction
+	}
+	if amount > 0 && cs.typePos == "retail" {
+		return ErrRetailCredit
 	}
-	return res
+	return nil
 }
 
-//readBlocks pulls messages from the topic and pushes them to the Blocks channel
+//readBlocks pulls messages from the topic and hands them to handleMessage
 func (cs *ChainSubscription) readBlocks() {
 	//infinite loop
 	for {
 		msg, err := cs.sub.Next(cs.ctx)
 		if err != nil {
-			close(cs.Blocks)
+			//the subscription was cancelled or the context is done
+			return
 		}
 
 		if msg.ReceivedFrom == cs.self {
 			continue
 		}
 
-		block := new(Block)
+		cs.handleMessage(msg.Data)
+	}
+}
 
-		err = json.Unmarshal(msg.Data, block)
+//handleMessage appends a received block to the ledger, answers a sync request or passes a reply on to Resync
+func (cs *ChainSubscription) handleMessage(data []byte) {
+	block := new(Block)
 
-		if err == nil && len(block.PrevHash) > 0 {
-			//send valid blocks onto the channel
-			cs.Blocks <- block
-			continue
-		}
+	err := json.Unmarshal(data, block)
 
-		specialMsg := new(SpecialMessage)
+	if err == nil && len(block.PrevHash) > 0 {
+		cs.seePeer(block.Sender, block.SenderNick, "", block.Index)
+		//the ledger validates the block and tells its subscribers
+		cs.Ledger.Append(block)
+		return
+	}
 
-		err2 := json.Unmarshal(msg.Data, specialMsg)
-		if err2 != nil {
-			continue
-		}
+	specialMsg := new(SpecialMessage)
 
-		if specialMsg.Type == 1 {
-			//publish special message with your length of blockchain
-			indexReturnMsg := SpecialMessage{
-				Type:       3,
-				Timestamp:  time.Now().String(),
-				Sender:     cs.self.Pretty(),
-				SenderNick: cs.nickName,
-				Receiver:   specialMsg.Sender,
-				Index:      cs.GetLatestBlock().Index,
-			}
-			indexReturnMsgJson, err := json.Marshal(indexReturnMsg)
-			if err != nil {
-				log.Printf("Error in marshalling index request i.e type 1 message")
-			}
-			err = cs.topic.Publish(cs.ctx, indexReturnMsgJson)
-			if err != nil {
-				log.Printf("Error in publishing index return i.e type 3 message")
-			}
+	err = json.Unmarshal(data, specialMsg)
+	if err != nil {
+		return
+	}
+	if specialMsg.Type == 5 {
+		cs.seePresence(specialMsg.Presence)
+		return
+	}
+	cs.seeMessage(specialMsg)
+
+	if specialMsg.Type == 1 {
+		//publish special message with your length of blockchain
+		indexReturnMsg := cs.indexReturnMessage(specialMsg)
+		indexReturnMsgJson, err := json.Marshal(indexReturnMsg)
+		if err != nil {
+			log.Printf("Error in marshalling index request i.e type 1 message")
 		}
+		err = cs.topic.Publish(cs.ctx, indexReturnMsgJson)
+		if err != nil {
+			log.Printf("Error in publishing index return i.e type 3 message")
+		}
+	}
+
+	if specialMsg.Type == 3 && specialMsg.Receiver == cs.self.Pretty() {
+		cs.collectIndex(specialMsg)
+	}
 
-		if specialMsg.Type == 2 && specialMsg.Receiver == cs.self.Pretty() {
-			//publish special message with your length of blockchain
-			chainReturnMsg := SpecialMessage{
-				Type:       4,
-				Timestamp:  time.Now().String(),
-				Sender:     cs.self.Pretty(),
-				SenderNick: cs.nickName,
-				Receiver:   specialMsg.Sender,
-				Blockchain: cs.Chain,
-			}
-			chainReturnMsgJson, err := json.Marshal(chainReturnMsg)
-			if err != nil {
-				log.Printf("Error in marshalling chain request i.e type 2 message")
-			}
-			err = cs.topic.Publish(cs.ctx, chainReturnMsgJson)
-			if err != nil {
-				log.Printf("Error in publishing chain return i.e type 4 message")
-			}
+	if specialMsg.Type == 2 && specialMsg.Receiver == cs.self.Pretty() {
+		//publish special message with your length of blockchain
+		chainReturnMsg := cs.chainReturnMessage(specialMsg)
+		chainReturnMsgJson, err := json.Marshal(chainReturnMsg)
+		if err != nil {
+			log.Printf("Error in marshalling chain request i.e type 2 message")
+		}
+		err = cs.topic.Publish(cs.ctx, chainReturnMsgJson)
+		if err != nil {
+			log.Printf("Error in publishing chain return i.e type 4 message")
 		}
+	}
 
+	if specialMsg.Type == 4 && specialMsg.Receiver == cs.self.Pretty() {
+		cs.resyncChain(specialMsg)
 	}
 }
 
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+/*CheckpointInterval is how many blocks apart a ledger takes balance checkpoints. It is read when the
+ledger is created. It is not configurable: trustCheckpoint needs every terminal of a chain to take
+its checkpoints at the same blocks, so that their votes can agree*/
+var CheckpointInterval = 256
+
+//CheckpointFileSuffix is appended to the chain file name to get the file the latest checkpoint is kept in
+const CheckpointFileSuffix = ".checkpoint"
+
+//errors returned for a checkpoint that cannot be synced from
+var (
+	ErrCheckpoint          = errors.New("checkpoint balances do not match their hash")
+	ErrCheckpointSignature = errors.New("checkpoint is not signed by the peer that sent it")
+	ErrCheckpointUntrusted = errors.New("checkpoint is neither on our chain nor vouched for by most peers")
+)
+
+/*Checkpoint records the card balances right after the block at Index. BalancesHash commits
+to the whole balance table, so a terminal that syncs from a checkpoint instead of from
+genesis can check the table it was sent, and blocks before Index can be pruned. A checkpoint
+sent to a peer is signed by the sender, so that the peer can tell who vouches for it*/
+type Checkpoint struct {
+	Index        int
+	BlockHash    string
+	Balances     map[int]float32
+	BalancesHash string
+	//Signer is the peer id of the signing key, PublicKey the marshalled key itself
+	Signer    string `json:",omitempty"`
+	PublicKey []byte `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
+}
+
+//newCheckpoint takes a checkpoint at a block, copying the balance table
+func newCheckpoint(block Block, balance map[int]float32) *Checkpoint {
+	cp := &Checkpoint{
+		Index:     block.Index,
+		BlockHash: block.Hash,
+		Balances:  make(map[int]float32, len(balance)),
+	}
+	for cardId, b := range balance {
+		cp.Balances[cardId] = b
+	}
+	cp.BalancesHash = calculateBalancesHash(cp.Balances)
+	return cp
+}
+
+//calculateBalancesHash hashes a balance table in card id order, with amounts written like in block hashes
+func calculateBalancesHash(balances map[int]float32) string {
+	cardIds := make([]int, 0, len(balances))
+	for cardId := range balances {
+		cardIds = append(cardIds, cardId)
+	}
+	sort.Ints(cardIds)
+
+	h := sha256.New()
+	for _, cardId := range cardIds {
+		fmt.Fprintf(h, "%d:%f;", cardId, balances[cardId])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//Verify checks that the balances of a checkpoint match its balances hash
+func (cp *Checkpoint) Verify() error {
+	if calculateBalancesHash(cp.Balances) != cp.BalancesHash {
+		return ErrCheckpoint
+	}
+	return nil
+}
+
+/*signedContent is the part of a checkpoint covered by the signature. BalancesHash commits to
+the balances, so they are left out and a checkpoint can be vouched for without them*/
+func (cp *Checkpoint) signedContent() ([]byte, error) {
+	return json.Marshal(struct {
+		Index        int
+		BlockHash    string
+		BalancesHash string
+	}{cp.Index, cp.BlockHash, cp.BalancesHash})
+}
+
+/*signCheckpoint returns a copy of a checkpoint signed with key. Without balances the copy is
+only a summary, as sent with index replies*/
+func signCheckpoint(cp *Checkpoint, key crypto.PrivKey, withBalances bool) (*Checkpoint, error) {
+	signer, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := crypto.MarshalPublicKey(key.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	signed := &Checkpoint{
+		Index:        cp.Index,
+		BlockHash:    cp.BlockHash,
+		BalancesHash: cp.BalancesHash,
+		Signer:       signer.Pretty(),
+		PublicKey:    pub,
+	}
+	if withBalances {
+		signed.Balances = cp.Balances
+	}
+	content, err := signed.signedContent()
+	if err != nil {
+		return nil, err
+	}
+	signed.Signature, err = key.Sign(content)
+	if err != nil {
+		return nil, err
+	}
+	return signed, nil
+}
+
+//VerifySignature checks that a checkpoint is signed by the peer id signer
+func (cp *Checkpoint) VerifySignature(signer string) error {
+	pub, err := crypto.UnmarshalPublicKey(cp.PublicKey)
+	if err != nil {
+		return ErrCheckpointSignature
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil || id.Pretty() != cp.Signer || len(signer) == 0 || signer != cp.Signer {
+		return ErrCheckpointSignature
+	}
+	content, err := cp.signedContent()
+	if err != nil {
+		return err
+	}
+	ok, err := pub.Verify(content, cp.Signature)
+	if err != nil || !ok {
+		return ErrCheckpointSignature
+	}
+	return nil
+}
+
+//sameState tells whether two checkpoints are taken at the same block with the same balances
+func (cp *Checkpoint) sameState(other *Checkpoint) bool {
+	return cp.Index == other.Index && cp.BlockHash == other.BlockHash && cp.BalancesHash == other.BalancesHash
+}
+
+//ReadCheckpointFile loads the checkpoint a ledger keeps next to its chain file
+func ReadCheckpointFile(path string) (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cp := new(Checkpoint)
+	err = json.Unmarshal(data, cp)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return cp, nil
+}
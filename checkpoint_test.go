@@ -0,0 +1,210 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+)
+
+//setCheckpointInterval changes CheckpointInterval for the duration of a test
+func setCheckpointInterval(t *testing.T, interval int) {
+	saved := CheckpointInterval
+	CheckpointInterval = interval
+	t.Cleanup(func() { CheckpointInterval = saved })
+}
+
+func TestCheckpointsAndPruning(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	setCheckpointInterval(t, 4)
+
+	full := NewLedger("")
+	pruned := NewLedger("")
+	pruned.EnablePruning()
+	for i := 0; i < 10; i++ {
+		blk := nextBlock(full.Latest(), 1+i%3, float32(i+1), "test")
+		if err := full.Append(blk); err != nil {
+			t.Fatal(err)
+		}
+		if err := pruned.Append(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cp := pruned.Checkpoint()
+	if cp == nil || cp.Index != 8 || cp.Verify() != nil {
+		t.Fatalf("expected a valid checkpoint at block 8, got %+v", cp)
+	}
+	if cp.Balances[1] != 1+4+7 || cp.BalancesHash != full.Checkpoint().BalancesHash {
+		t.Errorf("unexpected checkpoint balances %v", cp.Balances)
+	}
+	snap := snapshotLedger(pruned)
+	if len(snap.Chain) != 3 || snap.Chain[0].Index != 8 {
+		t.Errorf("expected blocks 8 to 10 after pruning, got %d blocks from %d", len(snap.Chain), snap.Chain[0].Index)
+	}
+	if pruned.Balance(1) != full.Balance(1) || pruned.BlockAt(9) == nil || pruned.BlockAt(3) != nil {
+		t.Error("pruned ledger does not answer like the full one")
+	}
+	if report := VerifyChainFrom(cp, snap.Chain); report.Problem != nil {
+		t.Errorf("pruned chain does not verify from its checkpoint: %s", report.Problem.Detail)
+	}
+
+	//a terminal syncing from the checkpoint ends up with the same balances
+	synced := NewLedger("")
+	if err := synced.ReplaceFromCheckpoint(cp, snap.Chain); err != nil {
+		t.Fatal(err)
+	}
+	for cardId := 1; cardId <= 3; cardId++ {
+		if synced.Balance(cardId) != full.Balance(cardId) {
+			t.Errorf("card %d: synced balance %f, expected %f", cardId, synced.Balance(cardId), full.Balance(cardId))
+		}
+	}
+
+	forged := *cp
+	forged.Balances = map[int]float32{1: 1000}
+	if err := NewLedger("").ReplaceFromCheckpoint(&forged, snap.Chain); err != ErrCheckpoint {
+		t.Errorf("expected %s for forged balances, got %v", ErrCheckpoint, err)
+	}
+}
+
+func TestPrunedNodeSyncsFromCheckpoint(t *testing.T) {
+	setCheckpointInterval(t, 2)
+	tn := newTestNetwork(t)
+	cash := tn.addNode("cash", "cash")
+	retail := tn.addNode("retail", "retail")
+	for i := 0; i < 3; i++ {
+		tn.transact(cash, 8, 10)
+		tn.transact(retail, 8, -5)
+	}
+
+	ledger := NewLedger("")
+	ledger.EnablePruning()
+	pruned := tn.addNodeWithLedger("pruned", "retail", ledger)
+	//the pruned chain is shorter than the others, so the node is left out of the convergence checks
+	tn.nodes = tn.nodes[:2]
+	t.Cleanup(func() { pruned.host.Close() })
+	if blocks := len(snapshotLedger(ledger).Chain); blocks != 1 {
+		t.Errorf("pruned node holds %d blocks, expected only the checkpoint block", blocks)
+	}
+	if latest := ledger.Latest(); latest.Hash != cash.cs.Ledger.Latest().Hash {
+		t.Fatalf("pruned node is at block %d, expected %d", latest.Index, cash.cs.Ledger.Latest().Index)
+	}
+
+	_, err := pruned.cs.SubmitTransaction(8, -15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for cash.cs.Ledger.Balance(8) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("block from pruned node did not reach the network")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestTrustCheckpoint(t *testing.T) {
+	setCheckpointInterval(t, 4)
+	cs := newLocalTerminal(t, "cash")
+	full := NewLedger("")
+	for i := 0; i < 5; i++ {
+		if err := full.Append(nextBlock(full.Latest(), 1, 10, "test")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cp := full.Checkpoint()
+
+	//three peers vouch for the checkpoint of the chain in their index replies
+	var keys []crypto.PrivKey
+	var ids []string
+	for i := 0; i < 3; i++ {
+		key, id := newPeerId(t)
+		keys, ids = append(keys, key), append(ids, id.Pretty())
+	}
+	vote := func(i int, cp *Checkpoint) {
+		summary, err := signCheckpoint(cp, keys[i], false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs.recordCheckpointVote(&SpecialMessage{Type: 3, Sender: ids[i], Checkpoint: summary})
+	}
+	sign := func(i int, cp *Checkpoint) *Checkpoint {
+		signed, err := signCheckpoint(cp, keys[i], true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	//a peer inflating a balance hashes its forged table, so it is self-consistent
+	forged := newCheckpoint(*full.BlockAt(cp.Index), map[int]float32{1: 1000})
+	vote(0, forged)
+	vote(1, cp)
+	vote(2, cp)
+
+	if err := cs.trustCheckpoint(cp, ids[1]); err != ErrCheckpointSignature {
+		t.Errorf("expected %s for an unsigned checkpoint, got %v", ErrCheckpointSignature, err)
+	}
+	if err := cs.trustCheckpoint(sign(0, cp), ids[1]); err != ErrCheckpointSignature {
+		t.Errorf("expected %s for a checkpoint signed by another peer, got %v", ErrCheckpointSignature, err)
+	}
+	if err := cs.trustCheckpoint(sign(0, forged), ids[0]); err != ErrCheckpointUntrusted {
+		t.Errorf("expected %s for a forged checkpoint, got %v", ErrCheckpointUntrusted, err)
+	}
+	if err := cs.trustCheckpoint(sign(1, cp), ids[1]); err != nil {
+		t.Errorf("checkpoint vouched for by most peers not trusted: %s", err)
+	}
+
+	//votes only count for the index request they answered
+	if err := cs.requestIndicesAt(0); err != nil {
+		t.Fatal(err)
+	}
+	vote(0, forged)
+	if err := cs.trustCheckpoint(sign(1, cp), ids[1]); err != ErrCheckpointUntrusted {
+		t.Errorf("expected %s once the votes of the last round are gone, got %v", ErrCheckpointUntrusted, err)
+	}
+
+	//a checkpoint of our own chain needs no votes
+	quiet := newLocalTerminal(t, "cash")
+	quiet.Ledger = full
+	if err := quiet.trustCheckpoint(sign(1, cp), ids[1]); err != nil {
+		t.Errorf("checkpoint of our own chain not trusted: %s", err)
+	}
+	if err := quiet.trustCheckpoint(sign(0, forged), ids[0]); err != ErrCheckpointUntrusted {
+		t.Errorf("expected %s for a forged checkpoint without votes, got %v", ErrCheckpointUntrusted, err)
+	}
+}
+
+func TestUntrustedCheckpointIsNotSynced(t *testing.T) {
+	setCheckpointInterval(t, 2)
+	tn := newTestNetwork(t)
+	cash := tn.addNode("cash", "cash")
+	retail := tn.addNode("retail", "retail")
+	for i := 0; i < 3; i++ {
+		tn.transact(cash, 8, 10)
+		tn.transact(retail, 8, -5)
+	}
+	//terminals without a key cannot vouch for their checkpoints, so only half the peers vouch for it
+	tn.startNode("quiet", "retail", NewLedger(""), false)
+	tn.startNode("silent", "retail", NewLedger(""), false)
+
+	ledger := NewLedger("")
+	ledger.EnablePruning()
+	start := time.Now()
+	pruned := tn.addNodeWithLedger("pruned", "retail", ledger)
+	tn.nodes = tn.nodes[:4]
+	t.Cleanup(func() { pruned.host.Close() })
+	if elapsed := time.Since(start); elapsed < time.Duration(SyncAttempts)*SyncWaitTime {
+		t.Errorf("sync gave up after %s, expected %d attempts %s apart", elapsed, SyncAttempts, SyncWaitTime)
+	}
+	if latest := ledger.Latest(); latest.Index != 0 {
+		t.Errorf("pruned node took an untrusted checkpoint at block %d", latest.Index)
+	}
+	if !pruned.cs.LastSync().IsZero() {
+		t.Error("failed sync was recorded as synced")
+	}
+}
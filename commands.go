@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rivo/tview"
+)
+
+//DefaultChainLength is the number of blocks shown by /chain
+const DefaultChainLength = 5
+
+//uiCommand is a slash command typed into the input field of the terminal UI
+type uiCommand struct {
+	name    string
+	args    string
+	help    string
+	minArgs int
+	maxArgs int
+	run     func(ui *TerminalUI, args []string) error
+}
+
+//usage is how the command is typed, e.g. /history <CARD_ID> [COUNT]
+func (cmd *uiCommand) usage() string {
+	if len(cmd.args) == 0 {
+		return "/" + cmd.name
+	}
+	return "/" + cmd.name + " " + cmd.args
+}
+
+//uiCommands are the commands of the terminal UI in the order /help lists them. They are set up in init because /help refers to them
+var uiCommands []uiCommand
+
+func init() {
+	uiCommands = []uiCommand{
+		{name: "balance", args: "<CARD_ID>", help: "show the balance on a card", minArgs: 1, maxArgs: 1, run: runBalanceCommand},
+		{name: "history", args: "<CARD_ID> [COUNT]", help: fmt.Sprintf("show the last COUNT transactions on a card (default %d)", DefaultHistoryLength), minArgs: 1, maxArgs: 2, run: runHistoryCommand},
+		{name: "peers", help: "list the terminals connected to the chain", run: runPeersCommand},
+		{name: "chain", args: "[COUNT]", help: fmt.Sprintf("show the last COUNT blocks of the chain (default %d)", DefaultChainLength), maxArgs: 1, run: runChainCommand},
+		{name: "sync", help: "sync with the longest chain on the network", run: runSyncCommand},
+		{name: "verify", help: "check the hashes, links and balances of the local chain", run: runVerifyCommand},
+		{name: "export", args: "[csv|jsonl]", help: "export the transactions of the local chain to the exports folder (default csv)", maxArgs: 1, run: runExportCommand},
+		{name: "help", help: "list the commands", run: runHelpCommand},
+		{name: "quit", help: "close the terminal", run: runQuitCommand},
+	}
+}
+
+//ErrUnknownCommand is returned for a slash command that is not in uiCommands
+var ErrUnknownCommand = errors.New("unknown command, type /help for the list of commands")
+
+/*parseCommand splits a line starting with a slash into the command and its arguments, and
+checks the number of arguments. The command is returned along with an error about its
+arguments, so that its usage can be shown*/
+func parseCommand(input string) (*uiCommand, []string, error) {
+	fields := strings.Fields(strings.TrimPrefix(input, "/"))
+	if len(fields) == 0 {
+		return nil, nil, ErrUnknownCommand
+	}
+	for i := range uiCommands {
+		cmd := &uiCommands[i]
+		if cmd.name != fields[0] {
+			continue
+		}
+		args := fields[1:]
+		if len(args) < cmd.minArgs || len(args) > cmd.maxArgs {
+			return cmd, nil, errors.New("wrong number of arguments")
+		}
+		return cmd, args, nil
+	}
+	return nil, nil, ErrUnknownCommand
+}
+
+//runCommand runs a slash command typed by the user, showing the usage of the command if it is not valid
+func (ui *TerminalUI) runCommand(input string) {
+	cmd, args, err := parseCommand(input)
+	if err == nil {
+		err = cmd.run(ui, args)
+	}
+	if err == nil {
+		return
+	}
+	if cmd == nil {
+		ui.displaySystemMessage(fmt.Sprintf("Problem with command: %s", err))
+		return
+	}
+	ui.displaySystemMessage(fmt.Sprintf("Problem with command: %s. Valid format is %s", err, tview.Escape(cmd.usage())))
+}
+
+//parseCardArg reads a card id argument
+func parseCardArg(arg string) (int, error) {
+	cardId, err := strconv.Atoi(arg)
+	if err != nil || cardId < 1 {
+		return 0, fmt.Errorf("%q is not a valid card id", arg)
+	}
+	return cardId, nil
+}
+
+//parseCountArg reads a count argument, which must be positive
+func parseCountArg(arg string) (int, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%q is not a valid count", arg)
+	}
+	return n, nil
+}
+
+func runBalanceCommand(ui *TerminalUI, args []string) error {
+	cardId, err := parseCardArg(args[0])
+	if err != nil {
+		return err
+	}
+	ui.displayBalance(cardId)
+	return nil
+}
+
+func runHistoryCommand(ui *TerminalUI, args []string) error {
+	cardId, err := parseCardArg(args[0])
+	if err != nil {
+		return err
+	}
+	n := DefaultHistoryLength
+	if len(args) > 1 {
+		n, err = parseCountArg(args[1])
+		if err != nil {
+			return err
+		}
+	}
+	ui.displayHistory(ui.cs.Ledger.CardHistory(cardId, n))
+	return nil
+}
+
+func runPeersCommand(ui *TerminalUI, args []string) error {
+	peers := ui.cs.PeerStatuses()
+	ui.displayInfo(fmt.Sprintf("%d peers connected to the chain", len(peers)))
+	for _, p := range peers {
+		//unsigned nicknames and roles are only what the messages of the peer claim
+		signed := ""
+		if !p.Signed {
+			signed = ", not announced"
+		}
+		fmt.Fprintf(ui.chainViewWriter, "  %s (%s, version %s%s) at block %d: %s\n", tview.Escape(p.Nick), p.Type, tview.Escape(p.Version), signed, p.Height, p.Id)
+	}
+	return nil
+}
+
+func runChainCommand(ui *TerminalUI, args []string) error {
+	n := DefaultChainLength
+	if len(args) > 0 {
+		var err error
+		n, err = parseCountArg(args[0])
+		if err != nil {
+			return err
+		}
+	}
+	blocks := ui.cs.Ledger.RecentBlocks(n)
+	ui.displayInfo(fmt.Sprintf("Last %d blocks of the chain", len(blocks)))
+	for i := range blocks {
+		fmt.Fprintf(ui.chainViewWriter, "  %s", blocks[i].pretty())
+	}
+	return nil
+}
+
+//runSyncCommand syncs in the background, as it takes a few seconds to hear from every peer
+func runSyncCommand(ui *TerminalUI, args []string) error {
+	ui.displayInfo("Syncing with the network")
+	go func() {
+		index, err := ui.cs.Resync()
+		if err != nil {
+			ui.displaySystemMessage(fmt.Sprintf("Problem with sync: %s", err))
+			return
+		}
+		ui.displayInfo(fmt.Sprintf("Sync done, chain is at block %d", index))
+	}()
+	return nil
+}
+
+func runVerifyCommand(ui *TerminalUI, args []string) error {
+	report := ui.cs.Ledger.Verify()
+	if p := report.Problem; p != nil {
+		ui.displaySystemMessage(fmt.Sprintf("Chain FAILED verification at block %d: %s", p.Block.Index, p.Err))
+		fmt.Fprintf(ui.chainViewWriter, "  %s\n", p.Detail)
+		return nil
+	}
+	ui.displayInfo(fmt.Sprintf("Chain OK, %d blocks checked", report.Blocks))
+	return nil
+}
+
+//runExportCommand exports in the background, as reading a long chain takes a while
+func runExportCommand(ui *TerminalUI, args []string) error {
+	format := "csv"
+	if len(args) > 0 {
+		format = args[0]
+	}
+	if format != "csv" && format != "jsonl" {
+		return ErrExportFormat
+	}
+
+	ui.displayInfo("Exporting the chain")
+	go func() {
+		path, err := exportChain(ui.cs.Ledger, ui.exportFolder, ui.cs.nickName, format)
+		if err != nil {
+			ui.displaySystemMessage(fmt.Sprintf("Problem with export: %s", err))
+			return
+		}
+		ui.displayInfo(fmt.Sprintf("Exported the chain to %s", path))
+	}()
+	return nil
+}
+
+//exportChain exports the transactions of a ledger to a new file in folder, named after the terminal and the time, and returns its path
+func exportChain(ledger *Ledger, folder string, nick string, format string) (string, error) {
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(folder, fmt.Sprintf("%s-%s.%s", nick, time.Now().Format("20060102-150405"), format))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	ew, err := NewExportWriter(file, format, ExportFilter{})
+	if err != nil {
+		return "", err
+	}
+	err = ExportLedger(ew, ledger)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func runHelpCommand(ui *TerminalUI, args []string) error {
+	ui.displayInfo("Type <CARD_ID> <AMOUNT> to make a transaction, or one of these commands")
+	for i := range uiCommands {
+		usage := fmt.Sprintf("%-26s", uiCommands[i].usage())
+		fmt.Fprintf(ui.chainViewWriter, "  %s %s\n", tview.Escape(usage), tview.Escape(uiCommands[i].help))
+	}
+	return nil
+}
+
+func runQuitCommand(ui *TerminalUI, args []string) error {
+	ui.app.Stop()
+	return nil
+}
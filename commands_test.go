@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCommand(t *testing.T) {
+	cases := []struct {
+		input string
+		name  string
+		args  int
+		ok    bool
+	}{
+		{"/balance 7", "balance", 1, true},
+		{"/balance", "balance", 0, false},
+		{"/balance 7 8", "balance", 0, false},
+		{"/history 7", "history", 1, true},
+		{"/history  7   20 ", "history", 2, true},
+		{"/chain", "chain", 0, true},
+		{"/chain 3", "chain", 1, true},
+		{"/peers now", "peers", 0, false},
+		{"/export jsonl", "export", 1, true},
+		{"/help", "help", 0, true},
+		{"/bal 7", "", 0, false},
+		{"/", "", 0, false},
+	}
+	for _, c := range cases {
+		cmd, args, err := parseCommand(c.input)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: unexpected error %v", c.input, err)
+		}
+		name := ""
+		if cmd != nil {
+			name = cmd.name
+		}
+		if name != c.name || len(args) != c.args {
+			t.Errorf("%q: parsed as %q with %d args, expected %q with %d", c.input, name, len(args), c.name, c.args)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	ledger := NewLedger("")
+	for _, amount := range []float32{50, -20, 5} {
+		err := ledger.Append(nextBlock(ledger.Latest(), 7, amount, "test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out bytes.Buffer
+	ui := &TerminalUI{
+		cs:              &ChainSubscription{Ledger: ledger, nickName: "test"},
+		chainViewWriter: &out,
+	}
+
+	cases := []struct {
+		input    string
+		expected []string
+	}{
+		{"/balance 7", []string{"Current Balance on Card: 35.000000"}},
+		{"/balance seven", []string{`"seven" is not a valid card id`, "Valid format is /balance <CARD_ID>"}},
+		{"/history 7 2", []string{"opening balance 50.000000", "Block 2;", "Block 3;"}},
+		{"/history 7 0", []string{`"0" is not a valid count`}},
+		{"/chain 2", []string{"Last 2 blocks", "Index: 2;", "Index: 3;"}},
+		{"/verify", []string{"Chain OK, 4 blocks checked"}},
+		{"/export xml", []string{ErrExportFormat.Error()}},
+		{"/help", []string{"/history <CARD_ID> [COUNT[]", "/export [csv|jsonl]"}},
+		{"/bal 7", []string{ErrUnknownCommand.Error()}},
+	}
+	for _, c := range cases {
+		out.Reset()
+		ui.runCommand(c.input)
+		for _, expected := range c.expected {
+			if !strings.Contains(out.String(), expected) {
+				t.Errorf("%q: output does not contain %q:\n%s", c.input, expected, out.String())
+			}
+		}
+	}
+}
+
+func TestExportChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ledger := NewLedger("")
+	ledger.Append(nextBlock(ledger.Latest(), 7, 50, "test"))
+
+	//the folder is created on the first export
+	path, err := exportChain(ledger, filepath.Join(dir, "exports"), "test", "jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(path) != filepath.Join(dir, "exports") || !strings.HasPrefix(filepath.Base(path), "test-") {
+		t.Errorf("unexpected export path %s", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), `"card_id":7`) {
+		t.Errorf("export does not hold the transaction: %s %v", data, err)
+	}
+}
+
+func TestResync(t *testing.T) {
+	tn := newTestNetwork(t)
+	first := tn.addNode("first", "cash")
+	tn.transact(first, 1, 100)
+	second := tn.addNode("second", "retail")
+
+	//blocks appended straight to the ledger of the first node are not published, so the second falls behind
+	for i := 0; i < 3; i++ {
+		err := first.cs.Ledger.Append(nextBlock(first.cs.Ledger.Latest(), 2, 10, "first"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := second.cs.Resync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 4 {
+		t.Errorf("second node resynced to block %d, expected 4", index)
+	}
+	tn.waitForConvergence(time.Second)
+
+	//a block only the second node holds is dropped for the longer chain of the first
+	if err := second.cs.Ledger.Append(nextBlock(second.cs.Ledger.Latest(), 3, 1, "second")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := first.cs.Ledger.Append(nextBlock(first.cs.Ledger.Latest(), 2, 10, "first")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err = second.cs.Resync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 6 {
+		t.Errorf("second node resynced to block %d, expected 6", index)
+	}
+	tn.waitForConvergence(time.Second)
+	tn.assertBalance(3, 0)
+}
+
+func TestResyncWithoutPeers(t *testing.T) {
+	cs := newLocalTerminal(t, "cash")
+	tip, err := cs.startResync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//no index replies came in, so there was no sync to record
+	done, err := cs.requestResyncChain(&tip, nil)
+	if done != nil || err != ErrSyncNoPeers {
+		t.Errorf("expected %v, got %v", ErrSyncNoPeers, err)
+	}
+	if !cs.LastSync().IsZero() {
+		t.Errorf("sync without peers recorded at %s", cs.LastSync())
+	}
+}
+
+func TestFailedSyncLeavesChain(t *testing.T) {
+	cs := newLocalTerminal(t, "cash")
+	for i := 0; i < 3; i++ {
+		if err := cs.Ledger.Append(nextBlock(cs.Ledger.Latest(), 1, 10, "cash")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//a peer sends its longer chain in batches
+	other := []Block{*cs.Ledger.BlockAt(0)}
+	for i := 0; i < SyncBatchSize+10; i++ {
+		other = append(other, *nextBlock(other[len(other)-1], 2, 1, "other"))
+	}
+	last := other[len(other)-1].Index
+	page := func(blocks []Block) *SpecialMessage {
+		return &SpecialMessage{Type: 4, Sender: "other", SenderNick: "other", Index: last, Blockchain: blocks}
+	}
+
+	next, more, err := cs.applyChainPage(page(other[:SyncBatchSize]))
+	if err != nil || !more || next != SyncBatchSize {
+		t.Fatalf("first batch: next %d, more %t, %v", next, more, err)
+	}
+	//our chain is left as it is until the last batch is in, and transactions still go on it
+	if blk, err := cs.SubmitTransaction(1, 5); err != nil || blk.Index != 4 {
+		t.Fatalf("transaction during the sync: %v %v", blk, err)
+	}
+	tip := cs.Ledger.Latest()
+
+	//a batch that does not check out drops the whole staged chain
+	broken := append([]Block{}, other[SyncBatchSize:]...)
+	broken[1].Amount = 1000
+	if _, _, err = cs.applyChainPage(page(broken)); err == nil {
+		t.Error("batch that does not check out accepted")
+	}
+	if cs.Ledger.Latest() != tip || cs.Ledger.Balance(1) != 35 || cs.stage != nil {
+		t.Errorf("failed sync changed the chain to block %d", cs.Ledger.Latest().Index)
+	}
+
+	//once the last batch checks out the new chain is swapped in
+	cs.applyChainPage(page(other[:SyncBatchSize]))
+	if _, more, err = cs.applyChainPage(page(other[SyncBatchSize:])); err != nil || more {
+		t.Fatalf("last batch: more %t, %v", more, err)
+	}
+	if cs.Ledger.Latest().Hash != other[last].Hash || cs.Ledger.Balance(1) != 0 {
+		t.Errorf("chain not replaced, at block %d", cs.Ledger.Latest().Index)
+	}
+}
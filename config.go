@@ -0,0 +1,471 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//EnvPrefix starts the environment variables that override the config file, e.g. SPIRIT_DIRS_CHAINS for dirs.chains
+const EnvPrefix = "SPIRIT_"
+
+//duration is a time.Duration written like 1m30s in config files
+type duration time.Duration
+
+func (d duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	err := unmarshal(&s)
+	if err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+//DirConfig holds the folders a terminal keeps its files in
+type DirConfig struct {
+	Chains   string `yaml:"chains"`
+	Logs     string `yaml:"logs"`
+	Keys     string `yaml:"keys"`
+	Receipts string `yaml:"receipts"`
+	Exports  string `yaml:"exports"`
+}
+
+//DiscoveryConfig sets up the mDNS discovery of the terminals on the LAN
+type DiscoveryConfig struct {
+	Interval duration `yaml:"interval"`
+	Tag      string   `yaml:"tag"`
+}
+
+//LimitsConfig holds the rate limits a terminal applies to the messages of its peers, see messageFilter
+type LimitsConfig struct {
+	IndexRequests          rateLimit `yaml:"index_requests"`
+	ChainRequests          rateLimit `yaml:"chain_requests"`
+	Transactions           rateLimit `yaml:"transactions"`
+	DuplicateRequestWindow duration  `yaml:"duplicate_request_window"`
+}
+
+/*Config is everything a terminal is started with. It is read from a YAML file given with
+-config, then overridden by environment variables and then by the flags given on the
+command line. Every key in the file has an environment variable, and every flag a key*/
+type Config struct {
+	Nick           string          `yaml:"nick"`
+	Type           string          `yaml:"type"`
+	Chain          string          `yaml:"chain"`
+	Key            string          `yaml:"key"`
+	PSK            string          `yaml:"psk"`
+	AllowList      string          `yaml:"allow_list"`
+	Dirs           DirConfig       `yaml:"dirs"`
+	Listen         []string        `yaml:"listen"`
+	Peers          []string        `yaml:"peers"`
+	DHT            bool            `yaml:"dht"`
+	Discovery      DiscoveryConfig `yaml:"discovery"`
+	API            string          `yaml:"api"`
+	GRPC           string          `yaml:"grpc"`
+	Headless       bool            `yaml:"headless"`
+	Prune          bool            `yaml:"prune"`
+	Snapshot       string          `yaml:"snapshot"`
+	SnapshotSigner string          `yaml:"snapshot_signer"`
+	Limits         LimitsConfig    `yaml:"limits"`
+	//PresenceInterval has no flag. CheckpointInterval is not a setting: every terminal of a chain must take its checkpoints at the same blocks
+	PresenceInterval duration `yaml:"presence_interval"`
+}
+
+//defaultConfig returns the config of a terminal started without a config file or any flags
+func defaultConfig() *Config {
+	return &Config{
+		Chain:     "spiritchain-terminals",
+		Dirs:      DirConfig{Chains: "Chains", Logs: "Logs", Keys: "Keys", Receipts: "Receipts", Exports: "Exports"},
+		Listen:    []string{"/ip4/0.0.0.0/tcp/0"},
+		Discovery: DiscoveryConfig{Interval: duration(DiscoveryInterval), Tag: DiscoveryServiceTag},
+		Limits: LimitsConfig{
+			IndexRequests:          IndexRequestLimit,
+			ChainRequests:          ChainRequestLimit,
+			Transactions:           TransactionLimit,
+			DuplicateRequestWindow: duration(DuplicateRequestWindow),
+		},
+		PresenceInterval: duration(PresenceInterval),
+	}
+}
+
+/*configFlags defines the flags of a terminal on fs, with the defaults of def, and returns the
+-config flag. The other flags are read back by name with applyFlags*/
+func configFlags(fs *flag.FlagSet, def *Config) *string {
+	fs.String("nick", def.Nick, "nickname for this terminal. will be auto generated if left empty")
+	fs.String("chain", def.Chain, "name for the chain/topic you want to join.")
+	fs.String("type", def.Type, "type of terminal i.e retail or cash")
+	fs.String("api", def.API, "address for the local HTTP API e.g. 127.0.0.1:8080. disabled if left empty")
+	fs.String("grpc", def.GRPC, "address for the gRPC service e.g. 127.0.0.1:9090. disabled if left empty")
+	fs.Bool("headless", def.Headless, "run without the terminal UI, e.g. under systemd or in a container")
+	fs.String("snapshot", def.Snapshot, "signed snapshot file to seed the chain from before syncing newer blocks")
+	fs.String("snapshot-signer", def.SnapshotSigner, "peer id the snapshot must be signed by. required with -snapshot")
+	fs.Bool("prune", def.Prune, "keep only the blocks since the latest balance checkpoint, and sync from a checkpoint")
+	fs.String("receipts", def.Dirs.Receipts, "folder to save the receipts of transactions made in the UI to. not saved if left empty")
+	fs.String("listen", strings.Join(def.Listen, ","), "comma separated multiaddrs to listen on. give a fixed port for a terminal other sites bootstrap from")
+	fs.String("peers", strings.Join(def.Peers, ","), "comma separated multiaddrs of static/bootstrap peers e.g. /ip4/10.1.2.3/tcp/4001/p2p/<PEER_ID>")
+	fs.Bool("dht", def.DHT, "find the terminals of the chain through a Kademlia DHT bootstrapped from -peers, alongside mDNS")
+	fs.String("key", def.Key, "identity key file of the terminal, created if it does not exist. <keys dir>/<nick>.key if left empty, or a new identity on every run if -nick is empty too")
+	fs.String("psk", def.PSK, "pre-shared key file of a private network, made with the psk subcommand. only terminals with the same key can connect")
+	fs.String("allow-list", def.AllowList, "file with the peer ids, one per line, that the terminal may connect to. any peer if left empty")
+	return fs.String("config", "", "YAML config file. flags and "+EnvPrefix+"* environment variables override it. "+EnvPrefix+"CONFIG if left empty")
+}
+
+//splitList splits a comma separated list, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+//set sets the setting of a flag from its value as given on the command line or in the environment
+func (c *Config) set(name string, value string) error {
+	var err error
+	switch name {
+	case "nick":
+		c.Nick = value
+	case "chain":
+		c.Chain = value
+	case "type":
+		c.Type = value
+	case "api":
+		c.API = value
+	case "grpc":
+		c.GRPC = value
+	case "headless":
+		c.Headless, err = strconv.ParseBool(value)
+	case "snapshot":
+		c.Snapshot = value
+	case "snapshot-signer":
+		c.SnapshotSigner = value
+	case "prune":
+		c.Prune, err = strconv.ParseBool(value)
+	case "receipts":
+		c.Dirs.Receipts = value
+	case "listen":
+		c.Listen = splitList(value)
+	case "peers":
+		c.Peers = splitList(value)
+	case "dht":
+		c.DHT, err = strconv.ParseBool(value)
+	case "key":
+		c.Key = value
+	case "psk":
+		c.PSK = value
+	case "allow-list":
+		c.AllowList = value
+	default:
+		return fmt.Errorf("unknown setting %s", name)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q", value)
+	}
+	return nil
+}
+
+//envName is the environment variable that overrides a flag or a key of the config file
+func envName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+/*visitSettings calls fn with the environment variable and the value of every setting in v, a
+config struct. The variable is named after the keys of the setting in the config file, so the
+settings of nested structs such as dirs.chains become SPIRIT_DIRS_CHAINS*/
+func visitSettings(v reflect.Value, prefix string, fn func(name string, setting reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if len(key) == 0 {
+			key = strings.ToLower(t.Field(i).Name)
+		}
+		if v.Field(i).Kind() == reflect.Struct {
+			visitSettings(v.Field(i), prefix+key+"_", fn)
+			continue
+		}
+		fn(envName(prefix+key), v.Field(i))
+	}
+}
+
+//setValue sets a setting from its value in the environment, which is read like a value in the config file
+func setValue(setting reflect.Value, value string) error {
+	switch {
+	case setting.Kind() == reflect.String:
+		setting.SetString(value)
+	case setting.Kind() == reflect.Slice && setting.Type().Elem().Kind() == reflect.String:
+		setting.Set(reflect.ValueOf(splitList(value)))
+	default:
+		if err := yaml.UnmarshalStrict([]byte(value), setting.Addr().Interface()); err != nil {
+			return fmt.Errorf("invalid value %q", value)
+		}
+	}
+	return nil
+}
+
+/*applyEnv overrides the config with the environment variables of its settings, and then with
+those of the flags defined on fs that are named differently from their setting, e.g.
+SPIRIT_RECEIPTS for -receipts*/
+func (c *Config) applyEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	var problems configProblems
+	settings := make(map[string]bool)
+	visitSettings(reflect.ValueOf(c).Elem(), "", func(name string, setting reflect.Value) {
+		settings[name] = true
+		value, ok := lookup(name)
+		if !ok {
+			return
+		}
+		if err := setValue(setting, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, err))
+		}
+	})
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || settings[envName(f.Name)] {
+			return
+		}
+		value, ok := lookup(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err := c.set(f.Name, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", envName(f.Name), err))
+		}
+	})
+	return problems.err()
+}
+
+//applyFlags overrides the config with the flags given on the command line
+func (c *Config) applyFlags(fs *flag.FlagSet) error {
+	var problems configProblems
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		if err := c.set(f.Name, f.Value.String()); err != nil {
+			problems = append(problems, fmt.Sprintf("-%s: %s", f.Name, err))
+		}
+	})
+	return problems.err()
+}
+
+/*loadConfig reads a config file over the defaults. Keys the file does not know of are
+errors, so that a misspelt setting is not silently ignored*/
+func loadConfig(path string) (*Config, error) {
+	c := defaultConfig()
+	if len(path) == 0 {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.UnmarshalStrict(data, c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return c, nil
+}
+
+/*buildConfig works out the config of a terminal from the config file, the environment and
+the flags parsed on fs, in that order, and validates it*/
+func buildConfig(fs *flag.FlagSet, path string, lookup func(string) (string, bool)) (*Config, error) {
+	if len(path) == 0 {
+		path, _ = lookup(EnvPrefix + "CONFIG")
+	}
+	c, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	err = c.applyEnv(fs, lookup)
+	if err != nil {
+		return nil, err
+	}
+	err = c.applyFlags(fs)
+	if err != nil {
+		return nil, err
+	}
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+/*configDirs reads the dirs of the config file given with -config, or SPIRIT_CONFIG, and the
+environment, for the subcommands that work on the files of a terminal. The rest of the config
+is not validated, as those subcommands do not use it*/
+func configDirs(path string, lookup func(string) (string, bool)) (DirConfig, error) {
+	if len(path) == 0 {
+		path, _ = lookup(EnvPrefix + "CONFIG")
+	}
+	c, err := loadConfig(path)
+	if err != nil {
+		return DirConfig{}, err
+	}
+	err = c.applyEnv(flag.NewFlagSet("dirs", flag.ContinueOnError), lookup)
+	if err != nil {
+		return DirConfig{}, err
+	}
+	return c.Dirs, nil
+}
+
+//configProblems lists everything wrong with a config, so that it can all be fixed at once
+type configProblems []string
+
+func (p configProblems) Error() string {
+	return "invalid configuration:\n  " + strings.Join(p, "\n  ")
+}
+
+//err returns the problems as an error, or nil if there are none
+func (p configProblems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return p
+}
+
+//Validate checks the settings of a config and returns all of its problems
+func (c *Config) Validate() error {
+	var problems configProblems
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Type != "cash" && c.Type != "retail" {
+		add("type: %q is not a terminal type. only 'retail' and 'cash' are valid", c.Type)
+	}
+	if !plainText(c.Nick) {
+		add("nick: must only hold printable characters, and no ; or :")
+	}
+	if len(c.Chain) == 0 {
+		add("chain: must not be empty")
+	}
+	if len(c.Dirs.Chains) == 0 {
+		add("dirs.chains: must not be empty")
+	}
+	if len(c.Dirs.Logs) == 0 {
+		add("dirs.logs: must not be empty")
+	}
+	if len(c.Dirs.Exports) == 0 {
+		add("dirs.exports: must not be empty")
+	}
+	if len(c.Listen) == 0 {
+		add("listen: at least one address is needed")
+	}
+	for _, addr := range c.Listen {
+		if _, err := ma.NewMultiaddr(addr); err != nil {
+			add("listen: invalid address %s: %s", addr, err)
+		}
+	}
+	if _, err := parsePeerAddrs(strings.Join(c.Peers, ",")); err != nil {
+		add("peers: %s", err)
+	}
+	if _, _, err := net.SplitHostPort(c.API); len(c.API) > 0 && err != nil {
+		add("api: invalid address %s: %s", c.API, err)
+	}
+	if _, _, err := net.SplitHostPort(c.GRPC); len(c.GRPC) > 0 && err != nil {
+		add("grpc: invalid address %s: %s", c.GRPC, err)
+	}
+	if len(c.Snapshot) > 0 && len(c.SnapshotSigner) == 0 {
+		add("snapshot: needs snapshot_signer, the peer id of the terminal that signed the snapshot")
+	}
+	if len(c.SnapshotSigner) > 0 && len(c.Snapshot) == 0 {
+		add("snapshot_signer: is only used with snapshot")
+	}
+	if _, err := peer.Decode(c.SnapshotSigner); len(c.SnapshotSigner) > 0 && err != nil {
+		add("snapshot_signer: invalid peer id %s: %s", c.SnapshotSigner, err)
+	}
+	if c.Discovery.Interval <= 0 {
+		add("discovery.interval: must be positive")
+	}
+	if len(c.Discovery.Tag) == 0 {
+		add("discovery.tag: must not be empty")
+	}
+	checkLimit := func(name string, limit rateLimit) {
+		if limit.Rate <= 0 || limit.Burst < 1 {
+			add("%s: rate must be positive and burst at least 1, got rate %g and burst %g", name, limit.Rate, limit.Burst)
+		}
+	}
+	checkLimit("limits.index_requests", c.Limits.IndexRequests)
+	checkLimit("limits.chain_requests", c.Limits.ChainRequests)
+	checkLimit("limits.transactions", c.Limits.Transactions)
+	if c.Limits.DuplicateRequestWindow < 0 {
+		add("limits.duplicate_request_window: must not be negative")
+	}
+	if c.PresenceInterval <= 0 {
+		add("presence_interval: must be positive")
+	}
+	return problems.err()
+}
+
+//KeyFile is the identity key file of the terminal, or "" for a new identity on every run
+func (c *Config) KeyFile() string {
+	if len(c.Key) > 0 || len(c.Nick) == 0 {
+		return c.Key
+	}
+	return filepath.Join(c.Dirs.Keys, c.Nick+".key")
+}
+
+//apply sets the globals that the settings of the config stand for
+func (c *Config) apply() {
+	DiscoveryInterval = time.Duration(c.Discovery.Interval)
+	DiscoveryServiceTag = c.Discovery.Tag
+	IndexRequestLimit = c.Limits.IndexRequests
+	ChainRequestLimit = c.Limits.ChainRequests
+	TransactionLimit = c.Limits.Transactions
+	DuplicateRequestWindow = time.Duration(c.Limits.DuplicateRequestWindow)
+	//how long a peer may go unheard follows from how often it announces itself
+	PresenceInterval = time.Duration(c.PresenceInterval)
+	PeerTimeout = 3 * PresenceInterval
+	PeerLivenessWindow = 2 * PeerTimeout
+}
+
+//runConfig implements the config subcommand, which prints the config a terminal would run with
+func runConfig(args []string) int {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	configFlag := configFlags(fs, defaultConfig())
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s config [-config=FILE] [FLAGS...]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Checks the config a terminal started with the same config file, environment and flags would run with, and prints it as YAML.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	c, err := buildConfig(fs, *configFlag, os.LookupEnv)
+	if err != nil {
+		printErr("%s\n", err)
+		return 2
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		printErr("%s\n", err)
+		return 1
+	}
+	os.Stdout.Write(data)
+	return 0
+}
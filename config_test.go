@@ -0,0 +1,219 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//writeConfig writes a config file to a temporary folder and returns its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "terminal.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+//env makes a lookup function for a fixed environment
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+//parseConfig builds a config the way a terminal does, from a file, an environment and flags
+func parseConfig(t *testing.T, path string, vars map[string]string, args ...string) (*Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	configFlag := configFlags(fs, defaultConfig())
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if len(*configFlag) == 0 {
+		*configFlag = path
+	}
+	return buildConfig(fs, *configFlag, env(vars))
+}
+
+func TestConfigFile(t *testing.T) {
+	path := writeConfig(t, `
+nick: till1
+type: retail
+chain: store12
+dirs:
+  chains: /var/lib/spirit/chains
+listen: [/ip4/0.0.0.0/tcp/4001]
+peers:
+  - /ip4/10.1.2.3/tcp/4001/p2p/12D3KooWQUR1UPKgdytunUWvcHcrU5vqUkveVPhS5kV7tbueBZ7m
+api: 127.0.0.1:8080
+discovery:
+  interval: 30s
+limits:
+  transactions: {rate: 2, burst: 10}
+  duplicate_request_window: 5s
+presence_interval: 5s
+`)
+	c, err := parseConfig(t, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Nick != "till1" || c.Type != "retail" || c.Chain != "store12" || c.API != "127.0.0.1:8080" || len(c.Peers) != 1 {
+		t.Errorf("settings not read from the file: %+v", c)
+	}
+	//what the file leaves out keeps its default
+	if c.Dirs.Chains != "/var/lib/spirit/chains" || c.Dirs.Logs != "Logs" || c.Discovery.Tag != DiscoveryServiceTag {
+		t.Errorf("unexpected dirs %+v and discovery %+v", c.Dirs, c.Discovery)
+	}
+	if time.Duration(c.Discovery.Interval) != 30*time.Second || time.Duration(c.Limits.DuplicateRequestWindow) != 5*time.Second {
+		t.Errorf("durations not read from the file: %+v %+v", c.Discovery, c.Limits)
+	}
+	if c.Limits.Transactions != (rateLimit{Rate: 2, Burst: 10}) || c.Limits.IndexRequests != IndexRequestLimit {
+		t.Errorf("unexpected limits %+v", c.Limits)
+	}
+	if time.Duration(c.PresenceInterval) != 5*time.Second {
+		t.Errorf("presence interval not read from the file: %s", time.Duration(c.PresenceInterval))
+	}
+	if c.KeyFile() != filepath.Join("Keys", "till1.key") {
+		t.Errorf("unexpected key file %s", c.KeyFile())
+	}
+
+	//a misspelt key is an error, not a silently ignored setting
+	path = writeConfig(t, "type: cash\nchian: store12\n")
+	if _, err = parseConfig(t, path, nil); err == nil || !strings.Contains(err.Error(), "chian") {
+		t.Errorf("expected an error about the unknown key, got %v", err)
+	}
+	//the checkpoint interval is the same for every terminal of a chain, so it cannot be set
+	path = writeConfig(t, "type: cash\ncheckpoint_interval: 64\n")
+	if _, err = parseConfig(t, path, nil); err == nil || !strings.Contains(err.Error(), "checkpoint_interval") {
+		t.Errorf("expected an error about checkpoint_interval, got %v", err)
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	path := writeConfig(t, "nick: till1\ntype: cash\nchain: store12\napi: 127.0.0.1:8080\n")
+	vars := map[string]string{"SPIRIT_TYPE": "retail", "SPIRIT_API": "127.0.0.1:8081", "SPIRIT_DHT": "true", "SPIRIT_ALLOW_LIST": "store12.peers"}
+
+	c, err := parseConfig(t, path, vars, "-api=127.0.0.1:8082", "-listen=/ip4/0.0.0.0/tcp/4001,/ip6/::/tcp/4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//flags win over the environment, which wins over the file
+	if c.Nick != "till1" || c.Type != "retail" || c.API != "127.0.0.1:8082" || !c.DHT || c.AllowList != "store12.peers" {
+		t.Errorf("unexpected config %+v", c)
+	}
+	if len(c.Listen) != 2 {
+		t.Errorf("expected two listen addresses, got %v", c.Listen)
+	}
+
+	//the config file can be given in the environment too
+	c, err = parseConfig(t, "", map[string]string{"SPIRIT_CONFIG": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Chain != "store12" {
+		t.Errorf("config file from the environment not read, chain is %s", c.Chain)
+	}
+
+	if _, err = parseConfig(t, path, map[string]string{"SPIRIT_DHT": "sometimes"}); err == nil || !strings.Contains(err.Error(), "SPIRIT_DHT") {
+		t.Errorf("expected an error naming SPIRIT_DHT, got %v", err)
+	}
+}
+
+func TestConfigEnvNestedSettings(t *testing.T) {
+	path := writeConfig(t, "type: cash\ndirs:\n  logs: /var/log/spirit\n")
+	vars := map[string]string{
+		"SPIRIT_DIRS_CHAINS":                     "/var/lib/spirit/chains",
+		"SPIRIT_RECEIPTS":                        "/var/lib/spirit/receipts",
+		"SPIRIT_DISCOVERY_INTERVAL":              "30s",
+		"SPIRIT_DISCOVERY_TAG":                   "store12",
+		"SPIRIT_LIMITS_TRANSACTIONS_BURST":       "10",
+		"SPIRIT_LIMITS_DUPLICATE_REQUEST_WINDOW": "5s",
+		"SPIRIT_PRESENCE_INTERVAL":               "5s",
+		"SPIRIT_LIMITS_INDEX_REQUESTS_RATE":      "0.25",
+		"SPIRIT_LIMITS_CHAIN_REQUESTS_BURST":     "100",
+		"SPIRIT_LISTEN":                          "/ip4/0.0.0.0/tcp/4001,/ip6/::/tcp/4001",
+	}
+	c, err := parseConfig(t, path, vars, "-receipts=Receipts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//every key of the file has a variable, and what the environment leaves out keeps the file or default
+	if c.Dirs.Chains != "/var/lib/spirit/chains" || c.Dirs.Logs != "/var/log/spirit" || c.Dirs.Receipts != "Receipts" {
+		t.Errorf("unexpected dirs %+v", c.Dirs)
+	}
+	if time.Duration(c.Discovery.Interval) != 30*time.Second || c.Discovery.Tag != "store12" {
+		t.Errorf("unexpected discovery %+v", c.Discovery)
+	}
+	if c.Limits.Transactions != (rateLimit{Rate: TransactionLimit.Rate, Burst: 10}) || c.Limits.IndexRequests.Rate != 0.25 ||
+		c.Limits.ChainRequests.Burst != 100 || time.Duration(c.Limits.DuplicateRequestWindow) != 5*time.Second {
+		t.Errorf("unexpected limits %+v", c.Limits)
+	}
+	if time.Duration(c.PresenceInterval) != 5*time.Second || len(c.Listen) != 2 {
+		t.Errorf("unexpected config %+v", c)
+	}
+
+	//the variable of a flag named differently from its key works too
+	c, err = parseConfig(t, path, map[string]string{"SPIRIT_RECEIPTS": "/var/lib/spirit/receipts"})
+	if err != nil || c.Dirs.Receipts != "/var/lib/spirit/receipts" {
+		t.Errorf("SPIRIT_RECEIPTS not applied: %v %v", c, err)
+	}
+
+	for _, name := range []string{"SPIRIT_DISCOVERY_INTERVAL", "SPIRIT_PRESENCE_INTERVAL", "SPIRIT_LIMITS_TRANSACTIONS_RATE"} {
+		if _, err = parseConfig(t, path, map[string]string{name: "often"}); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("expected an error naming %s, got %v", name, err)
+		}
+	}
+}
+
+func TestConfigDirs(t *testing.T) {
+	//the subcommands only need the dirs, so the rest of the config is not validated
+	path := writeConfig(t, "type: bank\ndirs:\n  chains: /var/lib/spirit/chains\n")
+	dirs, err := configDirs(path, env(map[string]string{"SPIRIT_DIRS_KEYS": "/etc/spirit/keys"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirs.Chains != "/var/lib/spirit/chains" || dirs.Keys != "/etc/spirit/keys" || dirs.Logs != "Logs" {
+		t.Errorf("unexpected dirs %+v", dirs)
+	}
+
+	dirs, err = configDirs("", env(map[string]string{"SPIRIT_CONFIG": path}))
+	if err != nil || dirs.Chains != "/var/lib/spirit/chains" {
+		t.Errorf("config file from the environment not read: %+v %v", dirs, err)
+	}
+	if _, err = configDirs(writeConfig(t, "chians: x\n"), env(nil)); err == nil {
+		t.Error("config with an unknown key accepted")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	path := writeConfig(t, `
+type: bank
+nick: "till; 1"
+listen: [not-an-address]
+peers: [/ip4/10.1.2.3/tcp/4001]
+api: 8080
+snapshot: seed.json
+limits:
+  index_requests: {rate: 0, burst: 5}
+presence_interval: 0s
+`)
+	_, err := parseConfig(t, path, nil)
+	if err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	//every problem is reported at once, each naming its setting
+	for _, setting := range []string{"type:", "nick:", "listen:", "peers:", "api:", "snapshot:", "limits.index_requests:", "presence_interval:"} {
+		if !strings.Contains(err.Error(), "\n  "+setting) {
+			t.Errorf("problem with %s not reported in:\n%s", setting, err)
+		}
+	}
+	if strings.Contains(err.Error(), "grpc:") {
+		t.Errorf("unset gRPC address reported as invalid:\n%s", err)
+	}
+}
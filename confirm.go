@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/rivo/tview"
+)
+
+//pendingTransaction is a transaction typed into the UI that waits for the user to confirm it
+type pendingTransaction struct {
+	CardId    int
+	Amount    float32
+	Confirmed bool
+}
+
+//confirmationText is the question of the confirmation dialog
+func confirmationText(tx pendingTransaction, balance float32, role string, nick string) string {
+	return fmt.Sprintf("Confirm transaction\n\nCard: %d\nAmount: %.2f\nBalance after: %.2f\nTerminal: %s (%s)",
+		tx.CardId, tx.Amount, balance+tx.Amount, role, nick)
+}
+
+/*confirmTransaction asks the user to confirm a transaction in a dialog over the dashboard and
+sends the answer to confirmCh. Cancel is focused, so that a stray enter does not publish it.
+Every dialog has a page of its own, so that answering one does not close another. The dialog
+runs in the event loop of the app, so it leaves writing to the chain view to handleEvents; the
+chain view redraws through the event loop*/
+func (ui *TerminalUI) confirmTransaction(tx pendingTransaction) {
+	text := confirmationText(tx, ui.cs.Ledger.Balance(tx.CardId), ui.cs.typePos, ui.cs.nickName)
+	ui.app.QueueUpdateDraw(func() {
+		ui.dialogs++
+		page := fmt.Sprintf("confirm-%d", ui.dialogs)
+		modal := tview.NewModal().
+			SetText(tview.Escape(text)).
+			AddButtons([]string{"Confirm", "Cancel"}).
+			SetFocus(1).
+			SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+				ui.pages.RemovePage(page)
+				ui.app.SetFocus(ui.inputField)
+				tx.Confirmed = buttonLabel == "Confirm"
+				//handleEvents may be waiting on the event loop, so the answer is handed over outside of it
+				go ui.deliverConfirmation(tx)
+			})
+		ui.pages.AddPage(page, modal, false, true)
+		ui.app.SetFocus(modal)
+	})
+}
+
+/*deliverConfirmation hands the answer of a confirmation dialog to handleEvents. It waits for
+handleEvents to take it, so that no answer is lost, unless the terminal shuts down first, in
+which case the transaction is reported as not made*/
+func (ui *TerminalUI) deliverConfirmation(tx pendingTransaction) {
+	select {
+	case ui.confirmCh <- tx:
+	case <-ui.cs.ctx.Done():
+		if tx.Confirmed {
+			ui.displaySystemMessage(fmt.Sprintf("Transaction of %.2f on card %d not made: the terminal is shutting down", tx.Amount, tx.CardId))
+		}
+	}
+}
+
+//printReceipt shows the receipt of a transaction made on this terminal and saves it to the receipt folder
+func (ui *TerminalUI) printReceipt(block *Block) {
+	balance, ok := ui.cs.Ledger.BalanceAfter(block.CardId, block.Index)
+	if !ok {
+		balance = ui.cs.Ledger.Balance(block.CardId)
+	}
+	receipt := NewReceipt(block, ui.cs.typePos, balance)
+	fmt.Fprintf(ui.chainViewWriter, "%s", tview.Escape(receipt.Text()))
+
+	if len(ui.receiptFolder) == 0 {
+		return
+	}
+	path, err := WriteReceipt(ui.receiptFolder, receipt)
+	if err != nil {
+		ui.displaySystemMessage(fmt.Sprintf("Problem saving receipt: %s", err))
+		return
+	}
+	ui.displayInfo(fmt.Sprintf("Receipt saved to %s", path))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+/*Daemon runs a terminal without the UI as a pure ledger replica, so that the node can run
+under systemd or in a container alongside the HTTP API and gRPC service. Blocks received
+from the network are applied by the ledger; the daemon only reports what happens to it and
+to the peers*/
+type Daemon struct {
+	cs *ChainSubscription
+}
+
+//NewDaemon creates a headless service loop for the chain
+func NewDaemon(cs *ChainSubscription) *Daemon {
+	return &Daemon{cs: cs}
+}
+
+//Run reports ledger events and changes in the liveness of the peers until ctx is cancelled
+func (d *Daemon) Run(ctx context.Context) error {
+	log.Printf("Running headless on chain %s as %s", d.cs.topicName, d.cs.nickName)
+
+	events, stop := d.cs.Ledger.Subscribe()
+	defer func() { stop() }()
+	peerCheckTicker := time.NewTicker(time.Second)
+	defer peerCheckTicker.Stop()
+	var peerStates map[string]string
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				//we fell behind the ledger, pick up from its current state
+				events, stop = d.cs.Ledger.Subscribe()
+				continue
+			}
+			switch ev.Type {
+			case EventBlockAdded:
+				log.Printf("Added block %d from %s", ev.Block.Index, ev.Block.SenderNick)
+			case EventBlockRejected:
+				log.Printf("Rejected block %d from %s: %s", ev.Block.Index, ev.Block.SenderNick, ev.Err)
+			case EventChainReplaced:
+				log.Printf("Synced chain up to block %d", ev.Block.Index)
+			}
+
+		case <-peerCheckTicker.C:
+			var alerts []peerAlert
+			alerts, peerStates = healthAlerts(peerStates, d.cs.PeerHealth())
+			for _, alert := range alerts {
+				log.Printf("%s", alert.Message)
+			}
+
+		case <-ctx.Done():
+			log.Printf("Shutting down headless terminal")
+			return nil
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+func TestDaemonShutsDown(t *testing.T) {
+	cs := newLocalTerminal(t, "cash")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- NewDaemon(cs).Run(ctx)
+	}()
+	if _, err := cs.SubmitTransaction(1, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("daemon stopped with %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("daemon did not stop when its context was cancelled")
+	}
+	//the daemon no longer listens to the ledger
+	cs.Ledger.mu.RLock()
+	defer cs.Ledger.mu.RUnlock()
+	if len(cs.Ledger.subscribers) != 0 {
+		t.Errorf("daemon left %d ledger subscriptions behind", len(cs.Ledger.subscribers))
+	}
+}
+
+func TestShutdownWhileSyncing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, hosts := newMockHosts(t, ctx, 1)
+	ps, err := pubsub.NewGossipSub(ctx, hosts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a signal during the initial sync cancels the context the terminal subscribes with
+	syncCtx, stop := context.WithCancel(ctx)
+	time.AfterFunc(100*time.Millisecond, stop)
+	start := time.Now()
+	cs, err := SubscribeToChain(syncCtx, ps, hosts[0].ID(), hosts[0].Peerstore().PrivKey(hosts[0].ID()), testChainName, "till", "cash", NewLedger(""))
+	if err != context.Canceled || cs != nil {
+		t.Errorf("expected the sync to stop with %s, got %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed >= SyncWaitTime {
+		t.Errorf("sync took %s to stop", elapsed)
+	}
+}
+
+func TestCloseStopsSubscription(t *testing.T) {
+	tn := newTestNetwork(t)
+	first := tn.addNode("first", "cash")
+	ledger := NewLedger(filepath.Join(t.TempDir(), "second.txt"))
+	second := tn.addNodeWithLedger("second", "retail", ledger)
+	tn.transact(first, 1, 10)
+
+	//once the subscription is stopped the ledger can be closed, and blocks that still arrive are not written to it
+	done := make(chan struct{})
+	go func() {
+		second.cs.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription did not stop")
+	}
+	ledger.Close()
+	tip := ledger.Latest()
+	if _, err := first.cs.SubmitTransaction(1, 5); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if ledger.Latest() != tip {
+		t.Errorf("block %d appended after the subscription was stopped", ledger.Latest().Index)
+	}
+}
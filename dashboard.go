@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+//ConfirmationDepth is how many blocks have to follow a transaction before it is shown as confirmed
+const ConfirmationDepth = 2
+
+//TransactionTableSize is the number of transactions listed on the dashboard
+const TransactionTableSize = 20
+
+//statuses of the transactions listed on the dashboard
+const (
+	TxPending   = "pending"
+	TxConfirmed = "confirmed"
+	TxDropped   = "dropped"
+)
+
+//confirmationStatus is the status of a transaction that confirmations blocks follow
+func confirmationStatus(confirmations int) string {
+	if confirmations < ConfirmationDepth {
+		return TxPending
+	}
+	return TxConfirmed
+}
+
+//transactionRow is a line of the transaction table
+type transactionRow struct {
+	Block  Block
+	Status string
+	Own    bool
+}
+
+/*transactionRows lists the last n transactions of the chain, newest first. A transaction is
+pending until ConfirmationDepth blocks follow it. Transactions made on this terminal that a
+sync has taken off the chain are listed first as dropped, so that they can be made again*/
+func transactionRows(ledger *Ledger, self string, submitted []Block, n int) []transactionRow {
+	latest := ledger.Latest()
+	var rows []transactionRow
+	for _, blk := range submitted {
+		if blk.Index > latest.Index {
+			rows = append(rows, transactionRow{Block: blk, Status: TxDropped, Own: true})
+			continue
+		}
+		//a pruned block cannot be checked, but it was behind a checkpoint so it is not dropped
+		if held := ledger.BlockAt(blk.Index); held != nil && held.Hash != blk.Hash {
+			rows = append(rows, transactionRow{Block: blk, Status: TxDropped, Own: true})
+		}
+	}
+
+	blocks := ledger.RecentBlocks(n)
+	for i := len(blocks) - 1; i >= 0 && len(rows) < n; i-- {
+		blk := blocks[i]
+		if blk.Index == 0 {
+			continue
+		}
+		rows = append(rows, transactionRow{Block: blk, Status: confirmationStatus(latest.Index - blk.Index), Own: blk.Sender == self})
+	}
+	return rows
+}
+
+/*syncStatusText is the line of the sync status bar: our height against the best height our
+peers have reported, and when we last synced*/
+func syncStatusText(latest int, peers []PeerStatus, lastSync time.Time, now time.Time) string {
+	best := -1
+	bestNick := ""
+	for _, p := range peers {
+		if p.Height > best {
+			best, bestNick = p.Height, p.Nick
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Chain at block %d", latest)
+	switch {
+	case best < 0:
+		b.WriteString(" | Best peer: unknown")
+	case best > latest:
+		fmt.Fprintf(&b, " | Best peer: %s at block %d, [yellow]%d blocks behind, type /sync[-]", tview.Escape(bestNick), best, best-latest)
+	default:
+		fmt.Fprintf(&b, " | Best peer: %s at block %d", tview.Escape(bestNick), best)
+	}
+	if lastSync.IsZero() {
+		b.WriteString(" | Last sync: never")
+	} else {
+		fmt.Fprintf(&b, " | Last sync: %s (%s ago)", lastSync.Format("15:04:05"), now.Sub(lastSync).Truncate(time.Second))
+	}
+	fmt.Fprintf(&b, " | Peers: %d", len(peers))
+	return b.String()
+}
+
+//networkStatusText heads the sync status bar while the terminal is cut off from the network
+func networkStatusText(state string, since time.Time) string {
+	if state == NetOnline {
+		return ""
+	}
+	return fmt.Sprintf("[red]Network %s since %s[-] | ", state, since.Format("15:04:05"))
+}
+
+//lastSeenText says how long ago a peer was last heard of
+func lastSeenText(lastSeen time.Time, now time.Time) string {
+	if lastSeen.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%s ago", now.Sub(lastSeen).Truncate(time.Second))
+}
+
+//cardLookupText is the content of the card lookup pane
+func cardLookupText(statement CardStatement) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Card %d\nBalance: %f\n\n", statement.CardId, statement.Balance)
+	if len(statement.Transactions) == 0 {
+		b.WriteString("No transactions")
+		return b.String()
+	}
+	for i := len(statement.Transactions) - 1; i >= 0; i-- {
+		tx := statement.Transactions[i]
+		fmt.Fprintf(&b, "Block %d: %+f -> %f (%s)\n", tx.Index, tx.Amount, tx.Balance, tview.Escape(tx.Terminal))
+	}
+	return b.String()
+}
+
+//tableHeader fills the first row of a table with column names
+func tableHeader(table *tview.Table, columns ...string) {
+	for i, col := range columns {
+		table.SetCell(0, i, tview.NewTableCell(col).SetTextColor(tcell.ColorYellow).SetSelectable(false))
+	}
+}
+
+//renderTransactions refreshes the transaction table
+func (ui *TerminalUI) renderTransactions() {
+	rows := transactionRows(ui.cs.Ledger, ui.cs.self.Pretty(), ui.submitted, TransactionTableSize)
+	ui.app.QueueUpdateDraw(func() {
+		ui.transactions.Clear()
+		tableHeader(ui.transactions, "Block", "Time", "Card", "Amount", "Terminal", "Status")
+		for i, row := range rows {
+			color := tcell.ColorWhite
+			switch {
+			case row.Status == TxDropped:
+				color = tcell.ColorRed
+			case row.Own:
+				color = tcell.ColorDodgerBlue
+			}
+			when := row.Block.Timestamp
+			if t, err := parseBlockTime(when); err == nil {
+				when = t.Format("15:04:05")
+			}
+			cells := []string{
+				fmt.Sprint(row.Block.Index),
+				when,
+				fmt.Sprint(row.Block.CardId),
+				fmt.Sprintf("%+.2f", row.Block.Amount),
+				tview.Escape(row.Block.SenderNick),
+				row.Status,
+			}
+			for j, text := range cells {
+				ui.transactions.SetCell(i+1, j, tview.NewTableCell(text).SetTextColor(color))
+			}
+		}
+	})
+}
+
+/*renderPeers refreshes the peers table and the sync status bar. Peers that have fallen behind
+are shown in yellow, and peers that have gone silent or disconnected in red*/
+func (ui *TerminalUI) renderPeers(health []PeerHealth) {
+	var connected []PeerStatus
+	for _, h := range health {
+		if h.Connected {
+			connected = append(connected, h.PeerStatus)
+		}
+	}
+	now := time.Now()
+	state, since := ui.cs.NetworkState()
+	status := networkStatusText(state, since) + syncStatusText(ui.cs.Ledger.Latest().Index, connected, ui.cs.LastSync(), now)
+	ui.app.QueueUpdateDraw(func() {
+		ui.peersTable.Clear()
+		tableHeader(ui.peersTable, "Nick", "Role", "Ver", "Block", "Lag", "State", "Last Seen", "Id")
+		for i, p := range health {
+			nick, role, version, height, lag := p.Nick, p.Type, p.Version, "?", "?"
+			if len(nick) == 0 {
+				nick = "?"
+			}
+			if len(role) == 0 {
+				role = "?"
+			}
+			if len(version) == 0 {
+				version = "?"
+			}
+			if p.Height >= 0 {
+				height = fmt.Sprint(p.Height)
+				lag = fmt.Sprint(p.Lag)
+			}
+			id := p.Id
+			if len(id) > 8 {
+				id = id[len(id)-8:]
+			}
+			//peers that have not announced themselves yet are greyed out, their nick and role are only claimed
+			color := tcell.ColorWhite
+			switch {
+			case p.State == PeerSilent || p.State == PeerGone:
+				color = tcell.ColorRed
+			case p.State == PeerBehind:
+				color = tcell.ColorYellow
+			case !p.Signed:
+				color = tcell.ColorGray
+			}
+			cells := []string{tview.Escape(nick), role, tview.Escape(version), height, lag, p.State, lastSeenText(p.LastSeen, now), id}
+			for j, text := range cells {
+				ui.peersTable.SetCell(i+1, j, tview.NewTableCell(text).SetTextColor(color))
+			}
+		}
+		ui.statusBar.SetText(status)
+	})
+}
+
+//renderCard refreshes the card lookup pane with the card last looked up
+func (ui *TerminalUI) renderCard() {
+	if ui.lookupCard < 1 {
+		return
+	}
+	text := cardLookupText(ui.cs.Ledger.CardHistory(ui.lookupCard, DefaultHistoryLength))
+	ui.app.QueueUpdateDraw(func() {
+		ui.cardView.SetText(text)
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransactionRows(t *testing.T) {
+	ledger := NewLedger("")
+	for i := 0; i < 4; i++ {
+		err := ledger.Append(nextBlock(ledger.Latest(), 1+i, 10, "test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	//a transaction of ours that a sync replaced with another block
+	dropped := *nextBlock(*ledger.BlockAt(2), 9, 5, "self")
+
+	rows := transactionRows(ledger, "self", []Block{*ledger.BlockAt(1), dropped}, 3)
+	if len(rows) != 3 {
+		t.Fatalf("got %d rows, expected 3", len(rows))
+	}
+	expected := []struct {
+		index  int
+		status string
+	}{{3, TxDropped}, {4, TxPending}, {3, TxPending}}
+	for i, e := range expected {
+		if rows[i].Block.Index != e.index || rows[i].Status != e.status {
+			t.Errorf("row %d: block %d %s, expected block %d %s", i, rows[i].Block.Index, rows[i].Status, e.index, e.status)
+		}
+	}
+
+	//blocks further down the chain are confirmed, and the genesis block is not listed
+	rows = transactionRows(ledger, "self", nil, 10)
+	if len(rows) != 4 || rows[3].Block.Index != 1 || rows[3].Status != TxConfirmed {
+		t.Errorf("unexpected rows %+v", rows)
+	}
+}
+
+func TestSyncStatusText(t *testing.T) {
+	now := time.Now()
+	peers := []PeerStatus{
+		{Nick: "mudit", Height: 12},
+		{Nick: "parth", Height: 15},
+		{Nick: "jeetu", Height: -1},
+	}
+	text := syncStatusText(10, peers, now.Add(-90*time.Second), now)
+	for _, expected := range []string{"Chain at block 10", "parth at block 15", "5 blocks behind", "(1m30s ago)", "Peers: 3"} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("status %q does not contain %q", text, expected)
+		}
+	}
+	text = syncStatusText(15, nil, time.Time{}, now)
+	if !strings.Contains(text, "Best peer: unknown") || !strings.Contains(text, "Last sync: never") {
+		t.Errorf("unexpected status %q", text)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+)
+
+//LedgerDiff is how two or more ledgers differ after their last common block
+type LedgerDiff struct {
+	//Ancestor is the index of the last block shared by every ledger, -1 if they share none
+	Ancestor int
+	//Branches holds the blocks of each ledger after the common ancestor
+	Branches [][]Block
+	//Balances holds the card balances at the end of each ledger
+	Balances []map[int]float32
+}
+
+//Identical tells whether all the ledgers hold the same chain
+func (d LedgerDiff) Identical() bool {
+	for _, branch := range d.Branches {
+		if len(branch) > 0 {
+			return false
+		}
+	}
+	return d.Ancestor >= 0
+}
+
+/*DiffChains finds the last block shared by all the chains, comparing the blocks at the same
+index by hash, and splits every chain into the common part and the branch after it. A pruned
+chain starts at the block of its checkpoint, so chains are only compared over the indices they
+all hold. checkpoints holds the checkpoint of each pruned chain, which its balances start from,
+and nil for a chain that starts at genesis*/
+func DiffChains(chains [][]Block, checkpoints []*Checkpoint) LedgerDiff {
+	diff := LedgerDiff{Ancestor: -1}
+
+	//the indices held by every chain
+	first, last := chains[0][0].Index, chains[0][len(chains[0])-1].Index
+	for _, chain := range chains[1:] {
+		if chain[0].Index > first {
+			first = chain[0].Index
+		}
+		if tip := chain[len(chain)-1].Index; tip < last {
+			last = tip
+		}
+	}
+	//blocks link by hash, so once the chains differ at an index they differ at every later one
+	for index := first; index <= last; index++ {
+		hash := chains[0][index-chains[0][0].Index].Hash
+		shared := true
+		for _, chain := range chains[1:] {
+			if chain[index-chain[0].Index].Hash != hash {
+				shared = false
+				break
+			}
+		}
+		if !shared {
+			break
+		}
+		diff.Ancestor = index
+	}
+
+	for i, chain := range chains {
+		from := 0
+		if diff.Ancestor >= 0 {
+			from = diff.Ancestor - chain[0].Index + 1
+		}
+		diff.Branches = append(diff.Branches, chain[from:])
+
+		balances := make(map[int]float32)
+		if cp := checkpoints[i]; cp != nil {
+			for cardId, balance := range cp.Balances {
+				balances[cardId] = balance
+			}
+		}
+		for _, blk := range chain[1:] {
+			balances[blk.CardId] += blk.Amount
+		}
+		diff.Balances = append(diff.Balances, balances)
+	}
+	return diff
+}
+
+//printLedgerDiff writes the common ancestor, the diverging branches and the card balances that differ
+func printLedgerDiff(w io.Writer, paths []string, chains [][]Block, diff LedgerDiff) {
+	pruned := false
+	for _, chain := range chains {
+		pruned = pruned || chain[0].Index > 0
+	}
+	switch {
+	case diff.Ancestor < 0 && pruned:
+		fmt.Fprintf(w, "no common ancestor: the ledgers share none of the blocks they hold, which start after pruning\n")
+	case diff.Ancestor < 0:
+		fmt.Fprintf(w, "no common ancestor: the ledgers start from different genesis blocks\n")
+	default:
+		ancestor := chains[0][diff.Ancestor-chains[0][0].Index]
+		fmt.Fprintf(w, "common ancestor: block %d, hash %s\n", ancestor.Index, ancestor.Hash)
+	}
+
+	for i, path := range paths {
+		branch := diff.Branches[i]
+		fmt.Fprintf(w, "\n%s: %d blocks after the common ancestor\n", path, len(branch))
+		for _, blk := range branch {
+			fmt.Fprintf(w, "  + %s", blk.pretty())
+		}
+	}
+
+	cards := make(map[int]bool)
+	for _, balances := range diff.Balances {
+		for cardId := range balances {
+			cards[cardId] = true
+		}
+	}
+	var cardIds []int
+	for cardId := range cards {
+		differ := false
+		for _, balances := range diff.Balances {
+			if balances[cardId] != diff.Balances[0][cardId] {
+				differ = true
+			}
+		}
+		if differ {
+			cardIds = append(cardIds, cardId)
+		}
+	}
+	sort.Ints(cardIds)
+
+	if len(cardIds) == 0 {
+		fmt.Fprintf(w, "\ncard balances: no differences\n")
+		return
+	}
+	fmt.Fprintf(w, "\ncard balances that differ:\n")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "  card")
+	for _, path := range paths {
+		fmt.Fprintf(tw, "\t%s", filepath.Base(path))
+	}
+	fmt.Fprintf(tw, "\t\n")
+	for _, cardId := range cardIds {
+		fmt.Fprintf(tw, "  %d", cardId)
+		for _, balances := range diff.Balances {
+			fmt.Fprintf(tw, "\t%f", balances[cardId])
+		}
+		fmt.Fprintf(tw, "\t\n")
+	}
+	tw.Flush()
+}
+
+/*runDiff implements the diff subcommand. Like diff(1) it returns 0 if the ledgers are
+identical, 1 if they differ and 2 on errors*/
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff CHAIN_FILE CHAIN_FILE [CHAIN_FILE...]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Finds the common ancestor of persisted ledgers and shows how they diverge.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	paths := fs.Args()
+	if len(paths) < 2 {
+		fs.Usage()
+		return 2
+	}
+
+	chains := make([][]Block, len(paths))
+	checkpoints := make([]*Checkpoint, len(paths))
+	for i, path := range paths {
+		chain, err := ReadChainFile(path)
+		if err != nil {
+			printErr("%s\n", err)
+			return 2
+		}
+		chains[i] = chain
+		//the balances of a pruned ledger start from the checkpoint kept next to it
+		if chain[0].Index > 0 {
+			cp, err := ReadCheckpointFile(path + CheckpointFileSuffix)
+			if err != nil {
+				printErr("%s: chain is pruned at block %d but its checkpoint cannot be read: %s\n", path, chain[0].Index, err)
+				return 2
+			}
+			if cp.Index != chain[0].Index || cp.BlockHash != chain[0].Hash || cp.Verify() != nil {
+				printErr("%s: checkpoint does not match the first block of the chain\n", path)
+				return 2
+			}
+			checkpoints[i] = cp
+		}
+	}
+
+	diff := DiffChains(chains, checkpoints)
+	printLedgerDiff(os.Stdout, paths, chains, diff)
+	if diff.Identical() {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestDiffChains(t *testing.T) {
+	base := testChain()
+	left := append(append([]Block{}, base...), *nextBlock(base[len(base)-1], 1, -4.5, "left"))
+	right := append(append([]Block{}, base...), *nextBlock(base[len(base)-1], 2, 7, "right"))
+	right = append(right, *nextBlock(right[len(right)-1], 1, 1, "right"))
+
+	diff := DiffChains([][]Block{left, right, base}, make([]*Checkpoint, 3))
+	if diff.Identical() {
+		t.Fatal("diverging chains reported as identical")
+	}
+	if diff.Ancestor != len(base)-1 {
+		t.Errorf("expected common ancestor at %d, got %d", len(base)-1, diff.Ancestor)
+	}
+	if len(diff.Branches[0]) != 1 || len(diff.Branches[1]) != 2 || len(diff.Branches[2]) != 0 {
+		t.Errorf("unexpected branch lengths %d %d %d", len(diff.Branches[0]), len(diff.Branches[1]), len(diff.Branches[2]))
+	}
+	if diff.Balances[0][1] != 60 || diff.Balances[1][1] != 65.5 || diff.Balances[1][2] != 7 {
+		t.Errorf("unexpected balances %v", diff.Balances)
+	}
+
+	if !DiffChains([][]Block{base, base}, make([]*Checkpoint, 2)).Identical() {
+		t.Error("identical chains reported as different")
+	}
+}
+
+func TestDiffPrunedChains(t *testing.T) {
+	base := testChain()
+	left := append(append([]Block{}, base...), *nextBlock(base[len(base)-1], 1, -4.5, "left"))
+	right := append(append([]Block{}, base...), *nextBlock(base[len(base)-1], 2, 7, "right"))
+	right = append(right, *nextBlock(right[len(right)-1], 1, 1, "right"))
+
+	//the right ledger is pruned at block 3, so its balances start from the checkpoint there
+	pruned := right[3:]
+	cp := newCheckpoint(right[3], VerifyChain(right[:4]).Balances)
+	diff := DiffChains([][]Block{left, pruned}, []*Checkpoint{nil, cp})
+	if diff.Ancestor != len(base)-1 {
+		t.Errorf("expected common ancestor at block %d, got %d", len(base)-1, diff.Ancestor)
+	}
+	if len(diff.Branches[0]) != 1 || len(diff.Branches[1]) != 2 || diff.Branches[1][0].Index != len(base) {
+		t.Errorf("unexpected branches %v", diff.Branches)
+	}
+	if diff.Balances[0][1] != 60 || diff.Balances[1][1] != 65.5 || diff.Balances[1][2] != 7 {
+		t.Errorf("unexpected balances %v", diff.Balances)
+	}
+
+	if !DiffChains([][]Block{pruned, right}, []*Checkpoint{cp, nil}).Identical() {
+		t.Error("pruned chain reported as different from the full one")
+	}
+	//after the fork the ledgers hold no block in common
+	if diff = DiffChains([][]Block{left[len(base):], right[len(base):]}, []*Checkpoint{nil, nil}); diff.Ancestor != -1 {
+		t.Errorf("expected no common ancestor, got %d", diff.Ancestor)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//ExportColumns are the column names of an export, in order. They are part of the export format and must not change
+var ExportColumns = []string{"index", "timestamp", "card_id", "amount", "terminal", "terminal_id", "hash", "prev_hash"}
+
+//ErrExportFormat is returned for an export format other than csv or jsonl
+var ErrExportFormat = errors.New("export format must be csv or jsonl")
+
+//blockTimeLayout is how time.Time.String() writes the block timestamps, without the monotonic clock reading
+const blockTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+//ExportFilter selects the blocks that go into an export. Zero fields match every block
+type ExportFilter struct {
+	From     time.Time
+	To       time.Time
+	CardId   int
+	Terminal string
+}
+
+/*ParseExportFilter builds a filter from user input. Dates are YYYY-MM-DD, taken as whole days
+in the local time zone, or RFC 3339 times. The terminal matches the nickname or the peer id*/
+func ParseExportFilter(from string, to string, cardId int, terminal string) (ExportFilter, error) {
+	filter := ExportFilter{CardId: cardId, Terminal: terminal}
+	var err error
+	if len(from) > 0 {
+		filter.From, _, err = parseExportDate(from)
+		if err != nil {
+			return filter, fmt.Errorf("invalid from date: %s", err)
+		}
+	}
+	if len(to) > 0 {
+		var wholeDay bool
+		filter.To, wholeDay, err = parseExportDate(to)
+		if err != nil {
+			return filter, fmt.Errorf("invalid to date: %s", err)
+		}
+		if wholeDay {
+			filter.To = filter.To.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+	}
+	return filter, nil
+}
+
+//parseExportDate reads a date or a time, and tells whether it was a whole day
+func parseExportDate(s string) (time.Time, bool, error) {
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err == nil {
+		return t, true, nil
+	}
+	t, err = time.Parse(time.RFC3339, s)
+	return t, false, err
+}
+
+//parseBlockTime reads the timestamp of a block, which may end in the monotonic clock reading of time.Time.String()
+func parseBlockTime(ts string) (time.Time, error) {
+	if i := strings.Index(ts, " m="); i >= 0 {
+		if _, err := strconv.ParseFloat(ts[i+3:], 64); err != nil {
+			return time.Time{}, fmt.Errorf("invalid clock reading in %q", ts)
+		}
+		ts = ts[:i]
+	}
+	return time.Parse(blockTimeLayout, ts)
+}
+
+//Match tells whether a block passes the filter
+func (f ExportFilter) Match(block *Block) (bool, error) {
+	if f.CardId != 0 && block.CardId != f.CardId {
+		return false, nil
+	}
+	if len(f.Terminal) > 0 && block.SenderNick != f.Terminal && block.Sender != f.Terminal {
+		return false, nil
+	}
+	if f.From.IsZero() && f.To.IsZero() {
+		return true, nil
+	}
+	t, err := parseBlockTime(block.Timestamp)
+	if err != nil {
+		return false, fmt.Errorf("block %d: %s", block.Index, err)
+	}
+	if !f.From.IsZero() && t.Before(f.From) {
+		return false, nil
+	}
+	if !f.To.IsZero() && t.After(f.To) {
+		return false, nil
+	}
+	return true, nil
+}
+
+//exactAmount writes an amount as the shortest decimal that reads back as the same float32, e.g. 35.5 or 0.1
+func exactAmount(amount float32) string {
+	return strconv.FormatFloat(float64(amount), 'f', -1, 32)
+}
+
+//exportTimestamp writes a block timestamp as RFC 3339, or as stored if it cannot be read
+func exportTimestamp(ts string) string {
+	t, err := parseBlockTime(ts)
+	if err != nil {
+		return ts
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+//exportRecord is a block as it appears in an export, with values in the order of ExportColumns
+func exportRecord(block *Block) []string {
+	return []string{
+		strconv.Itoa(block.Index),
+		exportTimestamp(block.Timestamp),
+		strconv.Itoa(block.CardId),
+		exactAmount(block.Amount),
+		block.SenderNick,
+		block.Sender,
+		block.Hash,
+		block.PrevHash,
+	}
+}
+
+/*WriteExport writes the transactions of a chain that pass the filter as CSV (with a header
+row) or JSON Lines. The genesis block is not a transaction and is left out*/
+func WriteExport(w io.Writer, format string, chain []Block, filter ExportFilter) error {
+	ew, err := NewExportWriter(w, format, filter)
+	if err != nil {
+		return err
+	}
+	err = ew.Write(chain)
+	if err != nil {
+		return err
+	}
+	return ew.Flush()
+}
+
+/*ExportWriter writes an export a batch of blocks at a time, so that a long chain can be
+exported without holding all of it in memory*/
+type ExportWriter struct {
+	filter ExportFilter
+	record func(record []string) error
+	flush  func() error
+}
+
+//NewExportWriter starts an export in a format, writing the CSV header row straight away
+func NewExportWriter(w io.Writer, format string, filter ExportFilter) (*ExportWriter, error) {
+	ew := &ExportWriter{filter: filter}
+
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		err := cw.Write(ExportColumns)
+		if err != nil {
+			return nil, err
+		}
+		ew.record = cw.Write
+		ew.flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case "jsonl":
+		ew.record = func(record []string) error {
+			//fields are written in column order. index, card id and amount are JSON numbers, the rest strings
+			var line bytes.Buffer
+			line.WriteByte('{')
+			for i, col := range ExportColumns {
+				if i > 0 {
+					line.WriteByte(',')
+				}
+				key, _ := json.Marshal(col)
+				line.Write(key)
+				line.WriteByte(':')
+				switch col {
+				case "index", "card_id", "amount":
+					line.WriteString(record[i])
+				default:
+					value, _ := json.Marshal(record[i])
+					line.Write(value)
+				}
+			}
+			line.WriteString("}\n")
+			_, err := w.Write(line.Bytes())
+			return err
+		}
+		ew.flush = func() error { return nil }
+	default:
+		return nil, ErrExportFormat
+	}
+	return ew, nil
+}
+
+//Write adds the blocks that pass the filter to the export, leaving out the genesis block
+func (ew *ExportWriter) Write(blocks []Block) error {
+	for i := range blocks {
+		if blocks[i].Index == 0 {
+			continue
+		}
+		ok, err := ew.filter.Match(&blocks[i])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		err = ew.record(exportRecord(&blocks[i]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Flush writes out anything the export still buffers
+func (ew *ExportWriter) Flush() error {
+	return ew.flush()
+}
+
+/*ExportLedger writes the transactions of a ledger to an export a page at a time, up to the
+block that was latest when it started, and flushes it*/
+func ExportLedger(ew *ExportWriter, ledger *Ledger) error {
+	latest := ledger.Latest().Index
+	for from := 0; from <= latest; {
+		page := ledger.Page(from, SyncBatchSize)
+		blocks := page.Blocks
+		for len(blocks) > 0 && blocks[len(blocks)-1].Index > latest {
+			blocks = blocks[:len(blocks)-1]
+		}
+		if len(blocks) == 0 {
+			break
+		}
+		err := ew.Write(blocks)
+		if err != nil {
+			return err
+		}
+		from = blocks[len(blocks)-1].Index + 1
+	}
+	return ew.Flush()
+}
+
+//runExport implements the export subcommand and returns the exit code
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	formatFlag := fs.String("format", "csv", "output format i.e csv or jsonl")
+	outFlag := fs.String("o", "", "file to write the export to. standard output if left empty")
+	fromFlag := fs.String("from", "", "only transactions on or after this date (YYYY-MM-DD or RFC 3339)")
+	toFlag := fs.String("to", "", "only transactions on or before this date (YYYY-MM-DD or RFC 3339)")
+	cardFlag := fs.Int("card", 0, "only transactions on this card")
+	terminalFlag := fs.String("terminal", "", "only transactions made on this terminal (nickname or peer id)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export [FLAGS] CHAIN_FILE\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Writes the transactions of a persisted ledger as CSV or JSON Lines with columns\n%s\n", strings.Join(ExportColumns, ","))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	filter, err := ParseExportFilter(*fromFlag, *toFlag, *cardFlag, *terminalFlag)
+	if err != nil {
+		printErr("%s\n", err)
+		return 2
+	}
+	chain, err := ReadChainFile(fs.Arg(0))
+	if err != nil {
+		printErr("%s\n", err)
+		return 2
+	}
+
+	out := io.Writer(os.Stdout)
+	if len(*outFlag) > 0 {
+		file, err := os.Create(*outFlag)
+		if err != nil {
+			printErr("%s\n", err)
+			return 2
+		}
+		defer file.Close()
+		out = file
+	}
+
+	err = WriteExport(out, *formatFlag, chain, filter)
+	if err != nil {
+		printErr("%s\n", err)
+		return 1
+	}
+	return 0
+}
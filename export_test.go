@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteExport(t *testing.T) {
+	chain := testChain()
+	chain[2].SenderNick = "canteen"
+	chain[3].Amount = 0.1
+
+	var buf bytes.Buffer
+	err := WriteExport(&buf, "csv", chain, ExportFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(records[0], ",") != strings.Join(ExportColumns, ",") {
+		t.Errorf("unexpected header %v", records[0])
+	}
+	if len(records) != len(chain) {
+		t.Fatalf("expected %d rows with the header and without genesis, got %d", len(chain), len(records))
+	}
+	if records[3][3] != "0.1" || records[1][3] != "100" {
+		t.Errorf("amounts not exact: %q %q", records[3][3], records[1][3])
+	}
+	if _, err := time.Parse(time.RFC3339Nano, records[1][1]); err != nil {
+		t.Errorf("timestamp not RFC 3339: %s", err)
+	}
+
+	buf.Reset()
+	err = WriteExport(&buf, "jsonl", chain, ExportFilter{CardId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 transactions on card 1, got %d", len(lines))
+	}
+	if !strings.HasPrefix(lines[1], `{"index":3,`) || !strings.Contains(lines[1], `"amount":0.1,`) {
+		t.Errorf("unexpected line %s", lines[1])
+	}
+	var row map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &row); err != nil {
+		t.Fatal(err)
+	}
+	if len(row) != len(ExportColumns) {
+		t.Errorf("expected %d fields, got %v", len(ExportColumns), row)
+	}
+
+	buf.Reset()
+	WriteExport(&buf, "csv", chain, ExportFilter{Terminal: "canteen"})
+	if n := strings.Count(buf.String(), "\n"); n != 2 {
+		t.Errorf("expected 1 transaction from canteen, got %d", n-1)
+	}
+
+	tomorrow := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
+	filter, err := ParseExportFilter(tomorrow, "", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	WriteExport(&buf, "csv", chain, filter)
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Errorf("expected no transactions from tomorrow, got %d", n-1)
+	}
+
+	if WriteExport(&buf, "parquet", chain, ExportFilter{}) != ErrExportFormat {
+		t.Error("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"example.com/spiritpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*GRPCServer implements the SpiritChain gRPC service defined in spiritpb/spiritchain.proto.
+Like the HTTP API, every call goes through the ChainSubscription methods used by the UI*/
+type GRPCServer struct {
+	spiritpb.UnimplementedSpiritChainServer
+	cs  *ChainSubscription
+	srv *grpc.Server
+	//closing is closed by Close to end the block watches, which would otherwise never finish
+	closing chan struct{}
+}
+
+//GRPCShutdownTimeout is how long Close waits for the calls in progress to finish before cutting them off
+var GRPCShutdownTimeout = 5 * time.Second
+
+//NewGRPCServer creates a gRPC server for the chain
+func NewGRPCServer(cs *ChainSubscription) *GRPCServer {
+	s := &GRPCServer{
+		cs:      cs,
+		srv:     grpc.NewServer(),
+		closing: make(chan struct{}),
+	}
+	spiritpb.RegisterSpiritChainServer(s.srv, s)
+	return s
+}
+
+//ListenAndServe serves the gRPC service on addr (e.g. 127.0.0.1:9090) until Close is called
+func (s *GRPCServer) ListenAndServe(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Starting gRPC server on %s", addr)
+	return s.srv.Serve(lis)
+}
+
+/*Close stops the gRPC server. It ends all open block watches and lets the other calls in
+progress finish, for up to GRPCShutdownTimeout*/
+func (s *GRPCServer) Close() {
+	close(s.closing)
+	stopped := make(chan struct{})
+	go func() {
+		s.srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(GRPCShutdownTimeout):
+		log.Printf("gRPC calls still running after %s, stopping anyway", GRPCShutdownTimeout)
+		s.srv.Stop()
+	}
+}
+
+func (s *GRPCServer) SubmitTransaction(ctx context.Context, req *spiritpb.SubmitTransactionRequest) (*spiritpb.TransactionStatus, error) {
+	block, err := s.cs.SubmitTransaction(int(req.CardId), req.Amount)
+	switch err {
+	case nil:
+		return &spiritpb.TransactionStatus{
+			Status: TxPending,
+			Block:  toProtoBlock(block),
+		}, nil
+	case ErrInvalidCard, ErrZeroAmount:
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case ErrCashDeduction, ErrRetailCredit:
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	case ErrInvalidTransaction:
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case ErrRateLimited:
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		log.Printf("Error submitting transaction from gRPC: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+}
+
+func (s *GRPCServer) GetBalance(ctx context.Context, req *spiritpb.GetBalanceRequest) (*spiritpb.Balance, error) {
+	if req.CardId < 1 {
+		return nil, status.Error(codes.InvalidArgument, ErrInvalidCard.Error())
+	}
+	return &spiritpb.Balance{
+		CardId:  req.CardId,
+		Balance: s.cs.Ledger.Balance(int(req.CardId)),
+	}, nil
+}
+
+func (s *GRPCServer) GetBlock(ctx context.Context, req *spiritpb.GetBlockRequest) (*spiritpb.Block, error) {
+	var block *Block
+	switch sel := req.Selector.(type) {
+	case *spiritpb.GetBlockRequest_Index:
+		block = s.cs.Ledger.BlockAt(int(sel.Index))
+	case *spiritpb.GetBlockRequest_Hash:
+		block = s.cs.Ledger.FindBlock(sel.Hash)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "either index or hash must be given")
+	}
+	if block == nil {
+		return nil, status.Error(codes.NotFound, "block not found")
+	}
+	return toProtoBlock(block), nil
+}
+
+/*WatchBlocks streams the blocks of the chain as they are appended. A client that lost its
+stream resumes with from_index, and is sent the blocks it missed first. A sync that replaces
+the chain only tells subscribers about the new tip, so the blocks of the new chain from where
+it differs from the old one are sent again*/
+func (s *GRPCServer) WatchBlocks(req *spiritpb.WatchBlocksRequest, stream spiritpb.SpiritChain_WatchBlocksServer) error {
+	//subscribe before reading the chain, so that no block is missed in between
+	events, stop := s.cs.Ledger.Subscribe()
+	defer stop()
+
+	//next is the index of the first block not sent yet, 0 until the chain is read
+	next := 0
+	if req.FromIndex > 0 {
+		var err error
+		next, err = s.sendBlocks(stream, int(req.FromIndex), s.cs.Ledger.Latest().Index)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "client fell too far behind the chain")
+			}
+			var err error
+			switch ev.Type {
+			case EventBlockAdded:
+				//blocks read from the chain above are sent already
+				if ev.Block.Index < next {
+					continue
+				}
+				err = stream.Send(toProtoBlock(&ev.Block))
+				next = ev.Block.Index + 1
+			case EventChainReplaced:
+				next, err = s.sendBlocks(stream, ev.Fork, ev.Block.Index)
+			}
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		case <-s.closing:
+			return nil
+		}
+	}
+}
+
+//sendBlocks sends the blocks of the chain from index from up to index to, a page at a time, and returns the index after the last block sent
+func (s *GRPCServer) sendBlocks(stream spiritpb.SpiritChain_WatchBlocksServer, from int, to int) (int, error) {
+	next := from
+	for next <= to {
+		page := s.cs.Ledger.Page(next, SyncBatchSize)
+		if len(page.Blocks) == 0 || page.Blocks[0].Index > to {
+			break
+		}
+		for i := range page.Blocks {
+			if page.Blocks[i].Index > to {
+				break
+			}
+			err := stream.Send(toProtoBlock(&page.Blocks[i]))
+			if err != nil {
+				return next, err
+			}
+			next = page.Blocks[i].Index + 1
+		}
+	}
+	return next, nil
+}
+
+func (s *GRPCServer) ListPeers(ctx context.Context, req *spiritpb.ListPeersRequest) (*spiritpb.PeerList, error) {
+	list := &spiritpb.PeerList{}
+	for _, p := range s.cs.PeerStatuses() {
+		list.Peers = append(list.Peers, toProtoPeer(p))
+	}
+	return list, nil
+}
+
+func (s *GRPCServer) ListPeerHealth(ctx context.Context, req *spiritpb.ListPeersRequest) (*spiritpb.PeerList, error) {
+	list := &spiritpb.PeerList{}
+	for _, h := range s.cs.PeerHealth() {
+		peer := toProtoPeer(h.PeerStatus)
+		peer.Lag = int64(h.Lag)
+		peer.State = h.State
+		peer.Connected = h.Connected
+		list.Peers = append(list.Peers, peer)
+	}
+	return list, nil
+}
+
+func toProtoPeer(p PeerStatus) *spiritpb.Peer {
+	peer := &spiritpb.Peer{
+		PeerId:  p.Id,
+		Nick:    p.Nick,
+		Role:    p.Type,
+		Version: p.Version,
+		Height:  int64(p.Height),
+		Signed:  p.Signed,
+	}
+	if !p.LastSeen.IsZero() {
+		peer.LastSeen = p.LastSeen.Format(time.RFC3339)
+	}
+	return peer
+}
+
+func toProtoBlock(block *Block) *spiritpb.Block {
+	return &spiritpb.Block{
+		Index:      int64(block.Index),
+		PrevHash:   block.PrevHash,
+		Timestamp:  block.Timestamp,
+		CardId:     int64(block.CardId),
+		Amount:     block.Amount,
+		Hash:       block.Hash,
+		Sender:     block.Sender,
+		SenderNick: block.SenderNick,
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"example.com/spiritpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+//newGRPCClient serves the gRPC service of a terminal over an in-memory connection and returns a client for it
+func newGRPCClient(t *testing.T, cs *ChainSubscription) spiritpb.SpiritChainClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	s := NewGRPCServer(cs)
+	go s.srv.Serve(lis)
+	t.Cleanup(s.Close)
+
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return spiritpb.NewSpiritChainClient(conn)
+}
+
+func TestGRPCService(t *testing.T) {
+	cs := newLocalTerminal(t, "cash")
+	client := newGRPCClient(t, cs)
+	ctx := context.Background()
+
+	tx, err := client.SubmitTransaction(ctx, &spiritpb.SubmitTransactionRequest{CardId: 7, Amount: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Status != TxPending || tx.Block.Index != 1 {
+		t.Errorf("unexpected status %+v", tx)
+	}
+	balance, err := client.GetBalance(ctx, &spiritpb.GetBalanceRequest{CardId: 7})
+	if err != nil || balance.Balance != 20 {
+		t.Errorf("expected a balance of 20 on card 7, got %v %v", balance, err)
+	}
+	block, err := client.GetBlock(ctx, &spiritpb.GetBlockRequest{Selector: &spiritpb.GetBlockRequest_Hash{Hash: tx.Block.Hash}})
+	if err != nil || block.Index != 1 {
+		t.Errorf("block not found by its hash: %v %v", block, err)
+	}
+
+	//the errors of SubmitTransaction map to status codes
+	calls := []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{"invalid card", func() error {
+			_, err := client.SubmitTransaction(ctx, &spiritpb.SubmitTransactionRequest{CardId: 0, Amount: 5})
+			return err
+		}, codes.InvalidArgument},
+		{"deduction on cash", func() error {
+			_, err := client.SubmitTransaction(ctx, &spiritpb.SubmitTransactionRequest{CardId: 7, Amount: -5})
+			return err
+		}, codes.PermissionDenied},
+		{"missing block", func() error {
+			_, err := client.GetBlock(ctx, &spiritpb.GetBlockRequest{Selector: &spiritpb.GetBlockRequest_Index{Index: 99}})
+			return err
+		}, codes.NotFound},
+		{"no selector", func() error {
+			_, err := client.GetBlock(ctx, &spiritpb.GetBlockRequest{})
+			return err
+		}, codes.InvalidArgument},
+	}
+	for _, c := range calls {
+		if code := status.Code(c.call()); code != c.code {
+			t.Errorf("%s: expected %s, got %s", c.name, c.code, code)
+		}
+	}
+}
+
+//recvBlocks reads the next n blocks from a watch
+func recvBlocks(t *testing.T, watch spiritpb.SpiritChain_WatchBlocksClient, n int) []*spiritpb.Block {
+	t.Helper()
+	var blocks []*spiritpb.Block
+	for len(blocks) < n {
+		block, err := watch.Recv()
+		if err != nil {
+			t.Fatalf("after %d of %d blocks: %s", len(blocks), n, err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+func TestWatchBlocks(t *testing.T) {
+	cs := newLocalTerminal(t, "cash")
+	var chain []Block
+	for i := 0; i < 3; i++ {
+		blk := nextBlock(cs.Ledger.Latest(), 1, 10, "cash")
+		if err := cs.Ledger.Append(blk); err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, *blk)
+	}
+	client := newGRPCClient(t, cs)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	//a client resuming from block 2 is sent what it missed, then the new blocks
+	watch, err := client.WatchBlocks(ctx, &spiritpb.WatchBlocksRequest{FromIndex: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := recvBlocks(t, watch, 2)
+	if blocks[0].Index != 2 || blocks[1].Hash != chain[2].Hash {
+		t.Errorf("expected blocks 2 and 3, got %v", blocks)
+	}
+	if _, err = cs.SubmitTransaction(1, 5); err != nil {
+		t.Fatal(err)
+	}
+	if blocks = recvBlocks(t, watch, 1); blocks[0].Index != 4 {
+		t.Errorf("expected block 4, got %v", blocks[0])
+	}
+
+	//a sync replaces the chain with a fork from block 2 on, which is sent from where it differs
+	fork := []Block{*cs.Ledger.BlockAt(0), chain[0]}
+	for i := 0; i < 4; i++ {
+		fork = append(fork, *nextBlock(fork[len(fork)-1], 2, 1, "other"))
+	}
+	if err = cs.Ledger.Replace(fork); err != nil {
+		t.Fatal(err)
+	}
+	blocks = recvBlocks(t, watch, 4)
+	for i, block := range blocks {
+		if block.Hash != fork[i+2].Hash {
+			t.Errorf("block %d of the fork: expected %s, got %s", fork[i+2].Index, fork[i+2].Hash, block.Hash)
+		}
+	}
+}
+
+func TestGRPCCloseEndsWatches(t *testing.T) {
+	cs := newLocalTerminal(t, "cash")
+	lis := bufconn.Listen(1 << 20)
+	s := NewGRPCServer(cs)
+	go s.srv.Serve(lis)
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = cs.SubmitTransaction(1, 5); err != nil {
+		t.Fatal(err)
+	}
+	//the first block is only sent once the watch is running
+	watch, err := spiritpb.NewSpiritChainClient(conn).WatchBlocks(context.Background(), &spiritpb.WatchBlocksRequest{FromIndex: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recvBlocks(t, watch, 1)
+
+	//an open watch does not hold up the shutdown, and ends cleanly
+	start := time.Now()
+	s.Close()
+	if elapsed := time.Since(start); elapsed >= GRPCShutdownTimeout {
+		t.Errorf("shutdown took %s, the watch was not ended", elapsed)
+	}
+	if _, err = watch.Recv(); err != io.EOF {
+		t.Errorf("expected the watch to end with EOF, got %v", err)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	host "github.com/libp2p/go-libp2p-core/host"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+//testChainName is the topic every node of a test network joins
+const testChainName = "spiritchain-test"
+
+/*testNetwork runs terminals on in-process libp2p hosts connected by mocknet, all joined to
+one gossipsub topic, so that the pubsub protocol can be exercised without mDNS or real
+sockets. Nodes are added one at a time, like terminals started a few seconds apart*/
+type testNetwork struct {
+	t      *testing.T
+	ctx    context.Context
+	cancel context.CancelFunc
+	mn     mocknet.Mocknet
+	nodes  []*testNode
+}
+
+//testNode is a single terminal of a test network
+type testNode struct {
+	nick string
+	host host.Host
+	cs   *ChainSubscription
+}
+
+//newTestNetwork creates an empty test network. It is shut down when the test ends
+func newTestNetwork(t *testing.T) *testNetwork {
+	log.SetOutput(ioutil.Discard)
+	syncWait := SyncWaitTime
+	SyncWaitTime = time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tn := &testNetwork{
+		t:      t,
+		ctx:    ctx,
+		cancel: cancel,
+		mn:     mocknet.New(ctx),
+	}
+	t.Cleanup(func() {
+		cancel()
+		for _, n := range tn.nodes {
+			n.host.Close()
+		}
+		SyncWaitTime = syncWait
+		log.SetOutput(os.Stderr)
+	})
+	return tn
+}
+
+//addNode starts a terminal of the given type, connects it to every other node and syncs its chain
+func (tn *testNetwork) addNode(nick string, typePos string) *testNode {
+	tn.t.Helper()
+	return tn.addNodeWithLedger(nick, typePos, NewLedger(""))
+}
+
+//addNodeWithLedger is addNode for a terminal whose ledger has been prepared, e.g. seeded from a snapshot
+func (tn *testNetwork) addNodeWithLedger(nick string, typePos string, ledger *Ledger) *testNode {
+	tn.t.Helper()
+	return tn.startNode(nick, typePos, ledger, true)
+}
+
+//startNode starts a terminal on a ledger. A terminal that does not vouch has no key to sign its checkpoints with
+func (tn *testNetwork) startNode(nick string, typePos string, ledger *Ledger, vouches bool) *testNode {
+	tn.t.Helper()
+
+	//mocknet's own GenPeer uses bogus keys that gossipsub message signing does not accept
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		tn.t.Fatalf("creating key for %s: %s", nick, err)
+	}
+	addr, err := ma.NewMultiaddr(fmt.Sprintf("/ip4/10.0.0.%d/tcp/4242", len(tn.nodes)+1))
+	if err != nil {
+		tn.t.Fatalf("creating address for %s: %s", nick, err)
+	}
+	h, err := tn.mn.AddPeer(sk, addr)
+	if err != nil {
+		tn.t.Fatalf("creating host for %s: %s", nick, err)
+	}
+	//gossipsub has to be running before the connections are made, otherwise the other
+	//nodes decide that this peer does not speak the pubsub protocol
+	ps, err := pubsub.NewGossipSub(tn.ctx, h, peerScoreOptions(testChainName))
+	if err != nil {
+		tn.t.Fatalf("creating gossipsub for %s: %s", nick, err)
+	}
+	err = tn.mn.LinkAll()
+	if err != nil {
+		tn.t.Fatalf("linking %s: %s", nick, err)
+	}
+	for _, n := range tn.nodes {
+		_, err = tn.mn.ConnectPeers(h.ID(), n.host.ID())
+		if err != nil {
+			tn.t.Fatalf("connecting %s to %s: %s", nick, n.nick, err)
+		}
+	}
+
+	key := sk
+	if !vouches {
+		key = nil
+	}
+	cs, err := SubscribeToChain(tn.ctx, ps, h.ID(), key, testChainName, nick, typePos, ledger)
+	if err != nil {
+		tn.t.Fatalf("subscribing %s: %s", nick, err)
+	}
+
+	cs.AnnouncePresence(sk)
+
+	node := &testNode{nick: nick, host: h, cs: cs}
+	tn.nodes = append(tn.nodes, node)
+	return node
+}
+
+//transact makes a transaction on a node and waits until every node has the new block
+func (tn *testNetwork) transact(node *testNode, cardId int, amount float32) *Block {
+	tn.t.Helper()
+
+	block, err := node.cs.SubmitTransaction(cardId, amount)
+	if err != nil {
+		tn.t.Fatalf("%s: transaction %d %f: %s", node.nick, cardId, amount, err)
+	}
+	tn.waitForConvergence(5 * time.Second)
+	return block
+}
+
+//divergence describes how the nodes disagree, or returns "" if they all have the same chain and balances
+func (tn *testNetwork) divergence() string {
+	first := snapshotLedger(tn.nodes[0].cs.Ledger)
+	for _, n := range tn.nodes[1:] {
+		snap := snapshotLedger(n.cs.Ledger)
+		if len(snap.Chain) != len(first.Chain) {
+			return fmt.Sprintf("%s has %d blocks, %s has %d", tn.nodes[0].nick, len(first.Chain), n.nick, len(snap.Chain))
+		}
+		for i := 1; i < len(snap.Chain); i++ {
+			if snap.Chain[i].Hash != first.Chain[i].Hash {
+				return fmt.Sprintf("%s and %s differ at block %d", tn.nodes[0].nick, n.nick, i)
+			}
+		}
+		for cardId, balance := range first.Balances {
+			if snap.Balances[cardId] != balance {
+				return fmt.Sprintf("card %d: %s has %f, %s has %f", cardId, tn.nodes[0].nick, balance, n.nick, snap.Balances[cardId])
+			}
+		}
+	}
+	return ""
+}
+
+//waitForConvergence fails the test if the nodes do not agree on the chain within timeout
+func (tn *testNetwork) waitForConvergence(timeout time.Duration) {
+	tn.t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		diff := tn.divergence()
+		if diff == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			tn.t.Fatalf("nodes did not converge: %s", diff)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+//assertBalance fails the test unless every node has the expected balance on a card
+func (tn *testNetwork) assertBalance(cardId int, expected float32) {
+	tn.t.Helper()
+	for _, n := range tn.nodes {
+		if balance := n.cs.Ledger.Balance(cardId); balance != expected {
+			tn.t.Errorf("%s: card %d has balance %f, expected %f", n.nick, cardId, balance, expected)
+		}
+	}
+}
+
+func TestNodesConvergeOnSameChain(t *testing.T) {
+	tn := newTestNetwork(t)
+	cash := tn.addNode("cash", "cash")
+	retail := tn.addNode("retail", "retail")
+	tn.addNode("replica", "retail")
+
+	tn.transact(cash, 7, 100)
+	tn.transact(cash, 8, 50)
+	tn.transact(retail, 7, -30)
+	tn.transact(retail, 8, -50)
+	tn.transact(cash, 7, 5)
+
+	tn.assertBalance(7, 75)
+	tn.assertBalance(8, 0)
+	if latest := cash.cs.Ledger.Latest(); latest.Index != 5 {
+		t.Errorf("expected chain to end at block 5, got %d", latest.Index)
+	}
+
+	//a deduction beyond the balance is rejected before it reaches the network
+	_, err := retail.cs.SubmitTransaction(8, -1)
+	if err != ErrInvalidTransaction {
+		t.Errorf("expected %s, got %v", ErrInvalidTransaction, err)
+	}
+	tn.waitForConvergence(time.Second)
+}
+
+func TestLateJoinerSyncsChain(t *testing.T) {
+	tn := newTestNetwork(t)
+	cash := tn.addNode("cash", "cash")
+	retail := tn.addNode("retail", "retail")
+
+	tn.transact(cash, 3, 40)
+	tn.transact(retail, 3, -15)
+
+	late := tn.addNode("late", "retail")
+	tn.waitForConvergence(5 * time.Second)
+	if balance := late.cs.Ledger.Balance(3); balance != 25 {
+		t.Errorf("late joiner has balance %f on card 3, expected 25", balance)
+	}
+
+	//the late joiner takes part in the chain like any other node
+	tn.transact(late, 3, -25)
+	tn.assertBalance(3, 0)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+/*PeerTimeout is how long a connected peer can go unheard before it is reported as silent.
+Presence announcements double as heartbeats, so this allows for a couple of lost ones*/
+var PeerTimeout = 3 * PresenceInterval
+
+//PeerForgetTime is how long a peer stays in the directory after it has disconnected
+var PeerForgetTime = 10 * time.Minute
+
+//MaxPeerLag is how many blocks a peer can be behind us before it is reported as behind
+const MaxPeerLag = 5
+
+//liveness states of a peer
+const (
+	PeerAlive  = "alive"
+	PeerBehind = "behind"
+	PeerSilent = "silent"
+	PeerGone   = "gone"
+)
+
+/*PeerHealth is the liveness of a peer. Lag is how many blocks the peer was behind us when it
+last told us its height, negative if it was ahead, and 0 if its height is not known*/
+type PeerHealth struct {
+	PeerStatus
+	Connected bool   `json:"connected"`
+	Lag       int    `json:"lag"`
+	State     string `json:"state"`
+}
+
+//peerHealth works out the liveness of a peer at a time
+func peerHealth(status PeerStatus, connected bool, now time.Time) PeerHealth {
+	health := PeerHealth{PeerStatus: status, Connected: connected, State: PeerAlive}
+	if status.Height >= 0 {
+		health.Lag = status.ourHeight - status.Height
+	}
+	switch {
+	case !connected:
+		health.State = PeerGone
+	case !status.LastSeen.IsZero() && now.Sub(status.LastSeen) > PeerTimeout:
+		health.State = PeerSilent
+	case health.Lag > MaxPeerLag:
+		health.State = PeerBehind
+	}
+	return health
+}
+
+/*PeerHealth returns the liveness of every peer subscribed to the chain, and of the peers that
+have disconnected in the last PeerForgetTime, sorted by nickname*/
+func (cs *ChainSubscription) PeerHealth() []PeerHealth {
+	now := time.Now()
+	connected := make(map[string]bool)
+	for _, p := range cs.ListPeers() {
+		connected[p.Pretty()] = true
+	}
+
+	cs.peersMu.Lock()
+	var health []PeerHealth
+	for id, status := range cs.peers {
+		if !connected[id] && now.Sub(status.LastSeen) > PeerForgetTime {
+			delete(cs.peers, id)
+			continue
+		}
+		health = append(health, peerHealth(*status, connected[id], now))
+	}
+	for id := range connected {
+		if _, ok := cs.peers[id]; !ok {
+			health = append(health, peerHealth(PeerStatus{Id: id, Height: -1}, true, now))
+		}
+	}
+	cs.peersMu.Unlock()
+
+	sort.Slice(health, func(i, j int) bool {
+		if health[i].Nick != health[j].Nick {
+			return health[i].Nick < health[j].Nick
+		}
+		return health[i].Id < health[j].Id
+	})
+	return health
+}
+
+//peerName is how alerts name a peer, its nickname or the end of its peer id
+func peerName(status PeerStatus) string {
+	if len(status.Nick) > 0 {
+		return status.Nick
+	}
+	if len(status.Id) > 8 {
+		return status.Id[len(status.Id)-8:]
+	}
+	return status.Id
+}
+
+//peerAlert tells that a peer has changed state. Problem is false when it has recovered
+type peerAlert struct {
+	Message string
+	Problem bool
+}
+
+/*healthAlerts compares the liveness of the peers with their states at the previous check and
+returns an alert for every peer that has fallen behind, gone silent or disconnected, or has
+recovered, along with the states to compare the next check with. Peers seen for the first
+time only raise an alert if they are not alive*/
+func healthAlerts(prev map[string]string, health []PeerHealth) ([]peerAlert, map[string]string) {
+	var alerts []peerAlert
+	next := make(map[string]string, len(health))
+	for _, h := range health {
+		next[h.Id] = h.State
+		was, known := prev[h.Id]
+		if was == h.State || (!known && h.State == PeerAlive) {
+			continue
+		}
+		name := peerName(h.PeerStatus)
+		switch h.State {
+		case PeerBehind:
+			alerts = append(alerts, peerAlert{fmt.Sprintf("Peer %s is %d blocks behind", name, h.Lag), true})
+		case PeerSilent:
+			alerts = append(alerts, peerAlert{fmt.Sprintf("Peer %s has not been heard from for %s", name, PeerTimeout), true})
+		case PeerGone:
+			alerts = append(alerts, peerAlert{fmt.Sprintf("Peer %s has disconnected", name), true})
+		case PeerAlive:
+			alerts = append(alerts, peerAlert{fmt.Sprintf("Peer %s is back", name), false})
+		}
+	}
+	return alerts, next
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthAlerts(t *testing.T) {
+	now := time.Now()
+	status := PeerStatus{Id: "QmPeer", Nick: "second", Height: 10, ourHeight: 12, LastSeen: now}
+
+	if h := peerHealth(status, true, now); h.State != PeerAlive || h.Lag != 2 {
+		t.Errorf("expected alive peer 2 blocks behind, got %+v", h)
+	}
+	//a peer that has not told us its height has no lag
+	unknown := PeerStatus{Id: "QmOther", Height: -1}
+	if h := peerHealth(unknown, true, now); h.State != PeerAlive || h.Lag != 0 {
+		t.Errorf("expected alive peer without lag, got %+v", h)
+	}
+
+	checks := []struct {
+		status    PeerStatus
+		connected bool
+		state     string
+		alert     string
+		problem   bool
+	}{
+		{status, true, PeerAlive, "", false},
+		{PeerStatus{Id: "QmPeer", Nick: "second", Height: 10, ourHeight: 20, LastSeen: now}, true, PeerBehind, "Peer second is 10 blocks behind", true},
+		{PeerStatus{Id: "QmPeer", Nick: "second", Height: 10, ourHeight: 20, LastSeen: now.Add(-2 * PeerTimeout)}, true, PeerSilent, "Peer second has not been heard from", true},
+		{PeerStatus{Id: "QmPeer", Nick: "second", Height: 20, ourHeight: 20, LastSeen: now}, false, PeerGone, "Peer second has disconnected", true},
+		{PeerStatus{Id: "QmPeer", Nick: "second", Height: 20, ourHeight: 20, LastSeen: now}, true, PeerAlive, "Peer second is back", false},
+		{PeerStatus{Id: "QmPeer", Nick: "second", Height: 21, ourHeight: 21, LastSeen: now}, true, PeerAlive, "", false},
+	}
+	var states map[string]string
+	for i, c := range checks {
+		h := peerHealth(c.status, c.connected, now)
+		if h.State != c.state {
+			t.Errorf("check %d: expected state %s, got %s", i, c.state, h.State)
+		}
+		var alerts []peerAlert
+		alerts, states = healthAlerts(states, []PeerHealth{h})
+		if len(c.alert) == 0 {
+			if len(alerts) != 0 {
+				t.Errorf("check %d: unexpected alerts %v", i, alerts)
+			}
+			continue
+		}
+		if len(alerts) != 1 || !strings.HasPrefix(alerts[0].Message, c.alert) || alerts[0].Problem != c.problem {
+			t.Errorf("check %d: expected alert %q, got %v", i, c.alert, alerts)
+		}
+	}
+
+	//a peer first seen in trouble is reported straight away
+	alerts, _ := healthAlerts(states, []PeerHealth{peerHealth(PeerStatus{Id: "QmThird", Height: 0, ourHeight: 30}, true, now)})
+	if len(alerts) != 1 || alerts[0].Message != "Peer QmThird is 30 blocks behind" {
+		t.Errorf("unexpected alerts for a new peer %v", alerts)
+	}
+}
+
+func TestPeerHealth(t *testing.T) {
+	tn := newTestNetwork(t)
+	first := tn.addNode("first", "cash")
+	second := tn.addNode("second", "retail")
+	secondId := second.host.ID().Pretty()
+
+	//blocks the second node never receives put it behind the first
+	for i := 1; i <= MaxPeerLag+1; i++ {
+		err := first.cs.Ledger.Append(nextBlock(first.cs.Ledger.Latest(), i, 10, "first"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	first.cs.seePeer(secondId, "second", "retail", 0)
+	health := first.cs.PeerHealth()
+	if len(health) != 1 {
+		t.Fatalf("first node has health of %d peers, expected 1", len(health))
+	}
+	if h := health[0]; h.Id != secondId || !h.Connected || h.Lag != MaxPeerLag+1 || h.State != PeerBehind {
+		t.Errorf("unexpected health of the second node %+v", h)
+	}
+
+	//a peer that is no longer subscribed stays in the directory as gone, until it is forgotten
+	first.cs.seePeer("QmGone", "third", "cash", 3)
+	health = first.cs.PeerHealth()
+	if len(health) != 2 || health[0].Id != secondId || health[1].Id != "QmGone" {
+		t.Fatalf("unexpected health %+v", health)
+	}
+	if h := health[1]; h.Connected || h.State != PeerGone {
+		t.Errorf("unexpected health of the gone node %+v", h)
+	}
+	first.cs.peersMu.Lock()
+	first.cs.peers["QmGone"].LastSeen = time.Now().Add(-2 * PeerForgetTime)
+	first.cs.peersMu.Unlock()
+	if health = first.cs.PeerHealth(); len(health) != 1 {
+		t.Errorf("gone node was not forgotten %+v", health)
+	}
+}
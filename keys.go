@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+)
+
+/*loadOrCreateKey reads an ed25519 private key from a file, creating the key and the file
+(readable by the owner only) if it does not exist yet*/
+func loadOrCreateKey(path string) (crypto.PrivKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return crypto.UnmarshalPrivateKey(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	data, err = crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,747 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+//errors returned when a block cannot be appended to the chain
+var (
+	ErrBlockIndex          = errors.New("invalid index of new block")
+	ErrPrevHash            = errors.New("problem with prev hash")
+	ErrBlockHash           = errors.New("hash calculation problem")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+)
+
+//errors returned when a chain received from another terminal cannot replace ours
+var (
+	ErrNoGenesis   = errors.New("chain does not start at the genesis block")
+	ErrChainBehind = errors.New("chain is behind ours, or loses to it at the same height")
+)
+
+/*LedgerEventType tells subscribers what happened to the ledger
+		 1 - Block Added
+		 2 - Block Rejected
+		 3 - Chain Replaced (after a sync)
+*/
+type LedgerEventType int
+
+const (
+	EventBlockAdded LedgerEventType = iota + 1
+	EventBlockRejected
+	EventChainReplaced
+)
+
+//SubscriberBufferSize is how many events a ledger subscriber can fall behind by before it is dropped
+const SubscriberBufferSize = 1024
+
+/*LedgerEvent is sent to subscribers whenever the ledger changes or turns a block away. When
+the chain is replaced Block is the new tip, and Fork the index of the first block of the new
+chain that the ledger did not hold before, so subscribers know which blocks they have to read again*/
+type LedgerEvent struct {
+	Type  LedgerEventType
+	Block Block
+	Err   error
+	Fork  int
+}
+
+/*Ledger owns the chain and the card balances of a terminal. All blocks, whether made on
+this terminal or received from the network, are validated and applied here, and every
+front end (UI, daemon, APIs) reads the chain through it. It is safe for concurrent use:
+writers hold mu exclusively and readers get copies, never slices of the live chain.
+The blocks live in a BlockStore; only the latest block and the balances are kept here*/
+type Ledger struct {
+	mu          sync.RWMutex
+	store       BlockStore
+	tip         Block
+	balance     map[int]float32
+	cards       map[int][]cardPosting
+	subscribers map[chan LedgerEvent]struct{}
+	chainFile   string
+	clock       func() time.Time
+	//imported is the tip of a snapshot the chain was seeded from, until the network confirms it
+	imported *Block
+	//checkpoint is the latest balance checkpoint. With prune set the chain starts at its block
+	checkpoint         *Checkpoint
+	checkpointInterval int
+	prune              bool
+}
+
+//NewLedger is OpenLedger for a terminal, which cannot run without its chain. It panics if the chain file cannot be loaded
+func NewLedger(chainFile string) *Ledger {
+	l, err := OpenLedger(chainFile)
+	if err != nil {
+		panic(fmt.Sprintf("Error opening chain file: %s", err))
+	}
+	return l
+}
+
+/*OpenLedger creates a ledger stored in chainFile, or in memory if chainFile is empty. A chain
+file left by an earlier run is loaded and checked, so a restarted terminal resumes from the
+chain it had and only syncs the blocks it missed; otherwise the ledger starts at genesis. A
+chain file that cannot be resumed is an error and is left as it is, so that it can be looked
+into with verify instead of being lost*/
+func OpenLedger(chainFile string) (*Ledger, error) {
+	var store BlockStore = newMemStore()
+	if len(chainFile) > 0 {
+		fileStore, err := newFileStore(chainFile, RecentBlockCache)
+		if err != nil {
+			return nil, err
+		}
+		store = fileStore
+	}
+
+	l := &Ledger{
+		store:       store,
+		balance:     make(map[int]float32),
+		cards:       make(map[int][]cardPosting),
+		subscribers: make(map[chan LedgerEvent]struct{}),
+		chainFile:   chainFile,
+		clock:       time.Now,
+
+		checkpointInterval: CheckpointInterval,
+	}
+	if l.store.Tip() >= l.store.Base() {
+		err := l.load()
+		if err != nil {
+			l.store.Close()
+			return nil, fmt.Errorf("%s: %s", chainFile, err)
+		}
+		return l, nil
+	}
+	l.tip = GetGenesisBlock()
+	if err := l.store.Reset([]Block{l.tip}); err != nil {
+		l.store.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+/*load replays the blocks the store holds, from genesis or from the checkpoint kept next to a
+pruned chain file. It fails on the first block that does not check out*/
+func (l *Ledger) load() error {
+	first, _, err := l.store.Block(l.store.Base())
+	if err != nil {
+		return err
+	}
+	switch {
+	case first.Index == 0 && first.Hash == GetGenesisBlock().Hash:
+	case first.Index > 0 && len(l.chainFile) > 0:
+		cp, err := ReadCheckpointFile(l.chainFile + CheckpointFileSuffix)
+		if err == nil && (cp.Index != first.Index || cp.BlockHash != first.Hash) {
+			err = fmt.Errorf("checkpoint is at block %d", cp.Index)
+		}
+		if err == nil {
+			err = cp.Verify()
+		}
+		if err != nil {
+			return fmt.Errorf("chain starts at block %d without a matching checkpoint: %s", first.Index, err)
+		}
+		l.checkpoint = cp
+		for cardId, b := range cp.Balances {
+			l.balance[cardId] = b
+		}
+	default:
+		return fmt.Errorf("chain does not start at genesis")
+	}
+
+	l.tip = first
+	tip := l.store.Tip()
+	for index := first.Index + 1; index <= tip; index++ {
+		blk, ok, err := l.store.Block(index)
+		if err == nil && !ok {
+			err = ErrBlockIndex
+		}
+		if err == nil {
+			err = checkBlock(&l.tip, l.balance[blk.CardId], &blk)
+		}
+		if err != nil {
+			return fmt.Errorf("block %d: %s", index, err)
+		}
+		l.index(&blk)
+	}
+	log.Printf("Resumed the chain file at block %d", l.tip.Index)
+	return nil
+}
+
+//Close closes the store of the ledger
+func (l *Ledger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.store.Close()
+}
+
+//validate checks that a block can be appended to the chain. The caller must hold l.mu
+func (l *Ledger) validate(newBlock *Block) error {
+	log.Printf("Validating block: %s\n", newBlock.pretty())
+	return checkBlock(&l.tip, l.balance[newBlock.CardId], newBlock)
+}
+
+/*checkBlock checks that newBlock can follow prevBlock, given the balance on its card before
+the block. Every check of a block against the chain, live or offline, goes through here*/
+func checkBlock(prevBlock *Block, balance float32, newBlock *Block) error {
+	if newBlock.Index != prevBlock.Index+1 {
+		return ErrBlockIndex
+	}
+	if newBlock.PrevHash != prevBlock.Hash {
+		return ErrPrevHash
+	}
+	err := checkBlockFields(newBlock)
+	if err != nil {
+		return err
+	}
+	if balance+newBlock.Amount < 0.0 {
+		return ErrInsufficientBalance
+	}
+	return nil
+}
+
+/*checkBlockFields checks a block on its own, its fields and its hash. These are all the rules
+a block has to meet apart from fitting the chain, and both checkBlock and the topic validator
+apply them, so that the router never drops a block the ledger would take. A zero amount is
+valid, since older terminals made such blocks; new transactions are refused one by checkTransaction.
+The hash does not cover the sender, and covers the timestamp whatever it holds, so both are
+checked to be what a terminal writes: a time in the layout of time.Time.String() and plain text*/
+func checkBlockFields(block *Block) error {
+	if block.Index < 1 || len(block.PrevHash) == 0 {
+		return ErrBlockFields
+	}
+	if calculateBlockHash(*block) != block.Hash {
+		return ErrBlockHash
+	}
+	if block.CardId < 1 {
+		return ErrInvalidCard
+	}
+	if _, err := parseBlockTime(block.Timestamp); err != nil {
+		return ErrBlockTimestamp
+	}
+	if !plainText(block.Sender) || !plainText(block.SenderNick) {
+		return ErrBlockSender
+	}
+	return nil
+}
+
+//plainText tells whether s only holds printable characters and none of the separators of Block.pretty()
+func plainText(s string) bool {
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return !strings.ContainsAny(s, ";:")
+}
+
+//apply appends a validated block to the chain. The caller must hold l.mu
+func (l *Ledger) apply(block *Block) {
+	l.push(block)
+	l.notify(LedgerEvent{Type: EventBlockAdded, Block: *block})
+}
+
+/*push appends a validated block to the store and updates the balances, taking a checkpoint
+every CheckpointInterval blocks and pruning the blocks before it if asked to. The caller must hold l.mu*/
+func (l *Ledger) push(block *Block) {
+	err := l.store.Append(*block)
+	if err != nil {
+		panic(fmt.Sprintf("Error writing chain file: %s", err))
+	}
+	if !l.index(block) {
+		return
+	}
+	l.persistCheckpoint()
+	if l.prune {
+		err = l.store.Reset([]Block{*block})
+		if err != nil {
+			panic(fmt.Sprintf("Error pruning chain file: %s", err))
+		}
+		l.cards = make(map[int][]cardPosting)
+	}
+}
+
+/*index applies a block held by the store to the tip, the balances and the card index, and
+takes a checkpoint every CheckpointInterval blocks. It returns true if it took one. The caller must hold l.mu*/
+func (l *Ledger) index(block *Block) bool {
+	l.tip = *block
+	l.balance[block.CardId] += block.Amount
+	l.cards[block.CardId] = appendPosting(l.cards[block.CardId], cardPosting{Index: block.Index, Balance: l.balance[block.CardId]})
+	if block.Index%l.checkpointInterval != 0 {
+		return false
+	}
+	l.checkpoint = newCheckpoint(*block, l.balance)
+	return true
+}
+
+//EnablePruning makes the ledger drop the blocks before every new checkpoint
+func (l *Ledger) EnablePruning() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune = true
+}
+
+//Pruning tells whether the ledger drops the blocks before its checkpoints
+func (l *Ledger) Pruning() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.prune
+}
+
+//Checkpoint returns the latest balance checkpoint, or nil if the chain has not reached one yet
+func (l *Ledger) Checkpoint() *Checkpoint {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.checkpoint
+}
+
+//Validate checks that a block can be appended to the chain
+func (l *Ledger) Validate(block *Block) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.validate(block)
+}
+
+//Append validates a block and appends it to the chain
+func (l *Ledger) Append(block *Block) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.validate(block)
+	if err != nil {
+		log.Printf("%s", err)
+		l.notify(LedgerEvent{Type: EventBlockRejected, Block: *block, Err: err})
+		return err
+	}
+	l.apply(block)
+	return nil
+}
+
+/*AppendNew builds the next block for a transaction made on this terminal, validates it and
+hands it to publish before appending it. Nothing is appended if publish fails. The chain
+cannot change in between, so the new block always extends the latest block*/
+func (l *Ledger) AppendNew(cardId int, amount float32, sender string, senderNick string, publish func(*Block) error) (*Block, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	latestBlock := l.tip
+
+	var block Block
+	block.Index = latestBlock.Index + 1
+	block.PrevHash = latestBlock.Hash
+	block.Timestamp = l.clock().String()
+	block.CardId = cardId
+	block.Amount = amount
+	block.Hash = calculateBlockHash(block)
+	block.Sender = sender
+	block.SenderNick = senderNick
+
+	err := l.validate(&block)
+	if err != nil {
+		return nil, err
+	}
+	err = publish(&block)
+	if err != nil {
+		return nil, err
+	}
+	l.apply(&block)
+	return &block, nil
+}
+
+/*Replace swaps the local chain for one received from another terminal, replaying the card
+balances from genesis. The chain is checked block by block first and left untouched if any
+block does not follow from the one before it, or if the chain does not win over ours: it must
+be longer, or as long with a lower hash at the tip, the way forks are settled*/
+func (l *Ledger) Replace(chain []Block) error {
+	return l.replace(nil, chain)
+}
+
+/*ReplaceFromCheckpoint is Replace for a chain that starts at the block of a checkpoint
+instead of at genesis, as sent by a terminal syncing from its latest checkpoint. The
+balances are replayed from those of the checkpoint, which must match their hash*/
+func (l *Ledger) ReplaceFromCheckpoint(cp *Checkpoint, chain []Block) error {
+	return l.replace(cp, chain)
+}
+
+//replace implements Replace and ReplaceFromCheckpoint
+func (l *Ledger) replace(cp *Checkpoint, chain []Block) error {
+	st, err := l.StageChain(cp)
+	if err != nil {
+		return err
+	}
+	err = st.Add(chain)
+	if err != nil {
+		st.Discard()
+		return err
+	}
+	return l.CommitStage(st)
+}
+
+/*ChainStage holds a chain received from another terminal while it is checked, in a store of
+its own, so that the chain of the ledger is left as it is until the whole new chain has come
+in and checks out. A long chain is synced in batches, which are added one by one. It is made
+by StageChain and either swapped in by CommitStage or dropped with Discard. A stage is not
+safe for concurrent use*/
+type ChainStage struct {
+	store BlockStore
+	//start is the checkpoint the chain starts at, or nil if it starts at genesis
+	start      *Checkpoint
+	started    bool
+	tip        Block
+	balance    map[int]float32
+	cards      map[int][]cardPosting
+	checkpoint *Checkpoint
+	interval   int
+	prune      bool
+}
+
+/*StageChain starts staging a chain that is to replace the chain of the ledger, from genesis or
+from the block of a checkpoint. The balances are replayed from those of the checkpoint, which
+must match their hash*/
+func (l *Ledger) StageChain(cp *Checkpoint) (*ChainStage, error) {
+	balance := make(map[int]float32)
+	if cp != nil {
+		err := cp.Verify()
+		if err != nil {
+			return nil, err
+		}
+		for cardId, b := range cp.Balances {
+			balance[cardId] = b
+		}
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	store, err := l.store.Stage()
+	if err != nil {
+		return nil, err
+	}
+	return &ChainStage{
+		store:      store,
+		start:      cp,
+		balance:    balance,
+		cards:      make(map[int][]cardPosting),
+		checkpoint: cp,
+		interval:   l.checkpointInterval,
+		prune:      l.prune,
+	}, nil
+}
+
+//Add checks the next batch of the chain against the blocks staged before it, and stages it
+func (st *ChainStage) Add(blocks []Block) error {
+	if len(blocks) == 0 {
+		return ErrBlockIndex
+	}
+	next := 0
+	if !st.started {
+		first := blocks[0]
+		if st.start != nil && (first.Index != st.start.Index || first.Hash != st.start.BlockHash) {
+			return fmt.Errorf("block %d: does not match checkpoint at block %d", first.Index, st.start.Index)
+		}
+		if st.start == nil && (first.Index != 0 || first.Hash != GetGenesisBlock().Hash) {
+			return ErrNoGenesis
+		}
+		err := st.store.Append(first)
+		if err != nil {
+			return err
+		}
+		st.tip, st.started, next = first, true, 1
+	}
+
+	for i := next; i < len(blocks); i++ {
+		blk := &blocks[i]
+		log.Printf("Validating block: %s\n", blk.pretty())
+		err := checkBlock(&st.tip, st.balance[blk.CardId], blk)
+		if err != nil {
+			return fmt.Errorf("block %d: %s", blk.Index, err)
+		}
+		err = st.store.Append(*blk)
+		if err != nil {
+			return err
+		}
+		st.tip = *blk
+		st.balance[blk.CardId] += blk.Amount
+		st.cards[blk.CardId] = appendPosting(st.cards[blk.CardId], cardPosting{Index: blk.Index, Balance: st.balance[blk.CardId]})
+		if blk.Index%st.interval != 0 {
+			continue
+		}
+		st.checkpoint = newCheckpoint(*blk, st.balance)
+		//a pruning ledger only keeps the blocks from the last checkpoint in the chain on
+		if st.prune {
+			err = st.store.Reset([]Block{*blk})
+			if err != nil {
+				return err
+			}
+			st.cards = make(map[int][]cardPosting)
+		}
+	}
+	return nil
+}
+
+//Discard drops a staged chain that is not going to be committed
+func (st *ChainStage) Discard() {
+	st.store.Close()
+}
+
+/*CommitStage swaps a staged chain in for the chain of the ledger in one step, and tells the
+subscribers from which block on the chain has changed. The stage is used up either way*/
+func (l *Ledger) CommitStage(st *ChainStage) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !st.started {
+		st.Discard()
+		return ErrBlockIndex
+	}
+	//a peer is picked for the height it claims, so the chain it sends may still be behind ours
+	if st.tip.Index < l.tip.Index || (st.tip.Index == l.tip.Index && st.tip.Hash > l.tip.Hash) {
+		st.Discard()
+		return ErrChainBehind
+	}
+
+	//blocks are linked by their hashes, so the blocks we hold form a prefix of the new chain
+	base := st.store.Base()
+	fork := base + sort.Search(st.store.Tip()-base+1, func(i int) bool {
+		held, ok, err := l.store.Block(base + i)
+		staged, _, serr := st.store.Block(base + i)
+		return err != nil || serr != nil || !ok || held.Hash != staged.Hash
+	})
+	err := l.store.Swap(st.store)
+	if err != nil {
+		return err
+	}
+	l.tip = st.tip
+	l.balance = st.balance
+	l.cards = st.cards
+	l.checkpoint = st.checkpoint
+	l.imported = nil
+	l.persistCheckpoint()
+	l.notify(LedgerEvent{Type: EventChainReplaced, Block: l.tip, Fork: fork})
+	return nil
+}
+
+/*Extend appends blocks received from another terminal that continue the local chain, e.g.
+the blocks after the tip of an imported snapshot. Blocks the chain already holds are skipped
+if their hashes match. Either all the new blocks are appended or none are*/
+func (l *Ledger) Extend(blocks []Block) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	start := 0
+	for start < len(blocks) && blocks[start].Index <= l.tip.Index {
+		held, ok, err := l.store.Block(blocks[start].Index)
+		if err != nil {
+			return err
+		}
+		if !ok || held.Hash != blocks[start].Hash {
+			return fmt.Errorf("block %d: %s", blocks[start].Index, ErrPrevHash)
+		}
+		start++
+	}
+
+	//check every new block before appending any of them
+	prev := l.tip
+	balance := make(map[int]float32)
+	for i := start; i < len(blocks); i++ {
+		blk := &blocks[i]
+		if _, ok := balance[blk.CardId]; !ok {
+			balance[blk.CardId] = l.balance[blk.CardId]
+		}
+		err := checkBlock(&prev, balance[blk.CardId], blk)
+		if err != nil {
+			return fmt.Errorf("block %d: %s", blk.Index, err)
+		}
+		balance[blk.CardId] += blk.Amount
+		prev = *blk
+	}
+
+	for i := start; i < len(blocks); i++ {
+		l.apply(&blocks[i])
+	}
+	return nil
+}
+
+/*Import seeds the ledger from a verified snapshot. The tip of the snapshot stays unconfirmed
+until ConfirmImport is called once the network has been seen to hold the same block*/
+func (l *Ledger) Import(snap *ChainSnapshot) error {
+	err := l.Replace(snap.Chain)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tip := snap.Tip()
+	l.imported = &tip
+	return nil
+}
+
+//UnconfirmedImport returns the tip of an imported snapshot not yet confirmed by the network, or nil
+func (l *Ledger) UnconfirmedImport() *Block {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.imported == nil {
+		return nil
+	}
+	blk := *l.imported
+	return &blk
+}
+
+//ConfirmImport records that the network holds the tip of the imported snapshot
+func (l *Ledger) ConfirmImport() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.imported = nil
+}
+
+//Latest returns the most recent block in the chain
+func (l *Ledger) Latest() Block {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.tip
+}
+
+//Balance returns the current balance on a card
+func (l *Ledger) Balance(cardId int) float32 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.balance[cardId]
+}
+
+//BlockAt returns the block at an index of the chain. It returns nil if there is no such block
+func (l *Ledger) BlockAt(index int) *Block {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	blk, ok, err := l.store.Block(index)
+	if err != nil {
+		log.Printf("Error reading block %d: %s", index, err)
+	}
+	if !ok {
+		return nil
+	}
+	return &blk
+}
+
+//FindBlock looks up a block by its hash. It returns nil if the block is not in the chain
+func (l *Ledger) FindBlock(hash string) *Block {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	blk, ok, err := l.store.Find(hash)
+	if err != nil {
+		log.Printf("Error looking up block %s: %s", hash, err)
+	}
+	if !ok {
+		return nil
+	}
+	return &blk
+}
+
+/*RecentBlocks returns a copy of the last n blocks of the chain, oldest first. At most
+SyncBatchSize blocks are returned, longer chains are read a Page at a time*/
+func (l *Ledger) RecentBlocks(n int) []Block {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if n <= 0 || n > SyncBatchSize {
+		n = SyncBatchSize
+	}
+	return l.loadBlocks(l.tip.Index-n+1, n)
+}
+
+//LedgerPage is a run of consecutive blocks read under a single lock, with the latest block at the time
+type LedgerPage struct {
+	Blocks []Block
+	Latest Block
+	//Checkpoint is set when Blocks start at the block of the latest checkpoint
+	Checkpoint *Checkpoint
+}
+
+/*Page reads up to n blocks from index from on. A from of -1, or one before the first block
+of a pruned chain, starts the page at the latest checkpoint instead and includes the checkpoint*/
+func (l *Ledger) Page(from int, n int) LedgerPage {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	page := LedgerPage{Latest: l.tip}
+	if from < l.store.Base() && l.checkpoint != nil {
+		from = l.checkpoint.Index
+		page.Checkpoint = l.checkpoint
+	}
+	page.Blocks = l.loadBlocks(from, n)
+	return page
+}
+
+/*loadBlocks reads up to n blocks (all of them if n <= 0) from index from on out of the store.
+The caller must hold l.mu*/
+func (l *Ledger) loadBlocks(from int, n int) []Block {
+	if from < l.store.Base() {
+		from = l.store.Base()
+	}
+	to := l.store.Tip()
+	if n > 0 && from+n-1 < to {
+		to = from + n - 1
+	}
+	if to < from {
+		return nil
+	}
+	blocks := make([]Block, 0, to-from+1)
+	for index := from; index <= to; index++ {
+		blk, ok, err := l.store.Block(index)
+		if err != nil || !ok {
+			log.Printf("Error reading block %d: %v", index, err)
+			break
+		}
+		blocks = append(blocks, blk)
+	}
+	return blocks
+}
+
+/*Subscribe returns a channel that receives every ledger event from now on. The returned
+function ends the subscription and must be called once the caller is done. Subscribers
+that fall too far behind are dropped and their channel is closed*/
+func (l *Ledger) Subscribe() (<-chan LedgerEvent, func()) {
+	ch := make(chan LedgerEvent, SubscriberBufferSize)
+
+	l.mu.Lock()
+	l.subscribers[ch] = struct{}{}
+	l.mu.Unlock()
+
+	stop := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if _, ok := l.subscribers[ch]; ok {
+			delete(l.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, stop
+}
+
+//notify hands an event to every subscriber. The caller must hold l.mu
+func (l *Ledger) notify(event LedgerEvent) {
+	for ch := range l.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("Dropping ledger subscriber that fell behind at block %d", event.Block.Index)
+			delete(l.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+//persistCheckpoint writes the latest checkpoint next to the chain file. The caller must hold l.mu
+func (l *Ledger) persistCheckpoint() {
+	//a pruned chain file can only be verified from the checkpoint it starts at
+	if len(l.chainFile) == 0 || l.checkpoint == nil {
+		return
+	}
+	data, err := json.Marshal(l.checkpoint)
+	if err != nil {
+		panic("Error encoding checkpoint")
+	}
+	err = ioutil.WriteFile(l.chainFile+CheckpointFileSuffix, data, 0644)
+	if err != nil {
+		panic("Error writing checkpoint file")
+	}
+}
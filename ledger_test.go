@@ -0,0 +1,291 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*LedgerSnapshot is a consistent copy of the chain and the card balances at one point in time.
+If the ledger is pruned the chain starts at the block of Checkpoint. It holds the whole chain
+in memory, so only the tests take one; the terminal reads the chain a Page at a time*/
+type LedgerSnapshot struct {
+	Chain      []Block
+	Balances   map[int]float32
+	Checkpoint *Checkpoint
+}
+
+//snapshotLedger copies the chain and the card balances of l under a single read lock
+func snapshotLedger(l *Ledger) LedgerSnapshot {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	snap := LedgerSnapshot{
+		Chain:      l.loadBlocks(l.store.Base(), 0),
+		Balances:   make(map[int]float32, len(l.balance)),
+		Checkpoint: l.checkpoint,
+	}
+	for cardId, balance := range l.balance {
+		snap.Balances[cardId] = balance
+	}
+	return snap
+}
+
+//nextBlock builds a valid block on top of prev, as another terminal would
+func nextBlock(prev Block, cardId int, amount float32, nick string) *Block {
+	block := Block{
+		Index:      prev.Index + 1,
+		PrevHash:   prev.Hash,
+		Timestamp:  time.Now().String(),
+		CardId:     cardId,
+		Amount:     amount,
+		Sender:     nick,
+		SenderNick: nick,
+	}
+	block.Hash = calculateBlockHash(block)
+	return &block
+}
+
+//checkChain fails the test if the chain does not link up or disagrees with the balances
+func checkChain(t *testing.T, chain []Block, balances map[int]float32) {
+	replayed := make(map[int]float32)
+	for i := 1; i < len(chain); i++ {
+		if chain[i].Index != chain[i-1].Index+1 || chain[i].PrevHash != chain[i-1].Hash {
+			t.Errorf("block %d does not follow block %d", chain[i].Index, chain[i-1].Index)
+			return
+		}
+		replayed[chain[i].CardId] += chain[i].Amount
+	}
+	if balances == nil {
+		return
+	}
+	for cardId, balance := range replayed {
+		if balances[cardId] != balance {
+			t.Errorf("card %d: balance %f does not match chain %f", cardId, balances[cardId], balance)
+		}
+	}
+}
+
+func TestSyncResponsesDuringBlockApplication(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	const numBlocks = 300
+	cs := &ChainSubscription{
+		Ledger:   NewLedger(""),
+		nickName: "local",
+	}
+	req := &SpecialMessage{Sender: "remote"}
+
+	var writers, readers sync.WaitGroup
+	done := make(chan struct{})
+
+	//blocks received from the network
+	writers.Add(1)
+	go func() {
+		defer writers.Done()
+		for i := 0; i < numBlocks; i++ {
+			err := cs.Ledger.Append(nextBlock(cs.Ledger.Latest(), 1+i%5, 10, "remote"))
+			if err != nil && err != ErrBlockIndex && err != ErrPrevHash {
+				t.Errorf("append: %s", err)
+			}
+		}
+	}()
+
+	//transactions made on this terminal
+	writers.Add(1)
+	go func() {
+		defer writers.Done()
+		publish := func(*Block) error { return nil }
+		for i := 0; i < numBlocks; i++ {
+			_, err := cs.Ledger.AppendNew(1+i%5, 5, "local", "local", publish)
+			if err != nil {
+				t.Errorf("append new: %s", err)
+			}
+		}
+	}()
+
+	//sync requests from other terminals
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				index := cs.indexReturnMessage(req)
+				chain := cs.chainReturnMessage(req)
+				if chain.Index < index.Index {
+					t.Errorf("chain response at %d is behind index response at %d", chain.Index, index.Index)
+				}
+				checkChain(t, chain.Blockchain, nil)
+				snap := snapshotLedger(cs.Ledger)
+				checkChain(t, snap.Chain, snap.Balances)
+				cs.Ledger.Balance(1)
+			}
+		}()
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	snap := snapshotLedger(cs.Ledger)
+	checkChain(t, snap.Chain, snap.Balances)
+	if snap.Chain[len(snap.Chain)-1].Index < numBlocks {
+		t.Errorf("expected at least %d blocks, chain ends at %d", numBlocks, snap.Chain[len(snap.Chain)-1].Index)
+	}
+}
+
+func TestLedgerAppendAndReplace(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	l := NewLedger("")
+	genesis := l.Latest()
+	first := nextBlock(genesis, 1, 100, "cash")
+	if err := l.Append(first); err != nil {
+		t.Fatal(err)
+	}
+	stale := nextBlock(genesis, 1, 5, "cash")
+	tampered := nextBlock(*first, 1, -10, "retail")
+	tampered.Amount = -1000
+	overdrawn := nextBlock(*first, 1, -101, "retail")
+	noCard := nextBlock(*first, 0, 5, "cash")
+	for _, c := range []struct {
+		name  string
+		block *Block
+		err   error
+	}{
+		{"stale index", stale, ErrBlockIndex},
+		{"tampered", tampered, ErrBlockHash},
+		{"overdrawn", overdrawn, ErrInsufficientBalance},
+		{"no card", noCard, ErrInvalidCard},
+	} {
+		if err := l.Append(c.block); err != c.err {
+			t.Errorf("%s: expected %s, got %v", c.name, c.err, err)
+		}
+	}
+	if l.Latest().Hash != first.Hash || l.Balance(1) != 100 {
+		t.Errorf("rejected blocks changed the ledger")
+	}
+
+	//a longer chain replaces ours and its balances are replayed from genesis
+	chain := []Block{genesis}
+	for i := 0; i < 4; i++ {
+		chain = append(chain, *nextBlock(chain[len(chain)-1], 2, 10, "other"))
+	}
+	if err := l.Replace(chain); err != nil {
+		t.Fatal(err)
+	}
+	if l.Latest().Hash != chain[4].Hash || l.Balance(1) != 0 || l.Balance(2) != 40 {
+		t.Errorf("chain not replaced: tip %d, balances %f %f", l.Latest().Index, l.Balance(1), l.Balance(2))
+	}
+
+	//a chain that does not link up is refused and the ledger left as it was
+	broken := append([]Block{}, chain...)
+	broken[2].PrevHash = "elsewhere"
+	if err := l.Replace(broken); err == nil {
+		t.Error("chain that does not link up accepted")
+	}
+	if l.Latest().Hash != chain[4].Hash || l.Balance(2) != 40 {
+		t.Errorf("refused chain changed the ledger")
+	}
+
+	//a chain must start at genesis, and is refused if it is behind ours whatever height its sender claimed
+	if err := l.Replace(chain[1:]); err != ErrNoGenesis {
+		t.Errorf("chain without genesis: expected %s, got %v", ErrNoGenesis, err)
+	}
+	if err := l.Replace(chain[:4]); err != ErrChainBehind {
+		t.Errorf("shorter chain: expected %s, got %v", ErrChainBehind, err)
+	}
+	//at the same height the chain with the lower hash at its tip wins
+	fork := append(append([]Block{}, chain[:4]...), *nextBlock(chain[3], 2, 5, "other"))
+	var want error
+	if fork[4].Hash > chain[4].Hash {
+		want = ErrChainBehind
+	}
+	if err := l.Replace(fork); err != want {
+		t.Errorf("fork at the same height: expected %v, got %v", want, err)
+	}
+}
+
+func TestLedgerSubscribers(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	l := NewLedger("")
+	events, stop := l.Subscribe()
+	//a subscriber that never reads is dropped once it falls behind, without holding up the ledger
+	slow, stopSlow := l.Subscribe()
+
+	//few enough events that the reader below cannot fall behind, even if it is never scheduled
+	const numBlocks = SubscriberBufferSize / 4
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < numBlocks; i++ {
+			if err := l.Append(nextBlock(l.Latest(), 1, 1, "remote")); err != nil && err != ErrBlockIndex && err != ErrPrevHash {
+				t.Errorf("append: %s", err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			//blocks appended since the snapshot was taken leave it behind
+			if err := l.Replace(snapshotLedger(l).Chain); err != nil && err != ErrChainBehind {
+				t.Errorf("replace: %s", err)
+			}
+		}
+	}()
+	tip := make(chan int, 1)
+	go func() {
+		wg.Wait()
+		tip <- l.Latest().Index
+		stop()
+	}()
+
+	//every block added follows the block of the event before it
+	last, added := 0, 0
+	for ev := range events {
+		switch ev.Type {
+		case EventBlockAdded:
+			if ev.Block.Index != last+1 {
+				t.Fatalf("block %d added after block %d", ev.Block.Index, last)
+			}
+			added++
+		case EventChainReplaced:
+			if ev.Fork > ev.Block.Index+1 {
+				t.Fatalf("chain replaced up to block %d forks at %d", ev.Block.Index, ev.Fork)
+			}
+		case EventBlockRejected:
+			continue
+		}
+		last = ev.Block.Index
+	}
+	if latest := <-tip; last != latest || added < numBlocks/2 {
+		t.Errorf("events end at block %d after %d blocks added, the ledger at block %d", last, added, latest)
+	}
+
+	for i := 0; i < SubscriberBufferSize; i++ {
+		if err := l.Append(nextBlock(l.Latest(), 1, 1, "remote")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != SubscriberBufferSize {
+		t.Errorf("slow subscriber got %d events before it was dropped, expected %d", n, SubscriberBufferSize)
+	}
+	//ending a subscription that was dropped is harmless
+	stopSlow()
+}
@@ -6,6 +6,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/libp2p/go-libp2p"
@@ -16,25 +20,102 @@ import (
 )
 
 // DiscoveryInterval is how often we re-publish our mDNS records.
-const DiscoveryInterval = time.Minute
+var DiscoveryInterval = time.Minute
 
 // DiscoveryServiceTag is used in our mDNS advertisements to discover other chat peers.
-const DiscoveryServiceTag = "spiritchain-pos-network"
+var DiscoveryServiceTag = "spiritchain-pos-network"
 
 func main() {
-	nickFlag := flag.String("nick", "", "nickname for this terminal. will be auto generated if left empty")
-	chainFlag := flag.String("chain", "spiritchain-terminals", "name for the chain/topic you want to join.")
-	typeFlag := flag.String("type", "", "type of terminal i.e retail or cash")
+	// subcommands that work on persisted ledgers and do not join the network
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			os.Exit(runVerify(os.Args[2:]))
+		case "diff":
+			os.Exit(runDiff(os.Args[2:]))
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "snapshot":
+			os.Exit(runSnapshot(os.Args[2:]))
+		case "psk":
+			os.Exit(runPSK(os.Args[2:]))
+		case "id":
+			os.Exit(runID(os.Args[2:]))
+		case "config":
+			os.Exit(runConfig(os.Args[2:]))
+		}
+	}
 
+	// settings come from the config file, then the environment, then the flags
+	configFlag := configFlags(flag.CommandLine, defaultConfig())
 	flag.Parse()
+	cfg, err := buildConfig(flag.CommandLine, *configFlag, os.LookupEnv)
+	if err != nil {
+		printErr("%s\n", err)
+		os.Exit(2)
+	}
+	cfg.apply()
+	staticPeers, err := parsePeerAddrs(strings.Join(cfg.Peers, ","))
+	if err != nil {
+		panic(err)
+	}
+	for _, dir := range []string{cfg.Dirs.Chains, cfg.Dirs.Logs} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			panic(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// shut down gracefully on SIGINT/SIGTERM, also while the terminal is still syncing
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		log.Printf("Received %s", sig)
+		cancel()
+	}()
+
+	//create a new libp2p host, by default listening on a random TCP port
+	opts := []libp2p.Option{libp2p.ListenAddrStrings(cfg.Listen...)}
+	if keyFile := cfg.KeyFile(); len(keyFile) > 0 {
+		key, err := loadOrCreateKey(keyFile)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, libp2p.Identity(key))
+	}
+	if len(cfg.PSK) > 0 {
+		psk, err := loadPSK(cfg.PSK)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, libp2p.PrivateNetwork(psk))
+	}
+	var allowList *AllowList
+	if len(cfg.AllowList) > 0 {
+		allowList, err = loadAllowList(cfg.AllowList)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, libp2p.ConnectionGater(allowList))
+	}
+	host, err := libp2p.New(ctx, opts...)
+
+	if err != nil {
+		panic(err)
+	}
+	defer host.Close()
 
-	typePos := *typeFlag
-	if typePos != "cash" && typePos != "retail" {
-		panic("Invalid type flag given as input. only 'retail' and 'cash' are valid inputs")
+	// use the nickname from the config, or a default if blank
+	nick := cfg.Nick
+	if len(nick) == 0 {
+		nick = defaultNick(host.ID())
 	}
 
-	//setup the logfile
-	logfile := fmt.Sprintf("Logs/%s.log", *nickFlag)
+	//setup the logfile, named after the nickname
+	logfile := filepath.Join(cfg.Dirs.Logs, nick+".log")
 	f_log, err := os.Create(logfile)
 	if err != nil {
 		panic("Error opening log file")
@@ -43,48 +124,110 @@ func main() {
 	log.SetOutput(f_log)
 	//end of logfile setup
 
-	ctx := context.Background()
-
-	//create a new libp2p host that listens on a random TCP port
-	host, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/0.0.0.0/tcp/0"))
+	// join the chain from the config, or the default
+	chain := cfg.Chain
 
-	if err != nil {
-		panic(err)
-	}
-
-	// create a new PubSub service using the GossipSub router
-	ps, err := pubsub.NewGossipSub(ctx, host)
+	// create a new PubSub service using the GossipSub router, scoring peers on the messages they send on the chain
+	ps, err := pubsub.NewGossipSub(ctx, host, peerScoreOptions(chain))
 	if err != nil {
 		panic(err)
 	}
 
 	// setup local mDNS discovery
-	err = setupDiscovery(ctx, host)
+	err = setupDiscovery(ctx, host, allowList)
 	if err != nil {
 		panic(err)
 	}
-
-	// use the nickname from the cli flag, or a default if blank
-	nick := *nickFlag
-	if len(nick) == 0 {
-		nick = defaultNick(host.ID())
+	if allowList != nil && !allowList.Allows(host.ID()) {
+		log.Printf("Peer id %s is not on the allow-list, other terminals using it will not connect to this one", host.ID().Pretty())
+	}
+	for _, addr := range host.Addrs() {
+		log.Printf("Listening on %s/p2p/%s", addr, host.ID().Pretty())
 	}
 
-	// join the chain from the cli flag, or the flag default
-	chain := *chainFlag
+	// keep connected to the static peers, and find the terminals of other sites through the DHT if asked for
+	connectStaticPeers(ctx, host, staticPeers)
+
+	if cfg.DHT {
+		kad, err := setupDHT(ctx, host, chain, staticPeers)
+		if err != nil {
+			panic(err)
+		}
+		defer kad.Close()
+	}
 
 	log.Printf("Attempting to subscribe to chain / join chat room")
 
 	// join the chain
-	cs, err := SubscribeToChain(ctx, ps, host.ID(), chain, nick, typePos)
+	ledger := NewLedger(filepath.Join(cfg.Dirs.Chains, nick+".txt"))
+	defer ledger.Close()
+	if cfg.Prune {
+		ledger.EnablePruning()
+	}
+	if len(cfg.Snapshot) > 0 {
+		snap, err := ReadSnapshotFile(cfg.Snapshot)
+		if err != nil {
+			panic(err)
+		}
+		if err = snap.Verify(cfg.SnapshotSigner); err != nil {
+			panic(fmt.Sprintf("Invalid snapshot %s: %s", cfg.Snapshot, err))
+		}
+		imported, err := seedFromSnapshot(ledger, snap)
+		if err != nil {
+			panic(err)
+		}
+		if imported {
+			log.Printf("Imported snapshot up to block %d signed by %s", snap.Height, snap.Signer)
+		} else {
+			log.Printf("Skipped snapshot up to block %d, the chain file is at block %d", snap.Height, ledger.Latest().Index)
+		}
+	}
+	cs, err := SubscribeToChain(ctx, ps, host.ID(), host.Peerstore().PrivKey(host.ID()), chain, nick, cfg.Type, ledger)
+	if err != nil && ctx.Err() != nil {
+		log.Printf("Shutting down before the chain was synced")
+		return
+	}
 	if err != nil {
 		panic(err)
 	}
+	//stopped before the ledger is closed, so that no block arrives at a closed chain file
+	defer cs.Close()
+	cs.AnnouncePresence(host.Peerstore().PrivKey(host.ID()))
+	cs.WatchNetwork(host)
+
+	// serve the local HTTP API if asked for
+	if len(cfg.API) > 0 {
+		api := NewAPIServer(cs, cfg.API)
+		defer api.Close()
+		go func() {
+			if err := api.ListenAndServe(); err != nil {
+				log.Printf("error running API server: %s", err)
+			}
+		}()
+	}
+
+	// serve the gRPC service if asked for
+	if len(cfg.GRPC) > 0 {
+		grpcServer := NewGRPCServer(cs)
+		defer grpcServer.Close()
+		go func() {
+			if err := grpcServer.ListenAndServe(cfg.GRPC); err != nil {
+				log.Printf("error running gRPC server: %s", err)
+			}
+		}()
+	}
+
+	if cfg.Headless {
+		if err = NewDaemon(cs).Run(ctx); err != nil {
+			log.Printf("error running headless terminal: %s", err)
+		}
+		return
+	}
 
 	log.Printf("Attempting to start UI")
 
 	// draw the UI
-	ui := NewTerminalUI(cs)
+	ui := NewTerminalUI(cs, cfg.Dirs.Receipts, cfg.Dirs.Exports)
 	if err = ui.Run(); err != nil {
 		printErr("error running Terminal UI: %s", err)
 	}
@@ -111,29 +254,35 @@ func shortID(p peer.ID) string {
 // discoveryNotifee gets notified when we find a new peer via mDNS discovery
 type discoveryNotifee struct {
 	h host.Host
+	// allowed is the allow-list of the host, if it has one
+	allowed *AllowList
 }
 
 // HandlePeerFound connects to peers discovered via mDNS. Once they're connected,
 // the PubSub system will automatically start interacting with them if they also
-// support PubSub.
+// support PubSub. Peers that are not on the allow-list are not dialled at all.
 func (n *discoveryNotifee) HandlePeerFound(pi peer.AddrInfo) {
 	// fmt.Printf("discovered new peer %s\n", pi.ID.Pretty())
+	if n.allowed != nil && !n.allowed.Allows(pi.ID) {
+		return
+	}
 	err := n.h.Connect(context.Background(), pi)
 	if err != nil {
-		fmt.Printf("error connecting to peer %s: %s\n", pi.ID.Pretty(), err)
+		// peers of another private network are found too, so this goes to the log rather than the UI
+		log.Printf("error connecting to peer %s: %s\n", pi.ID.Pretty(), err)
 	}
 }
 
 // setupDiscovery creates an mDNS discovery service and attaches it to the libp2p Host.
 // This lets us automatically discover peers on the same LAN and connect to them.
-func setupDiscovery(ctx context.Context, h host.Host) error {
+func setupDiscovery(ctx context.Context, h host.Host, allowed *AllowList) error {
 	// setup mDNS discovery to find local peers
 	disc, err := discovery.NewMdnsService(ctx, h, DiscoveryInterval, DiscoveryServiceTag)
 	if err != nil {
 		return err
 	}
 
-	n := discoveryNotifee{h: h}
+	n := discoveryNotifee{h: h, allowed: allowed}
 	disc.RegisterNotifee(&n)
 	return nil
 }
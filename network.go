@@ -0,0 +1,201 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+//NetworkCheckInterval is how often a terminal checks whether it is still connected to the network
+var NetworkCheckInterval = 2 * time.Second
+
+/*PeerLivenessWindow is how long after a peer has disconnected it still counts towards a
+partition. A peer gone for longer has most likely been shut down rather than cut off*/
+var PeerLivenessWindow = 2 * PeerTimeout
+
+//states of the connection of a terminal to the network
+const (
+	NetOnline      = "online"
+	NetIsolated    = "isolated"
+	NetPartitioned = "partitioned"
+)
+
+/*networkState works out from the liveness of the peers at a time whether the terminal is cut
+off from the network: isolated when it has lost all of its peers, and partitioned when more of
+them have become unreachable in the last PeerLivenessWindow than are still connected. Peers
+that disconnected before that are left out while others are still connected. A terminal that
+has never had peers is online*/
+func networkState(health []PeerHealth, now time.Time) string {
+	connected, unreachable, gone := 0, 0, 0
+	for _, h := range health {
+		switch {
+		case h.Connected:
+			connected++
+		case now.Sub(h.LastSeen) <= PeerLivenessWindow:
+			unreachable++
+		default:
+			gone++
+		}
+	}
+	switch {
+	case unreachable+gone == 0:
+		return NetOnline
+	case connected == 0:
+		return NetIsolated
+	case unreachable > connected:
+		return NetPartitioned
+	}
+	return NetOnline
+}
+
+//redial is when to try to reconnect to a peer that has disconnected next
+type redial struct {
+	delay time.Duration
+	next  time.Time
+}
+
+//networkWatch is what WatchNetwork keeps between two checks
+type networkWatch struct {
+	state  string
+	peers  map[string]bool
+	redial map[string]*redial
+	delays reconnectDelays
+}
+
+func newNetworkWatch(delays reconnectDelays) *networkWatch {
+	return &networkWatch{state: NetOnline, peers: make(map[string]bool), redial: make(map[string]*redial), delays: delays}
+}
+
+/*check updates the state of the network from the liveness of the peers at a time. It returns
+whether the state has changed, and whether the terminal has to catch up with the network,
+because it has found a peer after losing all of them, or a peer that had disconnected is back
+and may hold a different chain, or it is back online thanks to a new peer. Going back online
+because unreachable peers have been gone for long enough needs no catching up*/
+func (w *networkWatch) check(health []PeerHealth, now time.Time) (changed bool, catchUp bool) {
+	state := networkState(health, now)
+	changed = state != w.state
+	catchUp = changed && w.state == NetIsolated
+
+	peers := make(map[string]bool, len(health))
+	for _, h := range health {
+		peers[h.Id] = h.Connected
+		connected, known := w.peers[h.Id]
+		if known && !connected && h.Connected {
+			catchUp = true
+		}
+		if !known && h.Connected && changed && state == NetOnline {
+			catchUp = true
+		}
+		if h.Connected {
+			delete(w.redial, h.Id)
+		}
+	}
+	for id := range w.redial {
+		if _, ok := peers[id]; !ok {
+			delete(w.redial, id)
+		}
+	}
+	w.state, w.peers = state, peers
+	return changed, catchUp
+}
+
+//due returns the disconnected peers to try to reconnect to now, and backs off before the next attempt to each
+func (w *networkWatch) due(now time.Time) []string {
+	var ids []string
+	for id, connected := range w.peers {
+		if connected {
+			continue
+		}
+		r, ok := w.redial[id]
+		if !ok {
+			r = &redial{}
+			w.redial[id] = r
+		}
+		if now.Before(r.next) {
+			continue
+		}
+		r.delay = w.delays.next(r.delay)
+		r.next = now.Add(r.delay)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+/*WatchNetwork checks every NetworkCheckInterval whether the terminal has lost its peers, until
+the context of the subscription is done. The ledger keeps serving local reads meanwhile. Peers
+that have disconnected are redialled with backoff, and once the terminal is back online, or a
+peer is back, it catches up with the network through Resync, which also resolves a fork that
+grew while the network was split*/
+func (cs *ChainSubscription) WatchNetwork(h host.Host) {
+	interval := NetworkCheckInterval
+	watch := newNetworkWatch(currentReconnectDelays())
+	cs.spawn(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-cs.ctx.Done():
+				return
+			}
+			changed, catchUp := watch.check(cs.PeerHealth(), time.Now())
+			if changed {
+				cs.setNetworkState(watch.state)
+				log.Printf("Network is %s", watch.state)
+			}
+			if catchUp {
+				cs.spawn(cs.catchUp)
+			}
+			for _, id := range watch.due(time.Now()) {
+				id := id
+				cs.spawn(func() { cs.redialPeer(h, id) })
+			}
+		}
+	})
+}
+
+//redialPeer tries to reconnect to a peer that has disconnected, at the addresses the peerstore still holds for it
+func (cs *ChainSubscription) redialPeer(h host.Host, id string) {
+	pid, err := peer.Decode(id)
+	if err != nil || h.Network().Connectedness(pid) == network.Connected {
+		return
+	}
+	err = h.Connect(cs.ctx, peer.AddrInfo{ID: pid})
+	if err != nil {
+		log.Printf("Error reconnecting to %s: %s", id, err)
+		return
+	}
+	log.Printf("Reconnected to %s", id)
+}
+
+//catchUp resyncs with the network after it has been disrupted
+func (cs *ChainSubscription) catchUp() {
+	log.Printf("Catching up with the network")
+	index, err := cs.Resync()
+	if err != nil {
+		log.Printf("Error catching up with the network: %s", err)
+		return
+	}
+	log.Printf("Caught up with the network at block %d", index)
+}
+
+//setNetworkState records a change of the state of the network
+func (cs *ChainSubscription) setNetworkState(state string) {
+	cs.netMu.Lock()
+	defer cs.netMu.Unlock()
+	cs.netState = state
+	cs.netSince = time.Now()
+}
+
+//NetworkState returns whether the terminal is online, isolated or partitioned, and since when
+func (cs *ChainSubscription) NetworkState() (string, time.Time) {
+	cs.netMu.Lock()
+	defer cs.netMu.Unlock()
+	if len(cs.netState) == 0 {
+		return NetOnline, time.Time{}
+	}
+	return cs.netState, cs.netSince
+}
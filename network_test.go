@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+//peersHealth makes the liveness of peers from whether each is connected. Every peer was last heard from at seen
+func peersHealth(connected map[string]bool, seen time.Time) []PeerHealth {
+	var health []PeerHealth
+	for id, c := range connected {
+		health = append(health, PeerHealth{PeerStatus: PeerStatus{Id: id, LastSeen: seen}, Connected: c})
+	}
+	return health
+}
+
+func TestNetworkWatch(t *testing.T) {
+	watch := newNetworkWatch(reconnectDelays{check: time.Second, min: time.Second, max: time.Minute})
+	checks := []struct {
+		peers   map[string]bool
+		state   string
+		changed bool
+		catchUp bool
+	}{
+		{map[string]bool{}, NetOnline, false, false},
+		{map[string]bool{"a": true, "b": true}, NetOnline, false, false},
+		//losing half of the peers is not a partition yet
+		{map[string]bool{"a": true, "b": false}, NetOnline, false, false},
+		{map[string]bool{"a": false, "b": false}, NetIsolated, true, false},
+		{map[string]bool{"a": false, "b": false, "c": true}, NetPartitioned, true, true},
+		{map[string]bool{"a": false, "b": false, "c": false}, NetIsolated, true, false},
+		{map[string]bool{"a": true, "b": false, "c": false}, NetPartitioned, true, true},
+		{map[string]bool{"a": true, "b": true, "c": false}, NetOnline, true, true},
+		//a peer coming back may hold a different chain even if we never went offline
+		{map[string]bool{"a": true, "b": true, "c": true}, NetOnline, false, true},
+	}
+	now := time.Now()
+	for i, c := range checks {
+		changed, catchUp := watch.check(peersHealth(c.peers, now), now)
+		if watch.state != c.state || changed != c.changed || catchUp != c.catchUp {
+			t.Errorf("check %d: expected %s, changed %t, catch up %t, got %s, %t, %t", i, c.state, c.changed, c.catchUp, watch.state, changed, catchUp)
+		}
+	}
+
+	//disconnected peers are redialled with backoff
+	watch.check(peersHealth(map[string]bool{"a": true, "b": false, "c": false}, now), now)
+	due := watch.due(now)
+	sort.Strings(due)
+	if len(due) != 2 || due[0] != "b" || due[1] != "c" {
+		t.Errorf("expected to redial b and c, got %v", due)
+	}
+	if due = watch.due(now.Add(500 * time.Millisecond)); len(due) != 0 {
+		t.Errorf("redialled %v before the delay", due)
+	}
+	if due = watch.due(now.Add(time.Second)); len(due) != 2 {
+		t.Errorf("expected to redial b and c after a second, got %v", due)
+	}
+	if due = watch.due(now.Add(2 * time.Second)); len(due) != 0 {
+		t.Errorf("redialled %v before the doubled delay", due)
+	}
+	//a peer that is back starts over
+	watch.check(peersHealth(map[string]bool{"a": true, "b": true, "c": false}, now), now)
+	watch.check(peersHealth(map[string]bool{"a": true, "b": false, "c": false}, now), now)
+	if due = watch.due(now.Add(2 * time.Second)); len(due) != 1 || due[0] != "b" {
+		t.Errorf("expected to redial b straight away, got %v", due)
+	}
+}
+
+func TestNetworkWatchLivenessWindow(t *testing.T) {
+	watch := newNetworkWatch(reconnectDelays{check: time.Second, min: time.Second, max: time.Minute})
+	now := time.Now()
+	peers := map[string]bool{"a": true, "b": false, "c": false}
+	if changed, _ := watch.check(peersHealth(peers, now), now); !changed || watch.state != NetPartitioned {
+		t.Fatalf("expected a partition, got %s", watch.state)
+	}
+
+	//peers that stay away for long have been shut down, which is no partition and needs no sync
+	later := now.Add(PeerLivenessWindow + time.Second)
+	changed, catchUp := watch.check(peersHealth(peers, now), later)
+	if watch.state != NetOnline || !changed || catchUp {
+		t.Errorf("expected to be back online without catching up, got %s, changed %t, catch up %t", watch.state, changed, catchUp)
+	}
+
+	//losing every peer is still isolation, however long ago they went
+	peers["a"] = false
+	if watch.check(peersHealth(peers, now), later); watch.state != NetIsolated {
+		t.Errorf("expected isolation, got %s", watch.state)
+	}
+}
+
+func TestResyncResolvesFork(t *testing.T) {
+	tn := newTestNetwork(t)
+	first := tn.addNode("first", "cash")
+	tn.transact(first, 1, 100)
+	second := tn.addNode("second", "retail")
+
+	//while the network is split, each side adds a block the other does not hear of
+	if err := first.cs.Ledger.Append(nextBlock(first.cs.Ledger.Latest(), 2, 10, "first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.cs.Ledger.Append(nextBlock(second.cs.Ledger.Latest(), 1, -30, "second")); err != nil {
+		t.Fatal(err)
+	}
+
+	//once it heals, both sides catch up and settle on the fork with the lowest tip hash
+	winner := first.cs.Ledger.Latest()
+	if second.cs.Ledger.Latest().Hash < winner.Hash {
+		winner = second.cs.Ledger.Latest()
+	}
+	for _, n := range []*testNode{first, second} {
+		index, err := n.cs.Resync()
+		if err != nil {
+			t.Fatalf("%s: %s", n.nick, err)
+		}
+		if index != 2 {
+			t.Errorf("%s resynced to block %d, expected 2", n.nick, index)
+		}
+	}
+	tn.waitForConvergence(time.Second)
+	if tip := first.cs.Ledger.Latest(); tip.Hash != winner.Hash {
+		t.Errorf("nodes settled on block %s, expected %s", tip.Hash, winner.Hash)
+	}
+}
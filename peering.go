@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	routingdisc "github.com/libp2p/go-libp2p-discovery"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+//MinReconnectDelay is how long we wait before the first reconnection attempt to a static peer that has dropped
+var MinReconnectDelay = time.Second
+
+//MaxReconnectDelay caps the delay between reconnection attempts, which doubles after every failed attempt
+var MaxReconnectDelay = 2 * time.Minute
+
+//PeerCheckInterval is how often the connection to a static peer is checked while it is up
+var PeerCheckInterval = 5 * time.Second
+
+//DHTInterval is how often we advertise ourselves on the DHT and look for the other terminals of the chain
+var DHTInterval = time.Minute
+
+//DHTRetryInterval is how soon we try again while the DHT has no peers to advertise ourselves to
+var DHTRetryInterval = 5 * time.Second
+
+//DHTProtocolPrefix keeps the DHT of the terminals apart from the public IPFS DHT
+const DHTProtocolPrefix = "/spiritchain"
+
+/*parsePeerAddrs parses a comma separated list of peer multiaddrs, each ending in the id of
+the peer, e.g. /ip4/10.1.2.3/tcp/4001/p2p/QmPeer. Addresses of the same peer are merged*/
+func parsePeerAddrs(list string) ([]peer.AddrInfo, error) {
+	var addrs []ma.Multiaddr
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer address %s: %s", s, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+	peers, err := peer.AddrInfosFromP2pAddrs(addrs...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer address: %s", err)
+	}
+	return peers, nil
+}
+
+//reconnectDelays are the delays keepConnected works with, taken from the globals when it starts
+type reconnectDelays struct {
+	check time.Duration
+	min   time.Duration
+	max   time.Duration
+}
+
+//currentReconnectDelays returns the delays set by PeerCheckInterval, MinReconnectDelay and MaxReconnectDelay
+func currentReconnectDelays() reconnectDelays {
+	return reconnectDelays{check: PeerCheckInterval, min: MinReconnectDelay, max: MaxReconnectDelay}
+}
+
+//next doubles the delay before the next reconnection attempt, up to the max
+func (d reconnectDelays) next(delay time.Duration) time.Duration {
+	if delay < d.min {
+		return d.min
+	}
+	delay *= 2
+	if delay > d.max {
+		delay = d.max
+	}
+	return delay
+}
+
+/*keepConnected connects the host to a static peer and reconnects whenever the connection
+drops, backing off after every failed attempt, until ctx is done*/
+func keepConnected(ctx context.Context, h host.Host, pi peer.AddrInfo, delays reconnectDelays) {
+	delay := time.Duration(0)
+	for {
+		wait := delays.check
+		if h.Network().Connectedness(pi.ID) != network.Connected {
+			err := h.Connect(ctx, pi)
+			if err != nil {
+				delay = delays.next(delay)
+				wait = delay
+				log.Printf("Error connecting to static peer %s, retrying in %s: %s", pi.ID.Pretty(), delay, err)
+			} else {
+				if delay > 0 {
+					log.Printf("Reconnected to static peer %s", pi.ID.Pretty())
+				}
+				delay = 0
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//connectStaticPeers keeps the host connected to every static peer, e.g. the bootstrap nodes of other sites
+func connectStaticPeers(ctx context.Context, h host.Host, peers []peer.AddrInfo) {
+	delays := currentReconnectDelays()
+	for _, pi := range peers {
+		if pi.ID == h.ID() {
+			continue
+		}
+		h.Peerstore().AddAddrs(pi.ID, pi.Addrs, time.Hour)
+		go keepConnected(ctx, h, pi, delays)
+	}
+}
+
+//rendezvous is the DHT namespace the terminals of a chain meet at
+func rendezvous(chain string) string {
+	return fmt.Sprintf("%s/%s", DiscoveryServiceTag, chain)
+}
+
+/*setupDHT starts a Kademlia DHT seeded with the bootstrap peers, and uses it to find the other
+terminals of the chain wherever they are, advertising ourselves at the rendezvous of the chain
+and connecting to the terminals found there every DHTInterval. Every terminal is a DHT server,
+since terminals at different sites cannot tell whether they are reachable by each other*/
+func setupDHT(ctx context.Context, h host.Host, chain string, bootstrap []peer.AddrInfo) (*dht.IpfsDHT, error) {
+	kad, err := dht.New(ctx, h, dht.Mode(dht.ModeServer), dht.ProtocolPrefix(DHTProtocolPrefix), dht.BootstrapPeers(bootstrap...))
+	if err != nil {
+		return nil, err
+	}
+	err = kad.Bootstrap(ctx)
+	if err != nil {
+		kad.Close()
+		return nil, err
+	}
+
+	rd := routingdisc.NewRoutingDiscovery(kad)
+	ns := rendezvous(chain)
+	interval, retry := DHTInterval, DHTRetryInterval
+	go func() {
+		for {
+			wait := interval
+			if !findPeers(ctx, h, rd, ns) {
+				wait = retry
+			}
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return kad, nil
+}
+
+/*findPeers advertises us at a rendezvous and connects to the terminals that have advertised
+there. It returns false if we could not be advertised, e.g. while the routing table is still empty*/
+func findPeers(ctx context.Context, h host.Host, rd *routingdisc.RoutingDiscovery, ns string) bool {
+	_, err := rd.Advertise(ctx, ns)
+	if err != nil {
+		log.Printf("Error advertising on the DHT: %s", err)
+		return false
+	}
+	found, err := rd.FindPeers(ctx, ns)
+	if err != nil {
+		log.Printf("Error looking for peers on the DHT: %s", err)
+		return true
+	}
+	for pi := range found {
+		if pi.ID == h.ID() || len(pi.Addrs) == 0 || h.Network().Connectedness(pi.ID) == network.Connected {
+			continue
+		}
+		err = h.Connect(ctx, pi)
+		if err != nil {
+			log.Printf("Error connecting to peer %s found on the DHT: %s", pi.ID.Pretty(), err)
+			continue
+		}
+		log.Printf("Connected to peer %s found on the DHT", pi.ID.Pretty())
+	}
+	return true
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestParsePeerAddrs(t *testing.T) {
+	peers, err := parsePeerAddrs("")
+	if err != nil || len(peers) != 0 {
+		t.Errorf("empty list: got %v, %v", peers, err)
+	}
+
+	id := "QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC"
+	peers, err = parsePeerAddrs(fmt.Sprintf("/ip4/10.1.2.3/tcp/4001/p2p/%s, /ip4/10.1.2.4/tcp/4001/p2p/%s", id, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].ID.Pretty() != id || len(peers[0].Addrs) != 2 {
+		t.Errorf("expected one peer with two addresses, got %v", peers)
+	}
+
+	for _, list := range []string{"10.1.2.3:4001", "/ip4/10.1.2.3/tcp/4001"} {
+		if _, err = parsePeerAddrs(list); err == nil {
+			t.Errorf("expected an error for %s", list)
+		}
+	}
+}
+
+func TestReconnectDelays(t *testing.T) {
+	d := reconnectDelays{check: time.Second, min: time.Second, max: time.Minute}
+	delay := time.Duration(0)
+	var delays []time.Duration
+	for i := 0; i < 10; i++ {
+		delay = d.next(delay)
+		delays = append(delays, delay)
+	}
+	if delays[0] != time.Second || delays[1] != 2*time.Second || delays[2] != 4*time.Second {
+		t.Errorf("delay does not double from %s: %v", d.min, delays)
+	}
+	if delays[9] != time.Minute {
+		t.Errorf("delay is not capped at %s: %v", d.max, delays)
+	}
+}
+
+//newMockHosts creates n linked but unconnected hosts on a mocknet, closed when the test ends
+func newMockHosts(t *testing.T, ctx context.Context, n int) (mocknet.Mocknet, []host.Host) {
+	mn := mocknet.New(ctx)
+	var hosts []host.Host
+	for i := 0; i < n; i++ {
+		sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := ma.NewMultiaddr(fmt.Sprintf("/ip4/10.0.1.%d/tcp/4001", i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := mn.AddPeer(sk, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts = append(hosts, h)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, h := range hosts {
+			h.Close()
+		}
+	})
+	return mn, hosts
+}
+
+//waitConnected waits until a host is connected to a peer, or fails the test
+func waitConnected(t *testing.T, h host.Host, id peer.ID, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for h.Network().Connectedness(id) != network.Connected {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is not connected to %s", h.ID().Pretty(), id.Pretty())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestStaticPeerReconnects(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	checkInterval, minDelay := PeerCheckInterval, MinReconnectDelay
+	PeerCheckInterval, MinReconnectDelay = 50*time.Millisecond, 50*time.Millisecond
+	defer func() { PeerCheckInterval, MinReconnectDelay = checkInterval, minDelay }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn, hosts := newMockHosts(t, ctx, 2)
+	a, b := hosts[0], hosts[1]
+
+	connectStaticPeers(ctx, a, []peer.AddrInfo{{ID: b.ID(), Addrs: b.Addrs()}})
+	waitConnected(t, a, b.ID(), 5*time.Second)
+
+	//the link goes down, attempts fail and back off until it comes back
+	if err := mn.UnlinkPeers(a.ID(), b.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.DisconnectPeers(a.ID(), b.ID()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if a.Network().Connectedness(b.ID()) == network.Connected {
+		t.Fatal("connected over a link that is down")
+	}
+	if _, err := mn.LinkPeers(a.ID(), b.ID()); err != nil {
+		t.Fatal(err)
+	}
+	waitConnected(t, a, b.ID(), 5*time.Second)
+}
+
+func TestDHTRendezvous(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	interval, retry := DHTInterval, DHTRetryInterval
+	DHTInterval, DHTRetryInterval = 200*time.Millisecond, 100*time.Millisecond
+	defer func() { DHTInterval, DHTRetryInterval = interval, retry }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, hosts := newMockHosts(t, ctx, 3)
+	bootstrap, a, b := hosts[0], hosts[1], hosts[2]
+
+	//the bootstrap node runs the DHT without being a terminal of the chain
+	kad, err := setupDHT(ctx, bootstrap, "other-chain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kad.Close()
+	//the two terminals only know the bootstrap node, and meet at the rendezvous of their chain
+	seed := []peer.AddrInfo{{ID: bootstrap.ID(), Addrs: bootstrap.Addrs()}}
+	for _, h := range []host.Host{a, b} {
+		connectStaticPeers(ctx, h, seed)
+		waitConnected(t, h, bootstrap.ID(), 5*time.Second)
+		kad, err := setupDHT(ctx, h, testChainName, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer kad.Close()
+	}
+	waitConnected(t, a, b.ID(), 10*time.Second)
+}
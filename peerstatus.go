@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+/*PeerStatus is what a terminal has heard of one of its peers. Nick, Type and Version come
+from the signed presence records of the peer once it has announced itself (Signed), and
+until then from what its other messages claim. Height is taken from its latest message and
+is -1 until the peer has sent a block, its index or a presence record*/
+type PeerStatus struct {
+	Id        string    `json:"peer_id"`
+	Nick      string    `json:"nick"`
+	Type      string    `json:"role"`
+	Version   string    `json:"version"`
+	Height    int       `json:"height"`
+	LastSeen  time.Time `json:"last_seen"`
+	Announced time.Time `json:"announced"`
+	Signed    bool      `json:"signed"`
+	//ourHeight is the height of our chain when the peer told us its height
+	ourHeight int
+}
+
+//seePeer records a message from a peer. A height of -1 leaves the known height of the peer as it is
+func (cs *ChainSubscription) seePeer(id string, nick string, typePos string, height int) {
+	if len(id) == 0 || id == cs.self.Pretty() {
+		return
+	}
+	ours := cs.Ledger.Latest().Index
+	cs.peersMu.Lock()
+	defer cs.peersMu.Unlock()
+	if cs.peers == nil {
+		cs.peers = make(map[string]*PeerStatus)
+	}
+	status, ok := cs.peers[id]
+	if !ok {
+		status = &PeerStatus{Id: id, Height: -1}
+		cs.peers[id] = status
+	}
+	if len(nick) > 0 && !status.Signed {
+		status.Nick = nick
+	}
+	if len(typePos) > 0 && !status.Signed {
+		status.Type = typePos
+	}
+	if height >= 0 {
+		status.Height = height
+		status.ourHeight = ours
+	}
+	status.LastSeen = time.Now()
+}
+
+//seeMessage records the sender of a sync message. Only index and chain replies carry the height of the sender
+func (cs *ChainSubscription) seeMessage(msg *SpecialMessage) {
+	height := -1
+	if msg.Type == 3 || msg.Type == 4 {
+		height = msg.Index
+	}
+	cs.seePeer(msg.Sender, msg.SenderNick, msg.SenderType, height)
+}
+
+/*PeerStatuses returns the status of every peer currently subscribed to the chain, sorted by
+nickname. Peers that have not sent anything yet only have their id*/
+func (cs *ChainSubscription) PeerStatuses() []PeerStatus {
+	peers := cs.ListPeers()
+
+	cs.peersMu.Lock()
+	statuses := make([]PeerStatus, 0, len(peers))
+	for _, p := range peers {
+		if status, ok := cs.peers[p.Pretty()]; ok {
+			statuses = append(statuses, *status)
+		} else {
+			statuses = append(statuses, PeerStatus{Id: p.Pretty(), Height: -1})
+		}
+	}
+	cs.peersMu.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Nick != statuses[j].Nick {
+			return statuses[i].Nick < statuses[j].Nick
+		}
+		return statuses[i].Id < statuses[j].Id
+	})
+	return statuses
+}
+
+//LastSync returns when the chain was last synced with the network, at startup or by Resync
+func (cs *ChainSubscription) LastSync() time.Time {
+	cs.syncMu.Lock()
+	defer cs.syncMu.Unlock()
+	return cs.lastSync
+}
+
+//synced records that a sync has completed
+func (cs *ChainSubscription) synced() {
+	cs.syncMu.Lock()
+	defer cs.syncMu.Unlock()
+	cs.lastSync = time.Now()
+}
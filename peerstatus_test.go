@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPeerStatuses(t *testing.T) {
+	tn := newTestNetwork(t)
+	first := tn.addNode("first", "cash")
+	tn.transact(first, 1, 100)
+	second := tn.addNode("second", "retail")
+	tn.transact(first, 2, 50)
+
+	//the second node heard of the first from its index reply and its blocks
+	statuses := second.cs.PeerStatuses()
+	if len(statuses) != 1 {
+		t.Fatalf("second node has %d peers, expected 1", len(statuses))
+	}
+	if s := statuses[0]; s.Id != first.host.ID().Pretty() || s.Nick != "first" || s.Type != "cash" || s.Height != 2 || s.LastSeen.IsZero() {
+		t.Errorf("unexpected status of the first node %+v", s)
+	}
+
+	//the first node heard of the second from its index request, if not from its presence record yet
+	statuses = first.cs.PeerStatuses()
+	if len(statuses) != 1 {
+		t.Fatalf("first node has %d peers, expected 1", len(statuses))
+	}
+	if s := statuses[0]; s.Nick != "second" || s.Type != "retail" {
+		t.Errorf("unexpected status of the second node %+v", s)
+	}
+	if second.cs.LastSync().IsZero() {
+		t.Error("second node has not recorded its sync")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+//Version is the software version terminals announce. Set it at build time with -ldflags "-X main.Version=1.2.0"
+var Version = "dev"
+
+//PresenceInterval is how often a terminal announces its presence on the topic
+var PresenceInterval = 10 * time.Second
+
+//ErrPresenceSignature is returned for a presence record that is not signed by the peer it is about
+var ErrPresenceSignature = errors.New("presence record signature is not valid")
+
+/*PresenceRecord is what a terminal announces about itself, signed with its peer key so that
+no other terminal can announce it under a different nickname or role*/
+type PresenceRecord struct {
+	PeerId  string
+	Nick    string
+	Role    string
+	Version string
+	Height  int
+	Time    time.Time
+	//PublicKey is the marshalled key of PeerId
+	PublicKey []byte
+	Signature []byte
+}
+
+//signedContent is the part of a presence record covered by the signature
+func (rec *PresenceRecord) signedContent() ([]byte, error) {
+	return json.Marshal(struct {
+		PeerId  string
+		Nick    string
+		Role    string
+		Version string
+		Height  int
+		Time    time.Time
+	}{rec.PeerId, rec.Nick, rec.Role, rec.Version, rec.Height, rec.Time})
+}
+
+//NewPresenceRecord builds the presence record of a terminal at a chain height, signed with its peer key
+func NewPresenceRecord(key crypto.PrivKey, nick string, role string, height int) (*PresenceRecord, error) {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := crypto.MarshalPublicKey(key.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	rec := &PresenceRecord{
+		PeerId:    id.Pretty(),
+		Nick:      nick,
+		Role:      role,
+		Version:   Version,
+		Height:    height,
+		Time:      time.Now(),
+		PublicKey: pub,
+	}
+	content, err := rec.signedContent()
+	if err != nil {
+		return nil, err
+	}
+	rec.Signature, err = key.Sign(content)
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+//Verify checks that a presence record is signed by the key of its peer id
+func (rec *PresenceRecord) Verify() error {
+	pub, err := crypto.UnmarshalPublicKey(rec.PublicKey)
+	if err != nil {
+		return ErrPresenceSignature
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil || id.Pretty() != rec.PeerId {
+		return ErrPresenceSignature
+	}
+	content, err := rec.signedContent()
+	if err != nil {
+		return err
+	}
+	ok, err := pub.Verify(content, rec.Signature)
+	if err != nil || !ok {
+		return ErrPresenceSignature
+	}
+	return nil
+}
+
+/*AnnouncePresence publishes the presence record of the terminal straight away and then every
+PresenceInterval, until the subscription is stopped. key is the peer key of the host*/
+func (cs *ChainSubscription) AnnouncePresence(key crypto.PrivKey) {
+	cs.spawn(func() {
+		ticker := time.NewTicker(PresenceInterval)
+		defer ticker.Stop()
+		for {
+			err := cs.publishPresence(key)
+			if err != nil {
+				log.Printf("Error announcing presence: %s", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-cs.ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+//publishPresence publishes a presence announcement (type 5) with our current height
+func (cs *ChainSubscription) publishPresence(key crypto.PrivKey) error {
+	rec, err := NewPresenceRecord(key, cs.nickName, cs.typePos, cs.Ledger.Latest().Index)
+	if err != nil {
+		return err
+	}
+	m := SpecialMessage{
+		Type:       5,
+		Timestamp:  time.Now().String(),
+		Sender:     cs.self.Pretty(),
+		SenderNick: cs.nickName,
+		SenderType: cs.typePos,
+		Presence:   rec,
+	}
+	jsonM, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return cs.topic.Publish(cs.ctx, jsonM)
+}
+
+/*seePresence adds a presence announcement to the peer directory. Records that do not verify,
+and records older than the last one from the same peer, e.g. replayed ones, are dropped*/
+func (cs *ChainSubscription) seePresence(rec *PresenceRecord) {
+	if rec == nil || rec.PeerId == cs.self.Pretty() {
+		return
+	}
+	err := rec.Verify()
+	if err != nil {
+		log.Printf("Dropped presence record of %s: %s", rec.PeerId, err)
+		return
+	}
+
+	ours := cs.Ledger.Latest().Index
+	cs.peersMu.Lock()
+	defer cs.peersMu.Unlock()
+	if cs.peers == nil {
+		cs.peers = make(map[string]*PeerStatus)
+	}
+	status, ok := cs.peers[rec.PeerId]
+	if !ok {
+		status = &PeerStatus{Id: rec.PeerId}
+		cs.peers[rec.PeerId] = status
+	}
+	if !rec.Time.After(status.Announced) {
+		return
+	}
+	status.Nick = rec.Nick
+	status.Type = rec.Role
+	status.Version = rec.Version
+	status.Height = rec.Height
+	status.ourHeight = ours
+	status.Announced = rec.Time
+	status.Signed = true
+	status.LastSeen = time.Now()
+}
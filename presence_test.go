@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+)
+
+func TestPresenceRecord(t *testing.T) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := NewPresenceRecord(key, "vineet", "cash", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Verify(); err != nil {
+		t.Fatalf("valid record does not verify: %s", err)
+	}
+	if rec.Version != Version || rec.Height != 42 {
+		t.Errorf("unexpected record %+v", rec)
+	}
+
+	tampered := *rec
+	tampered.Role = "retail"
+	if err := tampered.Verify(); err != ErrPresenceSignature {
+		t.Errorf("tampered record: expected %s, got %v", ErrPresenceSignature, err)
+	}
+
+	//a terminal cannot announce itself as another
+	other, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := NewPresenceRecord(other, "vineet", "cash", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.PeerId = rec.PeerId
+	if err := forged.Verify(); err != ErrPresenceSignature {
+		t.Errorf("forged record: expected %s, got %v", ErrPresenceSignature, err)
+	}
+}
+
+func TestPresenceDirectory(t *testing.T) {
+	tn := newTestNetwork(t)
+	first := tn.addNode("first", "cash")
+	second := tn.addNode("second", "retail")
+
+	var status PeerStatus
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		statuses := first.cs.PeerStatuses()
+		if len(statuses) == 1 && statuses[0].Signed {
+			status = statuses[0]
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("first node has not received the presence of the second: %+v", statuses)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if status.Id != second.host.ID().Pretty() || status.Nick != "second" || status.Type != "retail" || status.Version != Version || status.Height != 0 {
+		t.Errorf("unexpected directory entry %+v", status)
+	}
+
+	//a claim in a later message does not override the signed record
+	first.cs.seePeer(status.Id, "impostor", "cash", -1)
+	//and neither does an older record, e.g. a replayed one
+	key := second.host.Peerstore().PrivKey(second.host.ID())
+	old, err := NewPresenceRecord(key, "renamed", "retail", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Time = status.Announced.Add(-time.Second)
+	content, _ := old.signedContent()
+	old.Signature, _ = key.Sign(content)
+	first.cs.seePresence(old)
+
+	if s := first.cs.PeerStatuses()[0]; s.Nick != "second" || s.Type != "retail" {
+		t.Errorf("directory entry was overridden %+v", s)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/control"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/pnet"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+//pskHeader starts every pre-shared key file, in the format of the swarm.key files of IPFS
+const pskHeader = "/key/swarm/psk/1.0.0/\n/base16/\n"
+
+//ErrEmptyAllowList is returned for an allow-list file without any peer id, which would keep out every peer
+var ErrEmptyAllowList = errors.New("allow-list has no peer ids")
+
+//loadPSK reads the pre-shared key of a private network from a file
+func loadPSK(path string) (pnet.PSK, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	psk, err := pnet.DecodeV1PSK(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pre-shared key %s: %s", path, err)
+	}
+	return psk, nil
+}
+
+//writeNewPSK writes a new random 256 bit pre-shared key
+func writeNewPSK(w io.Writer) error {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s%s\n", pskHeader, hex.EncodeToString(key))
+	return err
+}
+
+/*AllowList is a connection gater that only lets the host connect to the peers on it. The peer
+id of a connection is only known once it is secured, so inbound connections are admitted
+until then*/
+type AllowList struct {
+	ids map[peer.ID]bool
+}
+
+/*readAllowList reads an allow-list of peer ids, one per line. Blank lines and anything after a
+# are ignored, so that each id can be labelled with the terminal it belongs to*/
+func readAllowList(r io.Reader) (*AllowList, error) {
+	al := &AllowList{ids: make(map[peer.ID]bool)}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if len(text) == 0 {
+			continue
+		}
+		id, err := peer.Decode(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid peer id %s: %s", line, text, err)
+		}
+		al.ids[id] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(al.ids) == 0 {
+		return nil, ErrEmptyAllowList
+	}
+	return al, nil
+}
+
+//loadAllowList reads an allow-list from a file
+func loadAllowList(path string) (*AllowList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	al, err := readAllowList(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return al, nil
+}
+
+//Allows tells whether a peer is on the allow-list
+func (al *AllowList) Allows(id peer.ID) bool {
+	return al.ids[id]
+}
+
+func (al *AllowList) InterceptPeerDial(id peer.ID) bool {
+	return al.Allows(id)
+}
+
+func (al *AllowList) InterceptAddrDial(id peer.ID, addr ma.Multiaddr) bool {
+	return al.Allows(id)
+}
+
+func (al *AllowList) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	return true
+}
+
+func (al *AllowList) InterceptSecured(dir network.Direction, id peer.ID, addrs network.ConnMultiaddrs) bool {
+	return al.Allows(id)
+}
+
+func (al *AllowList) InterceptUpgraded(conn network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+//runPSK implements the psk subcommand, which makes the pre-shared key of a new private network
+func runPSK(args []string) int {
+	fs := flag.NewFlagSet("psk", flag.ExitOnError)
+	outFlag := fs.String("o", "", "file to write the key to. standard output if left empty")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s psk [-o=FILE]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Writes a new pre-shared key for a private network of terminals, to be given to each with -psk.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	out := io.Writer(os.Stdout)
+	if len(*outFlag) > 0 {
+		//the key is a secret, so the file is readable by the owner only
+		file, err := os.OpenFile(*outFlag, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			printErr("%s\n", err)
+			return 2
+		}
+		defer file.Close()
+		out = file
+	}
+	err := writeNewPSK(out)
+	if err != nil {
+		printErr("%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+//runID implements the id subcommand, which prints the peer id of a terminal for the allow-lists of the others
+func runID(args []string) int {
+	fs := flag.NewFlagSet("id", flag.ExitOnError)
+	keyFlag := fs.String("key", "", "identity key file of the terminal, as given to it with -key. created if it does not exist")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s id -key=FILE\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Prints the peer id of a terminal, to be added to the allow-lists of the others.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 || len(*keyFlag) == 0 {
+		fs.Usage()
+		return 2
+	}
+	key, err := loadOrCreateKey(*keyFlag)
+	if err != nil {
+		printErr("%s\n", err)
+		return 2
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		printErr("%s\n", err)
+		return 1
+	}
+	fmt.Println(id.Pretty())
+	return 0
+}
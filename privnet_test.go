@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/pnet"
+)
+
+//newPeerId makes the key and peer id of a new terminal
+func newPeerId(t *testing.T) (crypto.PrivKey, peer.ID) {
+	t.Helper()
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, id
+}
+
+func TestAllowList(t *testing.T) {
+	_, first := newPeerId(t)
+	_, second := newPeerId(t)
+	_, other := newPeerId(t)
+
+	al, err := readAllowList(strings.NewReader(fmt.Sprintf("# store 12\n%s # till 1\n\n  %s\n", first.Pretty(), second.Pretty())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !al.Allows(first) || !al.Allows(second) || al.Allows(other) {
+		t.Errorf("unexpected allow-list %v", al.ids)
+	}
+	if !al.InterceptSecured(network.DirInbound, first, nil) || al.InterceptSecured(network.DirInbound, other, nil) {
+		t.Error("secured connections are not checked against the allow-list")
+	}
+	if al.InterceptPeerDial(other) {
+		t.Error("dialled a peer that is not on the allow-list")
+	}
+
+	if _, err = readAllowList(strings.NewReader("# nobody yet\n")); err != ErrEmptyAllowList {
+		t.Errorf("empty allow-list: expected %s, got %v", ErrEmptyAllowList, err)
+	}
+	if _, err = readAllowList(strings.NewReader("till-1\n")); err == nil || !strings.HasPrefix(err.Error(), "line 1:") {
+		t.Errorf("expected an error on line 1, got %v", err)
+	}
+}
+
+func TestWriteNewPSK(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeNewPSK(&buf); err != nil {
+		t.Fatal(err)
+	}
+	psk, err := pnet.DecodeV1PSK(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(psk) != 32 {
+		t.Errorf("key has %d bytes, expected 32", len(psk))
+	}
+}
+
+//newPrivateHost starts a host listening on localhost in the private network of psk, admitting only the peers on al if it is not nil
+func newPrivateHost(t *testing.T, ctx context.Context, key crypto.PrivKey, psk pnet.PSK, al *AllowList) host.Host {
+	t.Helper()
+	opts := []libp2p.Option{libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.Identity(key), libp2p.PrivateNetwork(psk)}
+	if al != nil {
+		opts = append(opts, libp2p.ConnectionGater(al))
+	}
+	h, err := libp2p.New(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestPrivateNetwork(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newPSK := func() pnet.PSK {
+		var buf bytes.Buffer
+		if err := writeNewPSK(&buf); err != nil {
+			t.Fatal(err)
+		}
+		psk, err := pnet.DecodeV1PSK(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return psk
+	}
+	psk, otherPSK := newPSK(), newPSK()
+
+	firstKey, firstId := newPeerId(t)
+	secondKey, secondId := newPeerId(t)
+	al := &AllowList{ids: map[peer.ID]bool{firstId: true, secondId: true}}
+	first := newPrivateHost(t, ctx, firstKey, psk, al)
+	second := newPrivateHost(t, ctx, secondKey, psk, al)
+	otherKey, _ := newPeerId(t)
+	//a host of another private network, and one of ours that is not on the allow-list
+	foreign := newPrivateHost(t, ctx, otherKey, otherPSK, nil)
+	strangerKey, _ := newPeerId(t)
+	stranger := newPrivateHost(t, ctx, strangerKey, psk, nil)
+
+	//a handshake under the wrong key does not fail, it stalls
+	connect := func(from host.Host, to host.Host) error {
+		dialCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		defer cancel()
+		return from.Connect(dialCtx, peer.AddrInfo{ID: to.ID(), Addrs: to.Addrs()})
+	}
+	if err := connect(first, second); err != nil {
+		t.Errorf("peers on the allow-list cannot connect: %s", err)
+	}
+	if err := connect(foreign, first); err == nil {
+		t.Error("a host of another private network connected")
+	}
+	if err := connect(first, stranger); err == nil {
+		t.Error("dialled a peer that is not on the allow-list")
+	}
+	if err := connect(stranger, first); err == nil && first.Network().Connectedness(stranger.ID()) == network.Connected {
+		t.Error("accepted a peer that is not on the allow-list")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+//rateLimit is how many messages of a kind a peer may publish per second, in bursts of up to Burst
+type rateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+/*IndexRequestLimit limits the index requests (type 1) of every peer. Each of them is answered
+by every terminal on the topic, so they are limited the most*/
+var IndexRequestLimit = rateLimit{Rate: 0.5, Burst: 5}
+
+//ChainRequestLimit limits the chain requests (type 2) of every peer. A long chain is synced with one per batch
+var ChainRequestLimit = rateLimit{Rate: 20, Burst: 50}
+
+//TransactionLimit limits the new blocks of every peer, including those made on this terminal
+var TransactionLimit = rateLimit{Rate: 5, Burst: 20}
+
+//DuplicateRequestWindow is how long a request is remembered, so that the same request from the same peer is dropped if it is replayed
+var DuplicateRequestWindow = time.Second
+
+//ErrRateLimited is returned for a transaction made on this terminal faster than TransactionLimit allows
+var ErrRateLimited = errors.New("too many transactions, try again in a moment")
+
+//reasons a message is dropped for, see DroppedMessages
+const (
+	DropInvalid     = "invalid"
+	DropRateLimited = "rate_limited"
+	DropDuplicate   = "duplicate"
+)
+
+//DroppedMessages counts the messages the topic validator has dropped, by reason and by the peer that published them
+type DroppedMessages struct {
+	Total    uint64            `json:"total"`
+	ByReason map[string]uint64 `json:"by_reason"`
+	ByPeer   map[string]uint64 `json:"by_peer"`
+}
+
+//tokenBucket holds what is left of the rate limit of a peer for one kind of message
+type tokenBucket struct {
+	limit   rateLimit
+	tokens  float64
+	last    time.Time
+	limited bool
+}
+
+//take takes a token from the bucket if there is one left, after refilling it for the time since the last take
+func (b *tokenBucket) take(now time.Time) bool {
+	b.tokens = b.available(now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+//available is how many tokens the bucket holds at now
+func (b *tokenBucket) available(now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*b.limit.Rate
+	if tokens > b.limit.Burst {
+		tokens = b.limit.Burst
+	}
+	return tokens
+}
+
+/*messageFilter is the topic validator of a chain. On top of the checks of checkMessage it
+limits how fast every peer may publish requests and blocks, and drops requests that a peer
+repeats, so that no peer can make the whole network answer a flood of requests. Our own
+messages are only checked, the limit on our own transactions is kept by SubmitTransaction*/
+type messageFilter struct {
+	self   peer.ID
+	limits map[int]rateLimit
+
+	mu       sync.Mutex
+	buckets  map[string]*tokenBucket
+	requests map[string]time.Time
+	window   time.Duration
+	swept    time.Time
+	dropped  DroppedMessages
+}
+
+//newMessageFilter makes the validator of a chain for a terminal, with the limits set when it is made
+func newMessageFilter(self peer.ID) *messageFilter {
+	return &messageFilter{
+		self: self,
+		limits: map[int]rateLimit{
+			blockMessage: TransactionLimit,
+			1:            IndexRequestLimit,
+			2:            ChainRequestLimit,
+		},
+		buckets:  make(map[string]*tokenBucket),
+		requests: make(map[string]time.Time),
+		window:   DuplicateRequestWindow,
+		dropped:  DroppedMessages{ByReason: make(map[string]uint64), ByPeer: make(map[string]uint64)},
+	}
+}
+
+/*admit decides whether a valid message of type typ published by author is let through at
+now. It returns the reason the message is dropped for, or "" if it is not*/
+func (f *messageFilter) admit(author string, typ int, req *SpecialMessage, now time.Time) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sweep(now)
+
+	if req != nil {
+		//the timestamp is chosen by the sender, so it is left out and a replay cannot get past by changing it
+		key := fmt.Sprintf("%s/%d/%s/%d/%s", author, req.Type, req.Receiver, req.Index, req.Hash)
+		if seen, ok := f.requests[key]; ok && now.Sub(seen) < f.window {
+			return DropDuplicate
+		}
+		f.requests[key] = now
+	}
+
+	limit, ok := f.limits[typ]
+	if !ok {
+		return ""
+	}
+	key := fmt.Sprintf("%s/%d", author, typ)
+	b, ok := f.buckets[key]
+	if !ok {
+		b = &tokenBucket{limit: limit, tokens: limit.Burst, last: now}
+		f.buckets[key] = b
+	}
+	if !b.take(now) {
+		if !b.limited {
+			log.Printf("Rate limiting messages of type %d from %s", typ, author)
+			b.limited = true
+		}
+		return DropRateLimited
+	}
+	b.limited = false
+	return ""
+}
+
+/*sweep forgets the requests older than the duplicate window, and the buckets that have filled
+up again, once per window. The caller must hold f.mu*/
+func (f *messageFilter) sweep(now time.Time) {
+	if now.Sub(f.swept) < f.window {
+		return
+	}
+	f.swept = now
+	for key, seen := range f.requests {
+		if now.Sub(seen) >= f.window {
+			delete(f.requests, key)
+		}
+	}
+	for key, b := range f.buckets {
+		if b.available(now) >= b.limit.Burst {
+			delete(f.buckets, key)
+		}
+	}
+}
+
+//drop counts a dropped message
+func (f *messageFilter) drop(author string, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dropped.Total++
+	f.dropped.ByReason[reason]++
+	f.dropped.ByPeer[author]++
+}
+
+//allowTransaction takes a token for a transaction made on this terminal, which peers would drop over the limit
+func (f *messageFilter) allowTransaction(now time.Time) bool {
+	return f.admit(f.self.Pretty(), blockMessage, nil, now) == ""
+}
+
+//stats returns a copy of the counts of dropped messages
+func (f *messageFilter) stats() DroppedMessages {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stats := DroppedMessages{Total: f.dropped.Total, ByReason: make(map[string]uint64), ByPeer: make(map[string]uint64)}
+	for reason, n := range f.dropped.ByReason {
+		stats.ByReason[reason] = n
+	}
+	for id, n := range f.dropped.ByPeer {
+		stats.ByPeer[id] = n
+	}
+	return stats
+}
+
+//DroppedMessages returns the counts of the messages on the topic that were dropped as invalid, rate limited or repeated
+func (cs *ChainSubscription) DroppedMessages() DroppedMessages {
+	if cs.filter == nil {
+		return DroppedMessages{ByReason: map[string]uint64{}, ByPeer: map[string]uint64{}}
+	}
+	return cs.filter.stats()
+}
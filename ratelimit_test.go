@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestMessageFilter(t *testing.T) {
+	_, self := newPeerId(t)
+	f := newMessageFilter(self)
+	now := time.Now()
+	request := func(index int) *SpecialMessage {
+		return &SpecialMessage{Type: 1, Sender: "a", Index: index}
+	}
+
+	//index requests are limited to a burst, then refill over time
+	for i := 0; i < int(IndexRequestLimit.Burst); i++ {
+		if reason := f.admit("a", 1, request(i), now); reason != "" {
+			t.Fatalf("request %d dropped as %s", i, reason)
+		}
+	}
+	if reason := f.admit("a", 1, request(100), now); reason != DropRateLimited {
+		t.Errorf("request over the burst: expected %s, got %q", DropRateLimited, reason)
+	}
+	if reason := f.admit("b", 1, request(100), now); reason != "" {
+		t.Errorf("another peer is limited too: %s", reason)
+	}
+	later := now.Add(time.Duration(float64(time.Second) / IndexRequestLimit.Rate))
+	if reason := f.admit("a", 1, request(101), later); reason != "" {
+		t.Errorf("request after a refill dropped as %s", reason)
+	}
+
+	//the same request is dropped within the window, whatever the limit
+	chain := &SpecialMessage{Type: 2, Sender: "c", Receiver: "a", Index: 10}
+	if reason := f.admit("c", 2, chain, now); reason != "" {
+		t.Fatalf("chain request dropped as %s", reason)
+	}
+	if reason := f.admit("c", 2, chain, now.Add(DuplicateRequestWindow/2)); reason != DropDuplicate {
+		t.Errorf("repeated request: expected %s, got %q", DropDuplicate, reason)
+	}
+	if reason := f.admit("c", 2, chain, now.Add(DuplicateRequestWindow)); reason != "" {
+		t.Errorf("request after the window dropped as %s", reason)
+	}
+	//a replay with a new timestamp is still a replay
+	again := *chain
+	again.Timestamp = "later"
+	if reason := f.admit("c", 2, &again, now.Add(DuplicateRequestWindow)); reason != DropDuplicate {
+		t.Errorf("replay with a new timestamp dropped as %q, expected %s", reason, DropDuplicate)
+	}
+
+	//our own transactions are held to the limit our peers apply
+	for i := 0; i < int(TransactionLimit.Burst); i++ {
+		if !f.allowTransaction(now) {
+			t.Fatalf("transaction %d refused", i)
+		}
+	}
+	if f.allowTransaction(now) {
+		t.Error("transaction over the burst allowed")
+	}
+
+	//buckets that have filled up again are forgotten
+	f.admit("d", blockMessage, nil, now.Add(time.Hour))
+	if len(f.buckets) != 1 {
+		t.Errorf("expected only the bucket of d to be left, got %d buckets", len(f.buckets))
+	}
+
+	f.drop("a", DropRateLimited)
+	f.drop("a", DropDuplicate)
+	f.drop("b", DropInvalid)
+	stats := f.stats()
+	if stats.Total != 3 || stats.ByReason[DropRateLimited] != 1 || stats.ByPeer["a"] != 2 || stats.ByPeer["b"] != 1 {
+		t.Errorf("unexpected counts %+v", stats)
+	}
+}
+
+func TestIndexRequestFloodIsLimited(t *testing.T) {
+	tn := newTestNetwork(t)
+	honest := tn.addNode("honest", "cash")
+
+	//the attacker is a bare gossipsub host that publishes whatever it likes
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := ma.NewMultiaddr("/ip4/10.0.0.99/tcp/4242")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attacker, err := tn.mn.AddPeer(sk, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+	ps, err := pubsub.NewGossipSub(tn.ctx, attacker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tn.mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tn.mn.ConnectPeers(attacker.ID(), honest.host.ID()); err != nil {
+		t.Fatal(err)
+	}
+	topic, err := ps.Join(testChainName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//every request let through is answered with an index reply. The subscription also gets
+	//our own requests, so it is read while they are published to keep it from overflowing
+	readCtx, cancel := context.WithTimeout(tn.ctx, 10*time.Second)
+	defer cancel()
+	ready := make(chan struct{})
+	counted := make(chan int)
+	go func() {
+		replies, answered := 0, false
+		for {
+			msg, err := sub.Next(readCtx)
+			if err != nil {
+				counted <- replies
+				return
+			}
+			var reply SpecialMessage
+			if json.Unmarshal(msg.Data, &reply) != nil || reply.Receiver != attacker.ID().Pretty() {
+				continue
+			}
+			switch reply.Type {
+			case 3:
+				replies++
+			case 4:
+				if !answered {
+					close(ready)
+					answered = true
+				}
+			}
+		}
+	}()
+
+	//messages published straight after the peers meet can get lost, so chain requests, which
+	//are not limited as tightly, are sent until one is answered
+	for i := 0; ; i++ {
+		m := SpecialMessage{Type: 2, Timestamp: time.Now().String(), Sender: attacker.ID().Pretty(), Receiver: honest.host.ID().Pretty(), Index: i}
+		if err = topic.Publish(tn.ctx, marshal(t, m)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-ready:
+		case <-time.After(100 * time.Millisecond):
+			continue
+		case <-readCtx.Done():
+			t.Fatal("honest peer does not answer")
+		}
+		break
+	}
+
+	//a request replayed with a new timestamp, then a flood of requests that differ
+	const flood = 30
+	requests := []int{0, 0}
+	for i := 1; i <= flood; i++ {
+		requests = append(requests, i)
+	}
+	for _, index := range requests {
+		m := SpecialMessage{Type: 1, Timestamp: time.Now().String(), Sender: attacker.ID().Pretty(), Index: index}
+		if err = topic.Publish(tn.ctx, marshal(t, m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(2 * time.Second)
+	cancel()
+	replies := <-counted
+
+	//the limit may have refilled by a token while the requests were published
+	if replies == 0 || replies > int(IndexRequestLimit.Burst)+1 {
+		t.Errorf("answered %d of %d requests, expected at most %d", replies, len(requests), int(IndexRequestLimit.Burst)+1)
+	}
+	stats := honest.cs.DroppedMessages()
+	if stats.ByReason[DropDuplicate] != 1 {
+		t.Errorf("expected 1 duplicate request, got %d", stats.ByReason[DropDuplicate])
+	}
+	if dropped := int(stats.ByReason[DropRateLimited]); dropped+replies != len(requests)-1 {
+		t.Errorf("%d requests rate limited and %d answered, expected %d in all", dropped, replies, len(requests)-1)
+	}
+	if stats.ByPeer[attacker.ID().Pretty()] != stats.Total {
+		t.Errorf("dropped messages not counted against the attacker: %+v", stats)
+	}
+}
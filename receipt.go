@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//ReceiptWidth is the number of characters on a line of a receipt, that of a 58mm receipt printer
+const ReceiptWidth = 32
+
+//ReceiptHashLength is how much of the block hash goes into the file name of a receipt
+const ReceiptHashLength = 12
+
+//ESC/POS commands used to print a receipt
+var (
+	escposInit        = []byte{0x1b, '@'}
+	escposAlignLeft   = []byte{0x1b, 'a', 0}
+	escposAlignCenter = []byte{0x1b, 'a', 1}
+	escposBoldOn      = []byte{0x1b, 'E', 1}
+	escposBoldOff     = []byte{0x1b, 'E', 0}
+	escposFeedAndCut  = []byte{0x1b, 'd', 4, 0x1d, 'V', 66, 0}
+)
+
+//Receipt is the record of a completed transaction that is handed to the card holder
+type Receipt struct {
+	Terminal   string
+	TerminalId string
+	Role       string
+	Timestamp  string
+	CardId     int
+	Amount     float32
+	Balance    float32
+	Index      int
+	Hash       string
+}
+
+//NewReceipt makes the receipt of a transaction made on this terminal, given the balance on the card right after it
+func NewReceipt(block *Block, role string, balance float32) Receipt {
+	return Receipt{
+		Terminal:   block.SenderNick,
+		TerminalId: block.Sender,
+		Role:       role,
+		Timestamp:  block.Timestamp,
+		CardId:     block.CardId,
+		Amount:     block.Amount,
+		Balance:    balance,
+		Index:      block.Index,
+		Hash:       block.Hash,
+	}
+}
+
+//receiptLine puts a label on the left of a line and a value on the right
+func receiptLine(label string, value string) string {
+	pad := ReceiptWidth - len(label) - len(value)
+	if pad < 1 {
+		pad = 1
+	}
+	return label + strings.Repeat(" ", pad) + value
+}
+
+//body is the lines of the receipt below its title
+func (r Receipt) body() []string {
+	when := r.Timestamp
+	if t, err := parseBlockTime(when); err == nil {
+		when = t.Format("2006-01-02 15:04:05")
+	}
+	lines := []string{
+		strings.Repeat("-", ReceiptWidth),
+		receiptLine("Terminal:", r.Terminal),
+		receiptLine("Role:", r.Role),
+		receiptLine("Date:", when),
+		receiptLine("Card:", fmt.Sprint(r.CardId)),
+		receiptLine("Amount:", fmt.Sprintf("%.2f", r.Amount)),
+		receiptLine("Balance:", fmt.Sprintf("%.2f", r.Balance)),
+		receiptLine("Block:", fmt.Sprint(r.Index)),
+		"Hash:",
+	}
+	//the hash is too long for one line
+	for hash := r.Hash; len(hash) > 0; {
+		n := ReceiptWidth
+		if len(hash) < n {
+			n = len(hash)
+		}
+		lines = append(lines, hash[:n])
+		hash = hash[n:]
+	}
+	return append(lines, strings.Repeat("-", ReceiptWidth))
+}
+
+//receiptTitle heads every receipt
+const receiptTitle = "SPIRIT CARD RECEIPT"
+
+//Text is the receipt as plain text, with the title centred
+func (r Receipt) Text() string {
+	var b strings.Builder
+	b.WriteString(strings.Repeat(" ", (ReceiptWidth-len(receiptTitle))/2) + receiptTitle + "\n")
+	for _, line := range r.body() {
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
+
+//ESCPOS is the receipt as ESC/POS commands, to be sent as is to a receipt printer
+func (r Receipt) ESCPOS() []byte {
+	var b bytes.Buffer
+	b.Write(escposInit)
+	b.Write(escposAlignCenter)
+	b.Write(escposBoldOn)
+	b.WriteString(receiptTitle + "\n")
+	b.Write(escposBoldOff)
+	b.Write(escposAlignLeft)
+	for _, line := range r.body() {
+		b.WriteString(line + "\n")
+	}
+	b.Write(escposFeedAndCut)
+	return b.Bytes()
+}
+
+/*WriteReceipt saves a receipt to a folder as <terminal>-<block index>-<short hash>.txt, and as
+.prn with the ESC/POS commands for a printer. A sync can put a different block at the same
+index, so the hash keeps the receipt of one from overwriting that of the other. It returns
+the path of the text file*/
+func WriteReceipt(folder string, r Receipt) (string, error) {
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return "", err
+	}
+	hash := r.Hash
+	if len(hash) > ReceiptHashLength {
+		hash = hash[:ReceiptHashLength]
+	}
+	name := filepath.Join(folder, fmt.Sprintf("%s-%d-%s", r.Terminal, r.Index, hash))
+	err = ioutil.WriteFile(name+".txt", []byte(r.Text()), 0644)
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(name+".prn", r.ESCPOS(), 0644)
+	if err != nil {
+		return "", err
+	}
+	return name + ".txt", nil
+}
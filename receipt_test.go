@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReceipt(t *testing.T) {
+	block := nextBlock(GetGenesisBlock(), 12, -5, "mudit")
+	receipt := NewReceipt(block, "retail", 30)
+
+	text := receipt.Text()
+	for _, expected := range []string{
+		"SPIRIT CARD RECEIPT",
+		"Card:                         12",
+		"Amount:                    -5.00",
+		"Balance:                   30.00",
+		"Block:                         1",
+		block.Hash[:ReceiptWidth] + "\n" + block.Hash[ReceiptWidth:] + "\n",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("receipt does not contain %q:\n%s", expected, text)
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if len(line) > ReceiptWidth {
+			t.Errorf("line %q is wider than %d", line, ReceiptWidth)
+		}
+	}
+
+	escpos := receipt.ESCPOS()
+	if !bytes.HasPrefix(escpos, escposInit) || !bytes.HasSuffix(escpos, escposFeedAndCut) {
+		t.Errorf("ESC/POS receipt does not start with init and end with a cut: %q", escpos)
+	}
+	if !bytes.Contains(escpos, []byte("Balance:                   30.00\n")) {
+		t.Errorf("ESC/POS receipt does not contain the balance: %q", escpos)
+	}
+
+	dir, err := ioutil.TempDir("", "receipts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, err := WriteReceipt(filepath.Join(dir, "Receipts"), receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written, _ := ioutil.ReadFile(path); string(written) != text {
+		t.Errorf("%s holds %q", path, written)
+	}
+	if written, _ := ioutil.ReadFile(strings.TrimSuffix(path, ".txt") + ".prn"); !bytes.Equal(written, escpos) {
+		t.Errorf("ESC/POS file holds %q", written)
+	}
+
+	//after a sync another block of ours can end up at the same index
+	replaced := NewReceipt(nextBlock(GetGenesisBlock(), 12, -7, "mudit"), "retail", 28)
+	other, err := WriteReceipt(filepath.Join(dir, "Receipts"), replaced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == path {
+		t.Errorf("receipts of different blocks at index 1 are both saved as %s", path)
+	}
+	if written, _ := ioutil.ReadFile(path); string(written) != text {
+		t.Errorf("receipt %s was overwritten", path)
+	}
+}
+
+func TestConfirmationText(t *testing.T) {
+	text := confirmationText(pendingTransaction{CardId: 12, Amount: -500}, 520, "retail", "mudit")
+	for _, expected := range []string{"Card: 12", "Amount: -500.00", "Balance after: 20.00", "Terminal: retail (mudit)"} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("confirmation %q does not contain %q", text, expected)
+		}
+	}
+}
+
+func TestDeliverConfirmation(t *testing.T) {
+	cs := newLocalTerminal(t, "retail")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs.ctx = ctx
+	var out bytes.Buffer
+	ui := &TerminalUI{cs: cs, confirmCh: make(chan pendingTransaction, 1), chainViewWriter: &out}
+
+	//an answer given while another is still waiting is not dropped
+	ui.deliverConfirmation(pendingTransaction{CardId: 1, Amount: 5, Confirmed: true})
+	delivered := make(chan struct{})
+	go func() {
+		ui.deliverConfirmation(pendingTransaction{CardId: 2, Amount: 7, Confirmed: true})
+		close(delivered)
+	}()
+	for _, cardId := range []int{1, 2} {
+		select {
+		case tx := <-ui.confirmCh:
+			if tx.CardId != cardId {
+				t.Errorf("got the answer for card %d, expected card %d", tx.CardId, cardId)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("answer for card %d was lost", cardId)
+		}
+	}
+	<-delivered
+
+	//an answer that cannot be handed over before the terminal shuts down is reported
+	ui.deliverConfirmation(pendingTransaction{CardId: 3, Amount: 1})
+	cancel()
+	ui.deliverConfirmation(pendingTransaction{CardId: 4, Amount: 9, Confirmed: true})
+	if !strings.Contains(out.String(), "card 4 not made") {
+		t.Errorf("undelivered transaction not reported, chain view holds %q", out.String())
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+//simSeed replays a simulation, e.g. go test -run TestSimulation -sim.seed=42
+var simSeed = flag.Int64("sim.seed", 0, "seed for the network simulation tests. a fixed default is used if 0")
+
+//simEpoch is the wall clock time at which every simulation starts
+var simEpoch = time.Date(2020, 11, 28, 0, 0, 0, 0, time.UTC)
+
+/*simPartition splits the network into groups of nodes between At and Heal. Nodes in
+different groups cannot reach each other; nodes not listed form a group of their own*/
+type simPartition struct {
+	At     time.Duration
+	Heal   time.Duration
+	Groups [][]int
+}
+
+/*simConfig describes a seeded scenario. Everything that happens in a simulation is drawn
+from the seed, so running the same config twice gives exactly the same chains*/
+type simConfig struct {
+	Seed     int64
+	Nodes    int
+	Cards    int
+	Duration time.Duration
+
+	//mean time between two transactions anywhere on the network
+	TxInterval time.Duration
+	//every message takes between MinDelay and MaxDelay to reach each peer
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	//ReorderRate is the chance that a message is held back by up to ReorderDelay more
+	ReorderRate  float64
+	ReorderDelay time.Duration
+	//DropRate is the chance that any message is lost on the way to a peer
+	DropRate float64
+	//ChainDropRate is the chance that a chain response (type 4) is lost
+	ChainDropRate float64
+
+	Partitions []simPartition
+	//every node syncs with the network this often, as a restarted terminal would. 0 disables it
+	SyncInterval time.Duration
+	//nodes keep syncing for SettleTime after the last transaction
+	SettleTime time.Duration
+	//how long a syncing node waits for index responses
+	SyncWindow time.Duration
+	//how long a syncing node waits for the chain of the peer it syncs with
+	SyncTimeout time.Duration
+}
+
+//simReport is the state of the network at the end of a simulation
+type simReport struct {
+	Heights []int
+	//DivergesAt is the first block index on which two nodes disagree, -1 if all chains agree
+	DivergesAt    int
+	Discrepancies []string
+	Transactions  int
+	Refused       int
+	Delivered     int
+	Dropped       int
+	Partitioned   int
+	Syncs         int
+}
+
+func (r simReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "heights: %v\n", r.Heights)
+	fmt.Fprintf(&b, "diverges at: %d\n", r.DivergesAt)
+	fmt.Fprintf(&b, "transactions: %d (refused %d)\n", r.Transactions, r.Refused)
+	fmt.Fprintf(&b, "messages: delivered %d, dropped %d, partitioned %d\n", r.Delivered, r.Dropped, r.Partitioned)
+	fmt.Fprintf(&b, "syncs: %d\n", r.Syncs)
+	for _, d := range r.Discrepancies {
+		fmt.Fprintf(&b, "discrepancy: %s\n", d)
+	}
+	return b.String()
+}
+
+//simEvent is something that happens at a point in virtual time
+type simEvent struct {
+	at  time.Duration
+	seq int
+	fn  func()
+}
+
+//simQueue orders events by time, then by the order in which they were scheduled
+type simQueue []*simEvent
+
+func (q simQueue) Len() int { return len(q) }
+func (q simQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+func (q simQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *simQueue) Push(x interface{}) { *q = append(*q, x.(*simEvent)) }
+func (q *simQueue) Pop() interface{} {
+	old := *q
+	ev := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return ev
+}
+
+/*simulator runs terminals on a virtual network in a single goroutine. Messages published by
+a node are scheduled for delivery to every other node it can reach, and delivered by calling
+handleMessage directly, so that nothing depends on goroutine scheduling or the wall clock*/
+type simulator struct {
+	cfg    simConfig
+	rng    *rand.Rand
+	now    time.Duration
+	seq    int
+	queue  simQueue
+	nodes  []*simNode
+	report simReport
+}
+
+//simNode is a terminal on the simulated network
+type simNode struct {
+	id int
+	cs *ChainSubscription
+}
+
+//simTopic stands in for the pubsub topic of one node
+type simTopic struct {
+	sim  *simulator
+	node int
+}
+
+func (t *simTopic) Publish(ctx context.Context, data []byte, opts ...pubsub.PubOpt) error {
+	t.sim.broadcast(t.node, data)
+	return nil
+}
+
+func (t *simTopic) ListPeers() []peer.ID {
+	var peers []peer.ID
+	for _, n := range t.sim.nodes {
+		if n.id != t.node && t.sim.reachable(t.node, n.id) {
+			peers = append(peers, n.cs.self)
+		}
+	}
+	return peers
+}
+
+func newSimulator(cfg simConfig) *simulator {
+	sim := &simulator{
+		cfg: cfg,
+		rng: rand.New(rand.NewSource(cfg.Seed)),
+	}
+	clock := func() time.Time { return simEpoch.Add(sim.now) }
+
+	for i := 0; i < cfg.Nodes; i++ {
+		//even nodes are cash terminals, odd nodes are retail terminals
+		typePos := "cash"
+		if i%2 == 1 {
+			typePos = "retail"
+		}
+		ledger := NewLedger("")
+		ledger.clock = clock
+		node := &simNode{id: i}
+		node.cs = &ChainSubscription{
+			Ledger:    ledger,
+			ctx:       context.Background(),
+			topic:     &simTopic{sim: sim, node: i},
+			self:      peer.ID(fmt.Sprintf("sim-node-%d", i)),
+			typePos:   typePos,
+			topicName: "spiritchain-sim",
+			nickName:  fmt.Sprintf("node%d", i),
+		}
+		sim.nodes = append(sim.nodes, node)
+	}
+	return sim
+}
+
+//schedule runs fn after delay in virtual time
+func (sim *simulator) schedule(delay time.Duration, fn func()) {
+	sim.seq++
+	heap.Push(&sim.queue, &simEvent{at: sim.now + delay, seq: sim.seq, fn: fn})
+}
+
+//between draws a duration in [min, max]
+func (sim *simulator) between(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(sim.rng.Int63n(int64(max-min)+1))
+}
+
+//group returns the partition group of a node at the current time
+func (sim *simulator) group(node int) int {
+	for _, p := range sim.cfg.Partitions {
+		if sim.now < p.At || sim.now >= p.Heal {
+			continue
+		}
+		for g, members := range p.Groups {
+			for _, m := range members {
+				if m == node {
+					return g
+				}
+			}
+		}
+		return len(p.Groups)
+	}
+	return 0
+}
+
+func (sim *simulator) reachable(from int, to int) bool {
+	return sim.group(from) == sim.group(to)
+}
+
+//broadcast schedules the delivery of a message from a node to every other node
+func (sim *simulator) broadcast(from int, data []byte) {
+	isChain := false
+	var msg SpecialMessage
+	if json.Unmarshal(data, &msg) == nil && msg.Type == 4 {
+		isChain = true
+	}
+
+	for _, n := range sim.nodes {
+		if n.id == from {
+			continue
+		}
+		if !sim.reachable(from, n.id) {
+			sim.report.Partitioned++
+			continue
+		}
+		if sim.rng.Float64() < sim.cfg.DropRate || (isChain && sim.rng.Float64() < sim.cfg.ChainDropRate) {
+			sim.report.Dropped++
+			continue
+		}
+		delay := sim.between(sim.cfg.MinDelay, sim.cfg.MaxDelay)
+		if sim.rng.Float64() < sim.cfg.ReorderRate {
+			delay += sim.between(0, sim.cfg.ReorderDelay)
+		}
+		to := n
+		sim.schedule(delay, func() {
+			//a partition can start while the message is on its way
+			if !sim.reachable(from, to.id) {
+				sim.report.Partitioned++
+				return
+			}
+			sim.report.Delivered++
+			sim.deliver(to, data)
+		})
+	}
+}
+
+//deliver hands a message to a node the way readBlocks does, which passes the replies to a sync on to Resync
+func (sim *simulator) deliver(node *simNode, data []byte) {
+	node.cs.handleMessage(data)
+}
+
+/*startSync makes a node run Resync, with its waits in virtual time: index replies are
+collected for SyncWindow, then the chain of the peer picked is waited for up to SyncTimeout.
+A node that is still syncing does not start another sync*/
+func (sim *simulator) startSync(node *simNode) {
+	tip, err := node.cs.startResync()
+	if err != nil {
+		return
+	}
+	sim.report.Syncs++
+
+	sim.schedule(sim.cfg.SyncWindow, func() {
+		done, _ := node.cs.requestResyncChain(&tip, nil)
+		if done == nil {
+			return
+		}
+		sim.schedule(sim.cfg.SyncTimeout, func() {
+			var err error
+			select {
+			case err = <-done:
+			default:
+				err = ErrSyncTimeout
+			}
+			node.cs.finishResync(done, err)
+		})
+	})
+}
+
+//transact makes a random transaction on a random node
+func (sim *simulator) transact() {
+	node := sim.nodes[sim.rng.Intn(len(sim.nodes))]
+	cardId := 1 + sim.rng.Intn(sim.cfg.Cards)
+	amount := float32(1 + sim.rng.Intn(100))
+	if node.cs.typePos == "retail" {
+		amount = -float32(1 + sim.rng.Intn(50))
+	}
+	sim.report.Transactions++
+	_, err := node.cs.SubmitTransaction(cardId, amount)
+	if err != nil {
+		sim.report.Refused++
+	}
+}
+
+//run plays the scenario until Duration and then lets the messages in flight settle
+func (sim *simulator) run() simReport {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var nextTx func()
+	nextTx = func() {
+		if sim.now >= sim.cfg.Duration {
+			return
+		}
+		sim.transact()
+		sim.schedule(sim.between(sim.cfg.TxInterval/2, sim.cfg.TxInterval*3/2), nextTx)
+	}
+	sim.schedule(sim.between(0, sim.cfg.TxInterval), nextTx)
+
+	if sim.cfg.SyncInterval > 0 {
+		for _, n := range sim.nodes {
+			node := n
+			var nextSync func()
+			nextSync = func() {
+				if sim.now >= sim.cfg.Duration+sim.cfg.SettleTime {
+					return
+				}
+				sim.startSync(node)
+				sim.schedule(sim.cfg.SyncInterval, nextSync)
+			}
+			sim.schedule(sim.between(sim.cfg.SyncInterval/2, sim.cfg.SyncInterval), nextSync)
+		}
+	}
+
+	for sim.queue.Len() > 0 {
+		ev := heap.Pop(&sim.queue).(*simEvent)
+		sim.now = ev.at
+		ev.fn()
+	}
+	return sim.finalReport()
+}
+
+//finalReport compares the chains and card balances of all nodes
+func (sim *simulator) finalReport() simReport {
+	r := sim.report
+	r.DivergesAt = -1
+
+	snaps := make([]LedgerSnapshot, len(sim.nodes))
+	for i, n := range sim.nodes {
+		snaps[i] = snapshotLedger(n.cs.Ledger)
+		r.Heights = append(r.Heights, snaps[i].Chain[len(snaps[i].Chain)-1].Index)
+	}
+
+	for i := 1; i < len(snaps); i++ {
+		for idx := 1; idx < len(snaps[0].Chain) || idx < len(snaps[i].Chain); idx++ {
+			if idx >= len(snaps[0].Chain) || idx >= len(snaps[i].Chain) || snaps[0].Chain[idx].Hash != snaps[i].Chain[idx].Hash {
+				if r.DivergesAt == -1 || idx < r.DivergesAt {
+					r.DivergesAt = idx
+				}
+				break
+			}
+		}
+	}
+
+	cards := make(map[int]bool)
+	for _, snap := range snaps {
+		for cardId := range snap.Balances {
+			cards[cardId] = true
+		}
+	}
+	var cardIds []int
+	for cardId := range cards {
+		cardIds = append(cardIds, cardId)
+	}
+	sort.Ints(cardIds)
+	for _, cardId := range cardIds {
+		balances := make([]string, len(snaps))
+		differ := false
+		for i, snap := range snaps {
+			balances[i] = fmt.Sprintf("%.2f", snap.Balances[cardId])
+			if snap.Balances[cardId] != snaps[0].Balances[cardId] {
+				differ = true
+			}
+		}
+		if differ {
+			r.Discrepancies = append(r.Discrepancies, fmt.Sprintf("card %d: %s", cardId, strings.Join(balances, " / ")))
+		}
+	}
+	return r
+}
+
+//chainHashes lists the latest block hash of every node
+func (sim *simulator) chainHashes() []string {
+	hashes := make([]string, len(sim.nodes))
+	for i, n := range sim.nodes {
+		hashes[i] = n.cs.Ledger.Latest().Hash
+	}
+	return hashes
+}
+
+//baseSimConfig is a small network with a realistic LAN
+func baseSimConfig(seed int64) simConfig {
+	if *simSeed != 0 {
+		seed = *simSeed
+	}
+	return simConfig{
+		Seed:         seed,
+		Nodes:        4,
+		Cards:        5,
+		Duration:     5 * time.Minute,
+		TxInterval:   5 * time.Second,
+		MinDelay:     5 * time.Millisecond,
+		MaxDelay:     50 * time.Millisecond,
+		SyncInterval: 30 * time.Second,
+		SettleTime:   2 * time.Minute,
+		SyncWindow:   time.Second,
+		SyncTimeout:  10 * time.Second,
+	}
+}
+
+func TestSimulationIsDeterministic(t *testing.T) {
+	cfg := baseSimConfig(7)
+	cfg.TxInterval = 200 * time.Millisecond
+	cfg.ReorderRate = 0.2
+	cfg.ReorderDelay = time.Second
+	cfg.DropRate = 0.05
+	cfg.ChainDropRate = 0.3
+	cfg.Partitions = []simPartition{{At: time.Minute, Heal: 2 * time.Minute, Groups: [][]int{{0, 1}, {2, 3}}}}
+
+	first := newSimulator(cfg)
+	firstReport := first.run()
+	second := newSimulator(cfg)
+	secondReport := second.run()
+
+	if firstReport.String() != secondReport.String() {
+		t.Fatalf("seed %d gave different reports:\n%s\n%s", cfg.Seed, firstReport, secondReport)
+	}
+	firstHashes, secondHashes := first.chainHashes(), second.chainHashes()
+	for i := range firstHashes {
+		if firstHashes[i] != secondHashes[i] {
+			t.Errorf("seed %d: node %d ended on %s and then on %s", cfg.Seed, i, firstHashes[i], secondHashes[i])
+		}
+	}
+}
+
+func TestSimulationConvergesOnReliableNetwork(t *testing.T) {
+	cfg := baseSimConfig(11)
+	report := newSimulator(cfg).run()
+
+	if report.DivergesAt != -1 || len(report.Discrepancies) > 0 {
+		t.Errorf("seed %d: nodes diverged on a reliable network\n%s", cfg.Seed, report)
+	}
+	if report.Transactions == report.Refused {
+		t.Errorf("seed %d: no transaction made it into the chain\n%s", cfg.Seed, report)
+	}
+}
+
+func TestSimulationReportsPartition(t *testing.T) {
+	cfg := baseSimConfig(23)
+	//the network stays split until the end, and nodes never sync across the split
+	cfg.Partitions = []simPartition{{At: 0, Heal: time.Hour, Groups: [][]int{{0, 1}, {2, 3}}}}
+	cfg.SyncInterval = 0
+	report := newSimulator(cfg).run()
+
+	if report.DivergesAt == -1 {
+		t.Errorf("seed %d: expected the two halves of the network to diverge\n%s", cfg.Seed, report)
+	}
+	if report.Partitioned == 0 {
+		t.Errorf("seed %d: expected messages to be stopped by the partition\n%s", cfg.Seed, report)
+	}
+	t.Logf("seed %d:\n%s", cfg.Seed, report)
+}
+
+//TestSimulationSyncRecoversDroppedBlocks checks that periodic syncs repair lost blocks and settle the forks they cause
+func TestSimulationSyncRecoversDroppedBlocks(t *testing.T) {
+	cfg := baseSimConfig(31)
+	cfg.DropRate = 0.2
+	//a few quiet minutes at the end give every node a chance to sync up
+	cfg.SyncInterval = 20 * time.Second
+	cfg.SettleTime = 5 * time.Minute
+	report := newSimulator(cfg).run()
+
+	t.Logf("seed %d:\n%s", cfg.Seed, report)
+	if report.Dropped == 0 {
+		t.Errorf("seed %d: expected messages to be dropped\n%s", cfg.Seed, report)
+	}
+	if report.DivergesAt != -1 || len(report.Discrepancies) > 0 {
+		t.Errorf("seed %d: nodes did not recover the dropped blocks by syncing\n%s", cfg.Seed, report)
+	}
+}
+
+func TestSimulationHealsPartition(t *testing.T) {
+	cfg := baseSimConfig(41)
+	//both halves keep making transactions while they are split, then have to settle on one chain
+	cfg.Partitions = []simPartition{{At: time.Minute, Heal: 3 * time.Minute, Groups: [][]int{{0, 1}, {2, 3}}}}
+	cfg.ReorderRate = 0.1
+	cfg.ReorderDelay = time.Second
+	cfg.DropRate = 0.05
+	cfg.SyncInterval = 20 * time.Second
+	cfg.SettleTime = 5 * time.Minute
+	report := newSimulator(cfg).run()
+
+	t.Logf("seed %d:\n%s", cfg.Seed, report)
+	if report.Partitioned == 0 {
+		t.Errorf("seed %d: expected messages to be stopped by the partition\n%s", cfg.Seed, report)
+	}
+	if report.DivergesAt != -1 || len(report.Discrepancies) > 0 {
+		t.Errorf("seed %d: the two halves did not settle on one chain after the partition healed\n%s", cfg.Seed, report)
+	}
+}
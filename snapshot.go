@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+//errors returned when a snapshot cannot be used to bootstrap a terminal
+var (
+	ErrSnapshotSignature = errors.New("snapshot signature is not valid")
+	ErrSnapshotSigner    = errors.New("snapshot is not signed by the expected terminal")
+	ErrSnapshotContents  = errors.New("snapshot chain does not match its height or balances")
+)
+
+/*ChainSnapshot is a chain up to height H and the card balances at H, signed by the terminal
+that produced it. A new terminal can start from a snapshot and only sync the blocks after H*/
+type ChainSnapshot struct {
+	Height   int
+	Chain    []Block
+	Balances map[int]float32
+	//Signer is the peer id of the signing key, PublicKey the marshalled key itself
+	Signer    string
+	PublicKey []byte
+	Signature []byte
+}
+
+//signedContent is the part of a snapshot covered by the signature
+func (snap *ChainSnapshot) signedContent() ([]byte, error) {
+	//json sorts map keys, so the same snapshot always gives the same bytes
+	return json.Marshal(struct {
+		Height   int
+		Chain    []Block
+		Balances map[int]float32
+	}{snap.Height, snap.Chain, snap.Balances})
+}
+
+/*NewChainSnapshot checks a chain from genesis and builds a snapshot of it up to height,
+signed with key. A height of -1 takes the whole chain*/
+func NewChainSnapshot(chain []Block, height int, key crypto.PrivKey) (*ChainSnapshot, error) {
+	if height < 0 {
+		height = len(chain) - 1
+	}
+	if height >= len(chain) {
+		return nil, fmt.Errorf("chain only goes up to block %d", len(chain)-1)
+	}
+
+	report := VerifyChain(chain[:height+1])
+	if report.Problem != nil {
+		return nil, fmt.Errorf("block %d: %s", report.Problem.Block.Index, report.Problem.Detail)
+	}
+
+	signer, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := crypto.MarshalPublicKey(key.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	snap := &ChainSnapshot{
+		Height:    height,
+		Chain:     chain[:height+1],
+		Balances:  report.Balances,
+		Signer:    signer.Pretty(),
+		PublicKey: pub,
+	}
+	content, err := snap.signedContent()
+	if err != nil {
+		return nil, err
+	}
+	snap.Signature, err = key.Sign(content)
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+/*Verify checks that a snapshot is signed by the peer id signer, and that its chain is
+consistent and ends at its height with its balances. Anyone can sign a snapshot, so without
+a signer the signature would prove nothing and the snapshot is refused*/
+func (snap *ChainSnapshot) Verify(signer string) error {
+	pub, err := crypto.UnmarshalPublicKey(snap.PublicKey)
+	if err != nil {
+		return ErrSnapshotSignature
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil || id.Pretty() != snap.Signer {
+		return ErrSnapshotSignature
+	}
+	if len(signer) == 0 || signer != snap.Signer {
+		return ErrSnapshotSigner
+	}
+	content, err := snap.signedContent()
+	if err != nil {
+		return err
+	}
+	ok, err := pub.Verify(content, snap.Signature)
+	if err != nil || !ok {
+		return ErrSnapshotSignature
+	}
+
+	if len(snap.Chain) != snap.Height+1 || snap.Chain[snap.Height].Index != snap.Height {
+		return ErrSnapshotContents
+	}
+	report := VerifyChain(snap.Chain)
+	if report.Problem != nil {
+		return fmt.Errorf("block %d: %s", report.Problem.Block.Index, report.Problem.Detail)
+	}
+	if len(report.Balances) != len(snap.Balances) {
+		return ErrSnapshotContents
+	}
+	for cardId, balance := range report.Balances {
+		if snap.Balances[cardId] != balance {
+			return ErrSnapshotContents
+		}
+	}
+	return nil
+}
+
+//Tip returns the last block of the snapshot, the block at its height
+func (snap *ChainSnapshot) Tip() Block {
+	return snap.Chain[len(snap.Chain)-1]
+}
+
+//ReadSnapshotFile loads a snapshot written by the snapshot subcommand. It does not verify it
+func ReadSnapshotFile(path string) (*ChainSnapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snap := new(ChainSnapshot)
+	err = json.Unmarshal(data, snap)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if len(snap.Chain) == 0 {
+		return nil, fmt.Errorf("%s: no blocks found", path)
+	}
+	return snap, nil
+}
+
+/*seedFromSnapshot imports snap into a ledger that is still at genesis or behind the snapshot.
+A ledger resumed from its chain file past the snapshot height keeps its chain, so a restart
+does not roll the terminal back to the snapshot. It reports whether the snapshot was imported*/
+func seedFromSnapshot(ledger *Ledger, snap *ChainSnapshot) (bool, error) {
+	tip := ledger.Latest()
+	if tip.Index > 0 && tip.Index >= snap.Height {
+		return false, nil
+	}
+	err := ledger.Import(snap)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//runSnapshot implements the snapshot subcommand and returns the exit code
+func runSnapshot(args []string) int {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	keyFlag := fs.String("key", "", "file holding the key to sign the snapshot with. created if it does not exist. snapshot.key in the keys folder of the config if left empty")
+	configFlag := fs.String("config", "", "config file to read the keys folder from. SPIRIT_CONFIG if left empty")
+	heightFlag := fs.Int("height", -1, "height to take the snapshot at. the whole chain if left at -1")
+	outFlag := fs.String("o", "", "file to write the snapshot to. standard output if left empty")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s snapshot [FLAGS] CHAIN_FILE\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Writes a signed snapshot of a persisted ledger for bootstrapping new terminals with -snapshot.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	chain, err := ReadChainFile(fs.Arg(0))
+	if err != nil {
+		printErr("%s\n", err)
+		return 2
+	}
+	keyFile := *keyFlag
+	if len(keyFile) == 0 {
+		dirs, err := configDirs(*configFlag, os.LookupEnv)
+		if err != nil {
+			printErr("%s\n", err)
+			return 2
+		}
+		keyFile = filepath.Join(dirs.Keys, "snapshot.key")
+	}
+	key, err := loadOrCreateKey(keyFile)
+	if err != nil {
+		printErr("%s\n", err)
+		return 2
+	}
+	snap, err := NewChainSnapshot(chain, *heightFlag, key)
+	if err != nil {
+		printErr("%s\n", err)
+		return 1
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		printErr("%s\n", err)
+		return 1
+	}
+
+	out := io.Writer(os.Stdout)
+	if len(*outFlag) > 0 {
+		file, err := os.Create(*outFlag)
+		if err != nil {
+			printErr("%s\n", err)
+			return 2
+		}
+		defer file.Close()
+		out = file
+	}
+	_, err = out.Write(append(data, '\n'))
+	if err != nil {
+		printErr("%s\n", err)
+		return 1
+	}
+	printErr("snapshot at block %d signed by %s\n", snap.Height, snap.Signer)
+	return 0
+}
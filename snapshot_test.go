@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+)
+
+//testSnapshot signs a snapshot of chain at height with a new key
+func testSnapshot(t *testing.T, chain []Block, height int) *ChainSnapshot {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := NewChainSnapshot(chain, height, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snap
+}
+
+func TestChainSnapshotVerify(t *testing.T) {
+	snap := testSnapshot(t, testChain(), 3)
+	if snap.Height != 3 || len(snap.Chain) != 4 || snap.Balances[1] != 64.5 {
+		t.Fatalf("unexpected snapshot at %d with %d blocks and balances %v", snap.Height, len(snap.Chain), snap.Balances)
+	}
+	if err := snap.Verify(""); err != ErrSnapshotSigner {
+		t.Errorf("snapshot accepted without a signer to check it against: %v", err)
+	}
+	if err := snap.Verify(snap.Signer); err != nil {
+		t.Fatalf("valid snapshot rejected for its own signer: %s", err)
+	}
+	if err := snap.Verify(testSnapshot(t, testChain(), -1).Signer); err != ErrSnapshotSigner {
+		t.Errorf("expected %s, got %v", ErrSnapshotSigner, err)
+	}
+
+	snap.Balances[2] = 1000
+	if err := snap.Verify(snap.Signer); err != ErrSnapshotSignature {
+		t.Errorf("expected %s for changed balances, got %v", ErrSnapshotSignature, err)
+	}
+	snap.Balances[2] = 20
+
+	other := testSnapshot(t, testChain(), 3)
+	snap.Signature = other.Signature
+	if err := snap.Verify(snap.Signer); err != ErrSnapshotSignature {
+		t.Errorf("expected %s for a signature by another key, got %v", ErrSnapshotSignature, err)
+	}
+}
+
+func TestBootstrapFromSnapshot(t *testing.T) {
+	tn := newTestNetwork(t)
+	cash := tn.addNode("cash", "cash")
+	retail := tn.addNode("retail", "retail")
+	tn.transact(cash, 4, 50)
+	tn.transact(retail, 4, -10)
+
+	snap := testSnapshot(t, snapshotLedger(cash.cs.Ledger).Chain, -1)
+	tn.transact(cash, 5, 30)
+	tn.transact(retail, 4, -5)
+
+	ledger := NewLedger("")
+	if err := ledger.Import(snap); err != nil {
+		t.Fatal(err)
+	}
+	seeded := tn.addNodeWithLedger("seeded", "retail", ledger)
+	if ledger.UnconfirmedImport() != nil {
+		t.Error("snapshot tip was not confirmed by the network")
+	}
+	tn.waitForConvergence(5 * time.Second)
+	if balance := seeded.cs.Ledger.Balance(4); balance != 35 {
+		t.Errorf("seeded node has balance %f on card 4, expected 35", balance)
+	}
+
+	//a snapshot the network does not agree with is dropped for the network's chain
+	forked := append([]Block{}, snap.Chain...)
+	forked = append(forked, *nextBlock(forked[len(forked)-1], 6, 99, "fork"))
+	fork := testSnapshot(t, forked, -1)
+	ledger = NewLedger("")
+	if err := ledger.Import(fork); err != nil {
+		t.Fatal(err)
+	}
+	tn.addNodeWithLedger("forked", "retail", ledger)
+	tn.waitForConvergence(5 * time.Second)
+	tn.assertBalance(6, 0)
+}
+
+func TestSnapshotOnRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "restart.txt")
+	snap := testSnapshot(t, testChain(), 3)
+
+	//the first start imports the snapshot into a ledger at genesis
+	ledger := NewLedger(path)
+	if imported, err := seedFromSnapshot(ledger, snap); err != nil || !imported {
+		t.Fatalf("snapshot not imported at genesis: %v, %v", imported, err)
+	}
+	ledger.ConfirmImport()
+	for i := 0; i < 3; i++ {
+		if err := ledger.Append(nextBlock(ledger.Latest(), 2, 1, "test")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tip := ledger.Latest()
+	ledger.Close()
+
+	//a restart with the same snapshot resumes the chain file
+	ledger, err = OpenLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.Close()
+	if imported, err := seedFromSnapshot(ledger, snap); err != nil || imported {
+		t.Fatalf("snapshot imported over a resumed chain: %v, %v", imported, err)
+	}
+	if ledger.Latest() != tip || ledger.UnconfirmedImport() != nil {
+		t.Errorf("resumed ledger at block %d, expected %d", ledger.Latest().Index, tip.Index)
+	}
+
+	//a chain file behind the snapshot is still seeded from it
+	behind := NewLedger("")
+	if err := behind.Replace(testChain()[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if imported, err := seedFromSnapshot(behind, snap); err != nil || !imported || behind.Latest().Index != 3 {
+		t.Errorf("ledger behind the snapshot not seeded: %v, %v", imported, err)
+	}
+}
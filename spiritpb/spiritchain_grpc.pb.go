@@ -0,0 +1,319 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package spiritpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion7
+
+// SpiritChainClient is the client API for SpiritChain service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type SpiritChainClient interface {
+	// SubmitTransaction makes a transaction on the terminal, with the same checks as the UI.
+	SubmitTransaction(ctx context.Context, in *SubmitTransactionRequest, opts ...grpc.CallOption) (*TransactionStatus, error)
+	// GetBalance returns the current balance on a card.
+	GetBalance(ctx context.Context, in *GetBalanceRequest, opts ...grpc.CallOption) (*Balance, error)
+	// GetBlock looks up a block of the local chain by index or by hash.
+	GetBlock(ctx context.Context, in *GetBlockRequest, opts ...grpc.CallOption) (*Block, error)
+	// WatchBlocks streams every block appended to the local chain after the call is made, or from
+	// from_index on. When a sync replaces the chain, the blocks of the new chain from where it differs are sent again.
+	WatchBlocks(ctx context.Context, in *WatchBlocksRequest, opts ...grpc.CallOption) (SpiritChain_WatchBlocksClient, error)
+	// ListPeers returns the peer directory of the terminal, built from the signed presence records of its peers.
+	ListPeers(ctx context.Context, in *ListPeersRequest, opts ...grpc.CallOption) (*PeerList, error)
+	// ListPeerHealth returns the liveness of the peers, including those that have disconnected recently.
+	ListPeerHealth(ctx context.Context, in *ListPeersRequest, opts ...grpc.CallOption) (*PeerList, error)
+}
+
+type spiritChainClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSpiritChainClient(cc grpc.ClientConnInterface) SpiritChainClient {
+	return &spiritChainClient{cc}
+}
+
+func (c *spiritChainClient) SubmitTransaction(ctx context.Context, in *SubmitTransactionRequest, opts ...grpc.CallOption) (*TransactionStatus, error) {
+	out := new(TransactionStatus)
+	err := c.cc.Invoke(ctx, "/spiritchain.SpiritChain/SubmitTransaction", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *spiritChainClient) GetBalance(ctx context.Context, in *GetBalanceRequest, opts ...grpc.CallOption) (*Balance, error) {
+	out := new(Balance)
+	err := c.cc.Invoke(ctx, "/spiritchain.SpiritChain/GetBalance", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *spiritChainClient) GetBlock(ctx context.Context, in *GetBlockRequest, opts ...grpc.CallOption) (*Block, error) {
+	out := new(Block)
+	err := c.cc.Invoke(ctx, "/spiritchain.SpiritChain/GetBlock", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *spiritChainClient) WatchBlocks(ctx context.Context, in *WatchBlocksRequest, opts ...grpc.CallOption) (SpiritChain_WatchBlocksClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_SpiritChain_serviceDesc.Streams[0], "/spiritchain.SpiritChain/WatchBlocks", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &spiritChainWatchBlocksClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type SpiritChain_WatchBlocksClient interface {
+	Recv() (*Block, error)
+	grpc.ClientStream
+}
+
+type spiritChainWatchBlocksClient struct {
+	grpc.ClientStream
+}
+
+func (x *spiritChainWatchBlocksClient) Recv() (*Block, error) {
+	m := new(Block)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *spiritChainClient) ListPeers(ctx context.Context, in *ListPeersRequest, opts ...grpc.CallOption) (*PeerList, error) {
+	out := new(PeerList)
+	err := c.cc.Invoke(ctx, "/spiritchain.SpiritChain/ListPeers", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *spiritChainClient) ListPeerHealth(ctx context.Context, in *ListPeersRequest, opts ...grpc.CallOption) (*PeerList, error) {
+	out := new(PeerList)
+	err := c.cc.Invoke(ctx, "/spiritchain.SpiritChain/ListPeerHealth", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SpiritChainServer is the server API for SpiritChain service.
+// All implementations must embed UnimplementedSpiritChainServer
+// for forward compatibility
+type SpiritChainServer interface {
+	// SubmitTransaction makes a transaction on the terminal, with the same checks as the UI.
+	SubmitTransaction(context.Context, *SubmitTransactionRequest) (*TransactionStatus, error)
+	// GetBalance returns the current balance on a card.
+	GetBalance(context.Context, *GetBalanceRequest) (*Balance, error)
+	// GetBlock looks up a block of the local chain by index or by hash.
+	GetBlock(context.Context, *GetBlockRequest) (*Block, error)
+	// WatchBlocks streams every block appended to the local chain after the call is made, or from
+	// from_index on. When a sync replaces the chain, the blocks of the new chain from where it differs are sent again.
+	WatchBlocks(*WatchBlocksRequest, SpiritChain_WatchBlocksServer) error
+	// ListPeers returns the peer directory of the terminal, built from the signed presence records of its peers.
+	ListPeers(context.Context, *ListPeersRequest) (*PeerList, error)
+	// ListPeerHealth returns the liveness of the peers, including those that have disconnected recently.
+	ListPeerHealth(context.Context, *ListPeersRequest) (*PeerList, error)
+	mustEmbedUnimplementedSpiritChainServer()
+}
+
+// UnimplementedSpiritChainServer must be embedded to have forward compatible implementations.
+type UnimplementedSpiritChainServer struct {
+}
+
+func (UnimplementedSpiritChainServer) SubmitTransaction(context.Context, *SubmitTransactionRequest) (*TransactionStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitTransaction not implemented")
+}
+func (UnimplementedSpiritChainServer) GetBalance(context.Context, *GetBalanceRequest) (*Balance, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBalance not implemented")
+}
+func (UnimplementedSpiritChainServer) GetBlock(context.Context, *GetBlockRequest) (*Block, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlock not implemented")
+}
+func (UnimplementedSpiritChainServer) WatchBlocks(*WatchBlocksRequest, SpiritChain_WatchBlocksServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchBlocks not implemented")
+}
+func (UnimplementedSpiritChainServer) ListPeers(context.Context, *ListPeersRequest) (*PeerList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPeers not implemented")
+}
+func (UnimplementedSpiritChainServer) ListPeerHealth(context.Context, *ListPeersRequest) (*PeerList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPeerHealth not implemented")
+}
+func (UnimplementedSpiritChainServer) mustEmbedUnimplementedSpiritChainServer() {}
+
+// UnsafeSpiritChainServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SpiritChainServer will
+// result in compilation errors.
+type UnsafeSpiritChainServer interface {
+	mustEmbedUnimplementedSpiritChainServer()
+}
+
+func RegisterSpiritChainServer(s grpc.ServiceRegistrar, srv SpiritChainServer) {
+	s.RegisterService(&_SpiritChain_serviceDesc, srv)
+}
+
+func _SpiritChain_SubmitTransaction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SubmitTransactionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SpiritChainServer).SubmitTransaction(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/spiritchain.SpiritChain/SubmitTransaction",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SpiritChainServer).SubmitTransaction(ctx, req.(*SubmitTransactionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SpiritChain_GetBalance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBalanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SpiritChainServer).GetBalance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/spiritchain.SpiritChain/GetBalance",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SpiritChainServer).GetBalance(ctx, req.(*GetBalanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SpiritChain_GetBlock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBlockRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SpiritChainServer).GetBlock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/spiritchain.SpiritChain/GetBlock",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SpiritChainServer).GetBlock(ctx, req.(*GetBlockRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SpiritChain_WatchBlocks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchBlocksRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SpiritChainServer).WatchBlocks(m, &spiritChainWatchBlocksServer{stream})
+}
+
+type SpiritChain_WatchBlocksServer interface {
+	Send(*Block) error
+	grpc.ServerStream
+}
+
+type spiritChainWatchBlocksServer struct {
+	grpc.ServerStream
+}
+
+func (x *spiritChainWatchBlocksServer) Send(m *Block) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _SpiritChain_ListPeers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPeersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SpiritChainServer).ListPeers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/spiritchain.SpiritChain/ListPeers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SpiritChainServer).ListPeers(ctx, req.(*ListPeersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SpiritChain_ListPeerHealth_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPeersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SpiritChainServer).ListPeerHealth(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/spiritchain.SpiritChain/ListPeerHealth",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SpiritChainServer).ListPeerHealth(ctx, req.(*ListPeersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _SpiritChain_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "spiritchain.SpiritChain",
+	HandlerType: (*SpiritChainServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SubmitTransaction",
+			Handler:    _SpiritChain_SubmitTransaction_Handler,
+		},
+		{
+			MethodName: "GetBalance",
+			Handler:    _SpiritChain_GetBalance_Handler,
+		},
+		{
+			MethodName: "GetBlock",
+			Handler:    _SpiritChain_GetBlock_Handler,
+		},
+		{
+			MethodName: "ListPeers",
+			Handler:    _SpiritChain_ListPeers_Handler,
+		},
+		{
+			MethodName: "ListPeerHealth",
+			Handler:    _SpiritChain_ListPeerHealth_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchBlocks",
+			Handler:       _SpiritChain_WatchBlocks_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "spiritchain.proto",
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//RecentBlockCache is how many of the latest blocks a file store keeps in memory
+const RecentBlockCache = 256
+
+//ErrStoreKind is returned by Swap for a store that was not made by Stage of the same kind of store
+var ErrStoreKind = errors.New("staged store is of another kind")
+
+/*BlockStore holds the blocks of a chain from its base, which is genesis or the checkpoint
+block of a pruned chain, up to its tip. Block indices are consecutive. Stores are not safe
+for concurrent use, the Ledger serialises access to its store*/
+type BlockStore interface {
+	//Append adds a block after the tip
+	Append(block Block) error
+	//Block returns the block at an index, and false if the store does not hold it
+	Block(index int) (Block, bool, error)
+	//Find returns the block with a hash, and false if the store does not hold it
+	Find(hash string) (Block, bool, error)
+	//Base returns the index of the first block held
+	Base() int
+	//Tip returns the index of the last block held
+	Tip() int
+	//Reset replaces the contents of the store with a run of consecutive blocks
+	Reset(blocks []Block) error
+	//Stage makes an empty store of the same kind to build a new chain in, away from this one
+	Stage() (BlockStore, error)
+	//Swap replaces the contents of the store with those of a store made by Stage, in one step
+	Swap(staged BlockStore) error
+	Close() error
+}
+
+//memStore keeps every block in memory. It is used by ledgers that are not persisted
+type memStore struct {
+	blocks []Block
+}
+
+func newMemStore() *memStore {
+	return &memStore{}
+}
+
+func (s *memStore) Append(block Block) error {
+	s.blocks = append(s.blocks, block)
+	return nil
+}
+
+func (s *memStore) Block(index int) (Block, bool, error) {
+	pos := index - s.Base()
+	if pos < 0 || pos >= len(s.blocks) {
+		return Block{}, false, nil
+	}
+	return s.blocks[pos], true, nil
+}
+
+func (s *memStore) Find(hash string) (Block, bool, error) {
+	for i := len(s.blocks) - 1; i >= 0; i-- {
+		if s.blocks[i].Hash == hash {
+			return s.blocks[i], true, nil
+		}
+	}
+	return Block{}, false, nil
+}
+
+func (s *memStore) Base() int {
+	if len(s.blocks) == 0 {
+		return 0
+	}
+	return s.blocks[0].Index
+}
+
+func (s *memStore) Tip() int {
+	return s.Base() + len(s.blocks) - 1
+}
+
+func (s *memStore) Reset(blocks []Block) error {
+	s.blocks = append(make([]Block, 0, len(blocks)), blocks...)
+	return nil
+}
+
+func (s *memStore) Stage() (BlockStore, error) {
+	return newMemStore(), nil
+}
+
+func (s *memStore) Swap(staged BlockStore) error {
+	next, ok := staged.(*memStore)
+	if !ok {
+		return ErrStoreKind
+	}
+	s.blocks = next.blocks
+	return nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+/*fileStore keeps the chain in a chain file, one line of JSON per block, which ReadChainFile
+reads too. Blocks are appended to the file as they come. Only the latest blocks and the file offset of every FileIndexStride-th
+block are kept in memory, so a long chain costs little memory; other blocks are read on from
+the nearest offset, and blocks looked up by hash are searched for in the file*/
+type fileStore struct {
+	file *os.File
+	path string
+	//offsets holds the offset of the blocks at positions 0, FileIndexStride, 2*FileIndexStride...
+	offsets []int64
+	count   int
+	end     int64
+	base    int
+	recent  []Block
+	cache   int
+	//cursor is where the block after the last one read from the file starts, so reading on is cheap
+	cursorPos int
+	cursorOff int64
+	//staged is set on a store made by Stage, whose file is removed if it is closed before it is swapped in
+	staged bool
+}
+
+//FileIndexStride is how many blocks apart a file store keeps the offsets of blocks
+const FileIndexStride = 64
+
+/*newFileStore opens the chain file at path, creating it if it does not exist, and loads the
+blocks it already holds. A last line left incomplete by a crash while it was written is cut
+off; any other line that cannot be read is an error, so that a chain file is never cut short
+because of a block in the middle of it*/
+func newFileStore(path string, cache int) (*fileStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileStore{
+		file:      file,
+		path:      path,
+		cache:     cache,
+		cursorPos: -1,
+	}
+	err = s.load()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+//load reads the blocks of an existing chain file
+func (s *fileStore) load() error {
+	r := bufio.NewReader(s.file)
+	var off int64
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(strings.TrimSpace(line)) == 0 {
+			off += int64(len(line))
+			s.end = off
+			continue
+		}
+		//every line is ended by a newline once it has been written in full
+		if err == io.EOF {
+			log.Printf("%s: dropping the half written block at offset %d", s.path, off)
+			break
+		}
+		block, perr := parseBlock(strings.TrimSpace(line))
+		if perr == nil && s.count > 0 && block.Index != s.base+s.count {
+			perr = fmt.Errorf("block %d does not follow block %d", block.Index, s.base+s.count-1)
+		}
+		if perr != nil {
+			return fmt.Errorf("%s: offset %d: %s", s.path, off, perr)
+		}
+		s.index(block, off, int64(len(line)))
+		off += int64(len(line))
+	}
+	return s.file.Truncate(s.end)
+}
+
+//index records a block at offset off, taking size bytes, as the new tip
+func (s *fileStore) index(block Block, off int64, size int64) {
+	if s.count == 0 {
+		s.base = block.Index
+	}
+	if s.count%FileIndexStride == 0 {
+		s.offsets = append(s.offsets, off)
+	}
+	s.count++
+	s.end = off + size
+
+	s.recent = append(s.recent, block)
+	if len(s.recent) >= 2*s.cache {
+		s.recent = append(make([]Block, 0, 2*s.cache), s.recent[len(s.recent)-s.cache:]...)
+	}
+}
+
+func (s *fileStore) Append(block Block) error {
+	data, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	line := string(data) + "\n"
+	_, err = s.file.WriteAt([]byte(line), s.end)
+	if err != nil {
+		return err
+	}
+	s.index(block, s.end, int64(len(line)))
+	return nil
+}
+
+func (s *fileStore) Block(index int) (Block, bool, error) {
+	pos := index - s.base
+	if pos < 0 || pos >= s.count {
+		return Block{}, false, nil
+	}
+	if r := len(s.recent) - (s.count - pos); r >= 0 {
+		return s.recent[r], true, nil
+	}
+
+	var block Block
+	err := s.scan(pos, func(p int, off int64, line string) (bool, error) {
+		if p < pos {
+			return true, nil
+		}
+		var err error
+		block, err = parseBlock(line)
+		if err != nil {
+			return false, fmt.Errorf("%s: block %d: %s", s.path, index, err)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return Block{}, false, err
+	}
+	return block, true, nil
+}
+
+/*scan reads the block lines of the file from the nearest offset known before position pos on,
+handing fn the position, offset and text of each until it returns false*/
+func (s *fileStore) scan(pos int, fn func(pos int, off int64, line string) (bool, error)) error {
+	p, off := pos-pos%FileIndexStride, s.offsets[pos/FileIndexStride]
+	if s.cursorPos >= p && s.cursorPos <= pos {
+		p, off = s.cursorPos, s.cursorOff
+	}
+	r := bufio.NewReader(io.NewSectionReader(s.file, off, s.end-off))
+	for p < s.count {
+		line, err := r.ReadString('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return err
+		}
+		lineOff := off
+		off += int64(len(line))
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		s.cursorPos, s.cursorOff = p+1, off
+		more, err := fn(p, lineOff, line)
+		if err != nil || !more {
+			return err
+		}
+		p++
+	}
+	return nil
+}
+
+//Find looks through the latest blocks first, then through the file from the tip back
+func (s *fileStore) Find(hash string) (Block, bool, error) {
+	if len(hash) == 0 {
+		return Block{}, false, nil
+	}
+	for i := len(s.recent) - 1; i >= 0; i-- {
+		if s.recent[i].Hash == hash {
+			return s.recent[i], true, nil
+		}
+	}
+	//the hash is on the line of its block, so only the lines that hold it have to be parsed
+	for group := len(s.offsets) - 1; group >= 0; group-- {
+		var block Block
+		found := false
+		err := s.scan(group*FileIndexStride, func(p int, off int64, line string) (bool, error) {
+			if p >= (group+1)*FileIndexStride {
+				return false, nil
+			}
+			if !strings.Contains(line, hash) {
+				return true, nil
+			}
+			var err error
+			block, err = parseBlock(line)
+			found = err == nil && block.Hash == hash
+			return !found, err
+		})
+		if err != nil || found {
+			return block, found, err
+		}
+	}
+	return Block{}, false, nil
+}
+
+func (s *fileStore) Base() int {
+	return s.base
+}
+
+func (s *fileStore) Tip() int {
+	return s.base + s.count - 1
+}
+
+//Reset writes the blocks to a new file that then takes the place of the chain file, so a failed write leaves the chain as it was
+func (s *fileStore) Reset(blocks []Block) error {
+	staged, err := s.Stage()
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		err = staged.Append(block)
+		if err != nil {
+			staged.Close()
+			return err
+		}
+	}
+	return s.Swap(staged)
+}
+
+//Stage makes the new chain file next to the chain file, so that Swap can rename it over the chain file
+func (s *fileStore) Stage() (BlockStore, error) {
+	file, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".sync-")
+	if err != nil {
+		return nil, err
+	}
+	err = file.Chmod(0644)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &fileStore{
+		file:      file,
+		path:      file.Name(),
+		cache:     s.cache,
+		cursorPos: -1,
+		staged:    true,
+	}, nil
+}
+
+//Swap renames the file of the staged store over the chain file, and carries on with the staged store
+func (s *fileStore) Swap(staged BlockStore) error {
+	next, ok := staged.(*fileStore)
+	if !ok {
+		return ErrStoreKind
+	}
+	//the new file must be on disk in full before it takes the place of the chain file
+	err := next.file.Sync()
+	if err == nil {
+		err = os.Rename(next.path, s.path)
+	}
+	if err != nil {
+		next.Close()
+		return err
+	}
+	s.file.Close()
+	next.path, next.staged = s.path, s.staged
+	*s = *next
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	err := s.file.Close()
+	if s.staged {
+		os.Remove(s.path)
+	}
+	return err
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.txt")
+
+	//a small cache makes most reads go to the file
+	store, err := newFileStore(path, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	chain := []Block{GetGenesisBlock()}
+	store.Append(chain[0])
+	for i := 0; i < 1500; i++ {
+		blk := *nextBlock(chain[len(chain)-1], 1+i%7, 1, "test")
+		chain = append(chain, blk)
+		if err := store.Append(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.Base() != 0 || store.Tip() != 1500 {
+		t.Fatalf("store holds blocks %d to %d, expected 0 to 1500", store.Base(), store.Tip())
+	}
+	for _, index := range []int{0, 1, 700, 1492, 1500} {
+		blk, ok, err := store.Block(index)
+		if err != nil || !ok || blk != chain[index] {
+			t.Errorf("block %d: read %+v, %v, %v", index, blk, ok, err)
+		}
+	}
+	if blk, ok, _ := store.Find(chain[321].Hash); !ok || blk.Index != 321 {
+		t.Errorf("could not find block 321 by hash")
+	}
+	if _, ok, _ := store.Block(1501); ok {
+		t.Error("found a block past the tip")
+	}
+
+	//the file is still a chain file
+	read, err := ReadChainFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(chain) || read[1000] != chain[1000] {
+		t.Errorf("chain file holds %d blocks, expected %d", len(read), len(chain))
+	}
+
+	if err := store.Reset(chain[1024:]); err != nil {
+		t.Fatal(err)
+	}
+	if store.Base() != 1024 || store.Tip() != 1500 {
+		t.Errorf("reset store holds blocks %d to %d, expected 1024 to 1500", store.Base(), store.Tip())
+	}
+	if _, ok, _ := store.Find(chain[10].Hash); ok {
+		t.Error("found a block dropped by the reset")
+	}
+	if blk, ok, _ := store.Block(1100); !ok || blk != chain[1100] {
+		t.Errorf("block 1100 after reset: %+v", blk)
+	}
+
+	//a reset writes a new file and renames it over the chain file, and a staged store that is not swapped in leaves nothing behind
+	staged, err := store.Stage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged.Append(chain[0])
+	staged.Close()
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+		t.Errorf("expected only the chain file, found %v", files)
+	}
+	if read, err := ReadChainFile(path); err != nil || len(read) != 1500-1024+1 {
+		t.Errorf("chain file holds %d blocks after the reset, %v", len(read), err)
+	}
+}
+
+func TestFileStoreReopens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.txt")
+
+	store, err := newFileStore(path, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := testChain()
+	for i := 0; i < 200; i++ {
+		chain = append(chain, *nextBlock(chain[len(chain)-1], 1, 1, "test"))
+	}
+	if err := store.Reset(chain); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	//a crash while a block was written leaves half a line at the end
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"Index":205,"PrevHash":"`)
+	file.Close()
+
+	store, err = newFileStore(path, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Base() != 0 || store.Tip() != len(chain)-1 {
+		t.Fatalf("reopened store holds blocks %d to %d, expected 0 to %d", store.Base(), store.Tip(), len(chain)-1)
+	}
+	for _, index := range []int{0, 3, 64, 130, len(chain) - 1} {
+		if blk, ok, err := store.Block(index); err != nil || !ok || blk != chain[index] {
+			t.Errorf("block %d: read %+v, %v, %v", index, blk, ok, err)
+		}
+	}
+	if blk, ok, _ := store.Find(chain[70].Hash); !ok || blk != chain[70] {
+		t.Errorf("could not find block 70 by hash")
+	}
+	next := *nextBlock(chain[len(chain)-1], 2, 5, "test")
+	if err := store.Append(next); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadChainFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(chain)+1 || read[len(chain)] != next {
+		t.Errorf("chain file holds %d blocks after the half written one was cut off, expected %d", len(read), len(chain)+1)
+	}
+	store.Close()
+
+	//a block that cannot be read in the middle of the file is an error, and nothing is cut off
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbled := strings.Replace(string(data), `{"Index":100,`, `{"Index":100,,`, 1)
+	if err := ioutil.WriteFile(path, []byte(garbled), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newFileStore(path, 8); err == nil {
+		t.Error("chain file with a garbled block opened")
+	}
+	if data, _ = ioutil.ReadFile(path); string(data) != garbled {
+		t.Error("chain file with a garbled block changed")
+	}
+}
+
+func TestLedgerResumes(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	setCheckpointInterval(t, 4)
+	dir, err := ioutil.TempDir("", "chains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, prune := range []bool{false, true} {
+		path := filepath.Join(dir, fmt.Sprintf("prune-%t.txt", prune))
+		l := NewLedger(path)
+		if prune {
+			l.EnablePruning()
+		}
+		for i := 0; i < 10; i++ {
+			if err := l.Append(nextBlock(l.Latest(), 1+i%2, float32(i+1), "test")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tip, balance := l.Latest(), l.Balance(2)
+		l.Close()
+
+		//a restarted terminal carries on from the chain it had, a pruned one from its checkpoint
+		l = NewLedger(path)
+		if l.Latest() != tip || l.Balance(2) != balance || l.Checkpoint() == nil || l.Checkpoint().Index != 8 {
+			t.Errorf("prune %t: resumed at block %d with balance %f, expected block %d with %f", prune, l.Latest().Index, l.Balance(2), tip.Index, balance)
+		}
+		if statement := l.CardHistory(2, 0); len(statement.Transactions) == 0 || statement.Balance != balance {
+			t.Errorf("prune %t: card index not rebuilt: %+v", prune, statement)
+		}
+		if err := l.Append(nextBlock(l.Latest(), 1, 1, "test")); err != nil {
+			t.Errorf("prune %t: cannot append after resuming: %s", prune, err)
+		}
+		l.Close()
+	}
+
+	//a chain file with blocks that do not follow from the chain, or that is no chain, is not resumed and left as it is
+	path := filepath.Join(dir, "broken.txt")
+	chain := testChain()
+	chain[3].Amount = 1000
+	writeFile := func(blocks []Block) {
+		store, err := newFileStore(path, RecentBlockCache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Reset(blocks)
+		store.Close()
+	}
+	for _, blocks := range [][]Block{chain, chain[2:]} {
+		writeFile(blocks)
+		if _, err := OpenLedger(path); err == nil {
+			t.Errorf("chain file of blocks %d to %d resumed", blocks[0].Index, blocks[len(blocks)-1].Index)
+		}
+		if read, err := ReadChainFile(path); err != nil || len(read) != len(blocks) {
+			t.Errorf("chain file of %d blocks changed to %d blocks, %v", len(blocks), len(read), err)
+		}
+	}
+}
+
+func TestLongChainSyncsInBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//registered before the network, so that they run once the nodes have stopped
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ledger := NewLedger(filepath.Join(dir, "late.txt"))
+	t.Cleanup(func() { ledger.Close() })
+
+	tn := newTestNetwork(t)
+	first := tn.addNode("first", "cash")
+
+	//more blocks than the old 1024 block limit, appended straight to the ledger of the first node
+	for i := 0; i < 2*SyncBatchSize+100; i++ {
+		err := first.cs.Ledger.Append(nextBlock(first.cs.Ledger.Latest(), 1+i%9, 2, "first"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	late := tn.addNodeWithLedger("late", "retail", ledger)
+	tn.waitForConvergence(5 * time.Second)
+
+	if balance := late.cs.Ledger.Balance(1); balance != first.cs.Ledger.Balance(1) {
+		t.Errorf("late node has balance %f on card 1, expected %f", balance, first.cs.Ledger.Balance(1))
+	}
+	if recent := late.cs.Ledger.RecentBlocks(3); len(recent) != 3 || recent[2].Index != 2*SyncBatchSize+100 {
+		t.Errorf("unexpected recent blocks %v", recent)
+	}
+}
+
+func TestResumedNodeSyncsMissedBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "back.txt")
+	//the ledger is closed once the nodes have stopped
+	var ledger *Ledger
+	t.Cleanup(func() { ledger.Close() })
+
+	tn := newTestNetwork(t)
+	cash := tn.addNode("cash", "cash")
+	for i := 0; i < 3; i++ {
+		tn.transact(cash, 4, 10)
+	}
+	//the chain file a terminal left when it was stopped at block 3
+	ledger = NewLedger(path)
+	if err := ledger.Extend(snapshotLedger(cash.cs.Ledger).Chain); err != nil {
+		t.Fatal(err)
+	}
+	ledger.Close()
+	tn.transact(cash, 4, 10)
+
+	ledger = NewLedger(path)
+	events, stop := ledger.Subscribe()
+	defer stop()
+	tn.addNodeWithLedger("back", "retail", ledger)
+	tn.waitForConvergence(5 * time.Second)
+
+	//the missed block is added on top of the resumed chain instead of the chain being replaced
+	select {
+	case ev := <-events:
+		if ev.Type != EventBlockAdded || ev.Block.Index != 4 {
+			t.Errorf("expected block 4 to be added, got event %d for block %d", ev.Type, ev.Block.Index)
+		}
+	default:
+		t.Error("resumed node did not sync the block it missed")
+	}
+}
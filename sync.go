@@ -7,30 +7,50 @@ import (
 )
 
 func (cs *ChainSubscription) RequestIndices() error {
+	//ask for the hash at the tip of an imported snapshot, to check it against the network
+	at := 0
+	if imported := cs.Ledger.UnconfirmedImport(); imported != nil {
+		at = imported.Index
+	}
+	return cs.requestIndicesAt(at)
+}
+
+//requestIndicesAt asks every peer for its index, and for the hash it holds at index at if at > 0
+func (cs *ChainSubscription) requestIndicesAt(at int) error {
 	log.Printf("Starting request indices")
 	m := SpecialMessage{
 		Type:       1,
 		Timestamp:  time.Now().String(),
 		Sender:     cs.self.Pretty(),
 		SenderNick: cs.nickName,
+		SenderType: cs.typePos,
+		Index:      at,
 	}
 	jsonM, err := json.Marshal(m)
 	if err != nil {
 		log.Printf("Error in request indices")
 		return err
 	}
+	//votes are only counted for the round they were sent in, so a peer that has since moved on is not held to an old checkpoint
+	cs.votesMu.Lock()
+	cs.checkpointVotes = nil
+	cs.votesMu.Unlock()
 	return cs.topic.Publish(cs.ctx, jsonM)
 }
 
-func (cs *ChainSubscription) ReadIndices() (string, int, error) {
+/*ReadIndices waits for the index of every peer and returns the peer with the longest chain,
+its index and the hash it holds at the index asked for by RequestIndices (if any)*/
+func (cs *ChainSubscription) ReadIndices() (string, int, string, error) {
 	log.Printf("Starting read indices")
 	numPeers := len(cs.topic.ListPeers())
 	peerIndices := make(map[string]int)
+	peerHashes := make(map[string]string)
 
 	for i := 0; i < numPeers; {
 		msg, err := cs.sub.Next(cs.ctx)
 		if err != nil {
 			log.Printf("Error in read indices loop: %s", err)
+			return "", -1, "", err
 		}
 		var indexMsg SpecialMessage
 		err = json.Unmarshal(msg.Data, &indexMsg)
@@ -40,33 +60,147 @@ func (cs *ChainSubscription) ReadIndices() (string, int, error) {
 		log.Printf("Logging msg in read indices; %s", indexMsg.pretty())
 		if indexMsg.Type == 3 && indexMsg.Receiver == cs.self.Pretty() {
 			i++
+			cs.seeMessage(&indexMsg)
 			log.Printf("Read Index Message message from %s", indexMsg.SenderNick)
 			peerIndices[indexMsg.Sender] = indexMsg.Index
+			peerHashes[indexMsg.Sender] = indexMsg.Hash
+			cs.recordCheckpointVote(&indexMsg)
+		}
+	}
+
+	maxSender, maxTillNow := bestPeer(peerIndices)
+	log.Printf("Exiting read indices")
+
+	return maxSender, maxTillNow, peerHashes[maxSender], nil
+
+}
+
+/*indexReturnMessage answers an index request (type 1) with the index of our latest block,
+and vouches for our latest checkpoint by sending it signed, without its balances. It may run
+while blocks are being appended, so it only reads the ledger through a copy*/
+func (cs *ChainSubscription) indexReturnMessage(req *SpecialMessage) SpecialMessage {
+	msg := SpecialMessage{
+		Type:       3,
+		Timestamp:  time.Now().String(),
+		Sender:     cs.self.Pretty(),
+		SenderNick: cs.nickName,
+		SenderType: cs.typePos,
+		Receiver:   req.Sender,
+		Index:      cs.Ledger.Latest().Index,
+	}
+	if req.Index > 0 {
+		if blk := cs.Ledger.BlockAt(req.Index); blk != nil {
+			msg.Hash = blk.Hash
+		}
+	}
+	msg.Checkpoint = cs.signedCheckpoint(cs.Ledger.Checkpoint(), false)
+	return msg
+}
+
+/*chainReturnMessage answers a chain request (type 2) with up to SyncBatchSize blocks from
+the requested index on, read from the ledger under a single lock so that they stay consistent
+even if blocks are appended while the message is marshalled and sent. Blocks are sent from
+the latest checkpoint, along with the checkpoint, if the requester asks for that or if we
+have pruned the blocks it asks for. Index holds our latest index, so that the requester knows
+whether to ask for more*/
+func (cs *ChainSubscription) chainReturnMessage(req *SpecialMessage) SpecialMessage {
+	page := cs.Ledger.Page(req.Index, SyncBatchSize)
+	return SpecialMessage{
+		Type:       4,
+		Timestamp:  time.Now().String(),
+		Sender:     cs.self.Pretty(),
+		SenderNick: cs.nickName,
+		SenderType: cs.typePos,
+		Receiver:   req.Sender,
+		Index:      page.Latest.Index,
+		Blockchain: page.Blocks,
+		Checkpoint: cs.signedCheckpoint(page.Checkpoint, true),
+	}
+}
+
+//signedCheckpoint signs a checkpoint with our key for sending. It returns nil if there is no checkpoint or it cannot be signed
+func (cs *ChainSubscription) signedCheckpoint(cp *Checkpoint, withBalances bool) *Checkpoint {
+	if cp == nil || cs.key == nil {
+		return nil
+	}
+	signed, err := signCheckpoint(cp, cs.key, withBalances)
+	if err != nil {
+		log.Printf("Error signing checkpoint %d: %s", cp.Index, err)
+		return nil
+	}
+	return signed
+}
+
+/*recordCheckpointVote keeps the checkpoint a peer vouched for in an index reply (type 3). A
+peer that sent none, or one it did not sign, still counts as a peer that answered*/
+func (cs *ChainSubscription) recordCheckpointVote(indexMsg *SpecialMessage) {
+	cp := indexMsg.Checkpoint
+	if cp != nil && cp.VerifySignature(indexMsg.Sender) != nil {
+		cp = nil
+	}
+	cs.votesMu.Lock()
+	defer cs.votesMu.Unlock()
+	if cs.checkpointVotes == nil {
+		cs.checkpointVotes = make(map[string]*Checkpoint)
+	}
+	cs.checkpointVotes[indexMsg.Sender] = cp
+}
+
+/*trustCheckpoint decides whether to sync from a checkpoint that sender sent with its chain.
+Its balances are not backed by any blocks we are sent, so it must be signed by the sender and
+either match a checkpoint of our own chain, or be the one that most of the peers that answered
+our last index request vouched for*/
+func (cs *ChainSubscription) trustCheckpoint(cp *Checkpoint, sender string) error {
+	if err := cp.VerifySignature(sender); err != nil {
+		return err
+	}
+	if err := cp.Verify(); err != nil {
+		return err
+	}
+	if own := cs.Ledger.Checkpoint(); own != nil && own.sameState(cp) {
+		return nil
+	}
+
+	cs.votesMu.Lock()
+	defer cs.votesMu.Unlock()
+	agree := 0
+	for _, vote := range cs.checkpointVotes {
+		if vote != nil && vote.sameState(cp) {
+			agree++
 		}
 	}
+	if agree*2 <= len(cs.checkpointVotes) {
+		return ErrCheckpointUntrusted
+	}
+	return nil
+}
 
+/*bestPeer picks the peer with the longest chain from the indices they returned. Ties go to
+the lowest peer id so that every terminal makes the same choice. It returns an index of -1
+if no peer answered*/
+func bestPeer(peerIndices map[string]int) (string, int) {
 	maxTillNow := -1
 	var maxSender string
 	for k, v := range peerIndices {
-		if v > maxTillNow {
+		if v > maxTillNow || (v == maxTillNow && k < maxSender) {
 			maxTillNow = v
 			maxSender = k
 		}
 	}
-	log.Printf("Exiting read indices")
-
-	return maxSender, maxTillNow, nil
-
+	return maxSender, maxTillNow
 }
 
-func (cs *ChainSubscription) RequestMaxBlockChain(receiverID string) error {
+//RequestMaxBlockChain asks a peer for its chain, from block index from on (0 for the whole chain)
+func (cs *ChainSubscription) RequestMaxBlockChain(receiverID string, from int) error {
 	log.Printf("Starting request indices")
 	m := SpecialMessage{
 		Type:       2,
 		Timestamp:  time.Now().String(),
 		Sender:     cs.self.Pretty(),
 		SenderNick: cs.nickName,
+		SenderType: cs.typePos,
 		Receiver:   receiverID,
+		Index:      from,
 	}
 	jsonM, err := json.Marshal(m)
 	if err != nil {
@@ -82,7 +216,9 @@ func (cs *ChainSubscription) ReadChain() error {
 	for {
 		msg, err := cs.sub.Next(cs.ctx)
 		if err != nil {
-			log.Printf("Error in read indices loop: %s", err)
+			log.Printf("Error in read chain loop: %s", err)
+			cs.discardStage()
+			return err
 		}
 		var chainMsg SpecialMessage
 		err = json.Unmarshal(msg.Data, &chainMsg)
@@ -94,16 +230,258 @@ func (cs *ChainSubscription) ReadChain() error {
 
 		if chainMsg.Type == 4 && chainMsg.Receiver == cs.self.Pretty() {
 			log.Printf("Read Chain message from %s", chainMsg.SenderNick)
-			cs.Chain = chainMsg.Blockchain
-			break
+			cs.seeMessage(&chainMsg)
+			next, more, err := cs.applyChainPage(&chainMsg)
+			if err != nil {
+				return err
+			}
+			if !more {
+				break
+			}
+			err = cs.RequestMaxBlockChain(chainMsg.Sender, next)
+			if err != nil {
+				return err
+			}
 		}
 	}
-	//sync the balance on cards as well
-	for _, blk := range cs.Chain {
-		cs.balance[blk.CardId] += blk.Amount
-		log.Printf("Syncing Balances: CardID-->%d Balance-->%f", blk.CardId, blk.Amount)
-	}
 	log.Printf("Exiting read chain")
 	return nil
 
 }
+
+/*applyChainPage adds a batch of a chain reply (type 4) to the ledger. Long chains come in
+batches, so it returns the index to ask the sender for next, and false once we have caught up.
+Blocks that continue our chain are appended as they come. A chain that replaces ours is staged
+until its last batch has come in and checks out, and only then swapped in, so a sync that fails
+halfway leaves our chain as it was. During Resync the caller must hold cs.syncMu*/
+func (cs *ChainSubscription) applyChainPage(chainMsg *SpecialMessage) (int, bool, error) {
+	var err error
+	switch {
+	case cs.stage != nil:
+		err = cs.stage.Add(chainMsg.Blockchain)
+	case chainMsg.Checkpoint != nil:
+		err = cs.trustCheckpoint(chainMsg.Checkpoint, chainMsg.Sender)
+		if err == nil {
+			err = cs.stageChain(chainMsg.Checkpoint, chainMsg.Blockchain)
+		}
+	case len(chainMsg.Blockchain) > 0 && chainMsg.Blockchain[0].Index > 0:
+		err = cs.Ledger.Extend(chainMsg.Blockchain)
+	default:
+		err = cs.stageChain(nil, chainMsg.Blockchain)
+	}
+	if err != nil {
+		log.Printf("Rejected chain from %s: %s", chainMsg.SenderNick, err)
+		cs.discardStage()
+		return 0, false, err
+	}
+
+	next, more := 0, false
+	if len(chainMsg.Blockchain) > 0 {
+		last := chainMsg.Blockchain[len(chainMsg.Blockchain)-1].Index
+		next, more = last+1, last < chainMsg.Index
+	}
+	if !more && cs.stage != nil {
+		err = cs.Ledger.CommitStage(cs.stage)
+		cs.stage = nil
+		if err != nil {
+			log.Printf("Rejected chain from %s: %s", chainMsg.SenderNick, err)
+			return 0, false, err
+		}
+	}
+	return next, more, nil
+}
+
+//stageChain starts staging a chain that is to replace ours with its first batch
+func (cs *ChainSubscription) stageChain(cp *Checkpoint, blocks []Block) error {
+	st, err := cs.Ledger.StageChain(cp)
+	if err != nil {
+		return err
+	}
+	cs.stage = st
+	return st.Add(blocks)
+}
+
+//discardStage drops the chain staged by a sync that did not finish
+func (cs *ChainSubscription) discardStage() {
+	if cs.stage != nil {
+		cs.stage.Discard()
+		cs.stage = nil
+	}
+}
+
+//fullSyncFrom is the index to ask for the whole chain from. A pruning terminal drops old blocks anyway, so it only asks for those after the latest checkpoint
+func (cs *ChainSubscription) fullSyncFrom() int {
+	if cs.Ledger.Pruning() {
+		return -1
+	}
+	return 0
+}
+
+/*Resync syncs a running terminal with the longest chain on the network again and returns the
+index of our latest block once it is done. readBlocks keeps running meanwhile and hands the
+replies to collectIndex and resyncChain: index replies are collected for SyncWaitTime, then
+the blocks after our tip are read from the best peer. If our tip is not on its chain, e.g.
+after a partition, its whole chain replaces ours. A peer whose chain is as long as ours but
+holds a different block at our tip has forked from us; the fork with the lowest tip hash wins,
+so that both sides of a partition settle on the same chain*/
+func (cs *ChainSubscription) Resync() (int, error) {
+	tip, err := cs.startResync()
+	if err != nil {
+		return tip.Index, err
+	}
+	select {
+	case <-time.After(SyncWaitTime):
+	case <-cs.ctx.Done():
+		err = cs.ctx.Err()
+	}
+
+	done, err := cs.requestResyncChain(&tip, err)
+	if done == nil {
+		return tip.Index, err
+	}
+	select {
+	case err = <-done:
+	case <-time.After(ResyncTimeout):
+		err = ErrSyncTimeout
+	case <-cs.ctx.Done():
+		err = cs.ctx.Err()
+	}
+	cs.finishResync(done, err)
+	return cs.Ledger.Latest().Index, err
+}
+
+/*The steps of Resync are run by the functions below, so that the simulated network of the
+tests can drive them without waiting in real time*/
+
+//startResync asks every peer for its index and starts collecting the replies. It returns our tip at the time
+func (cs *ChainSubscription) startResync() (Block, error) {
+	cs.syncMu.Lock()
+	if cs.syncIndices != nil || len(cs.syncPeer) > 0 {
+		cs.syncMu.Unlock()
+		return Block{}, ErrSyncInProgress
+	}
+	cs.syncIndices = make(map[string]int)
+	cs.syncHashes = make(map[string]string)
+	cs.syncMu.Unlock()
+
+	tip := cs.Ledger.Latest()
+	err := cs.requestIndicesAt(tip.Index)
+	if err != nil {
+		cs.syncMu.Lock()
+		cs.syncIndices, cs.syncHashes = nil, nil
+		cs.syncMu.Unlock()
+	}
+	return tip, err
+}
+
+/*requestResyncChain ends the wait for index replies. It picks the peer to sync with from the
+replies and asks it for its chain, from our tip or in full if it has forked from us. The
+returned channel gets the outcome from resyncChain; it is nil if there is nothing to sync or
+err is set, i.e. the wait ended early or no peer replied*/
+func (cs *ChainSubscription) requestResyncChain(tip *Block, err error) (chan error, error) {
+	cs.syncMu.Lock()
+	best, index := bestPeer(cs.syncIndices)
+	full := false
+	if index <= tip.Index {
+		best, full = forkPeer(tip, cs.syncIndices, cs.syncHashes)
+	}
+	cs.syncIndices, cs.syncHashes = nil, nil
+	if err == nil && index < 0 {
+		err = ErrSyncNoPeers
+	}
+	if err != nil || (index <= tip.Index && !full) {
+		if err == nil {
+			cs.lastSync = time.Now()
+		}
+		cs.syncMu.Unlock()
+		return nil, err
+	}
+	done := make(chan error, 1)
+	cs.syncPeer = best
+	cs.syncFull = full
+	cs.syncDone = done
+	cs.syncMu.Unlock()
+
+	from := tip.Index
+	if full {
+		log.Printf("Block %d of %s differs from ours. Syncing its full chain", tip.Index, best)
+		from = cs.fullSyncFrom()
+	} else {
+		log.Printf("Resyncing from block %d with %s, which is at block %d", tip.Index, best, index)
+	}
+	//asking from our tip on lets Extend check that the peer holds it too
+	err = cs.RequestMaxBlockChain(best, from)
+	if err != nil {
+		cs.finishResync(done, err)
+		return nil, err
+	}
+	return done, nil
+}
+
+//finishResync ends the sync that requestResyncChain started, with the outcome err
+func (cs *ChainSubscription) finishResync(done chan error, err error) {
+	cs.syncMu.Lock()
+	defer cs.syncMu.Unlock()
+	if cs.syncDone == done {
+		cs.syncPeer = ""
+		cs.syncDone = nil
+		cs.discardStage()
+	}
+	if err == nil {
+		cs.lastSync = time.Now()
+	}
+}
+
+//collectIndex records an index reply (type 3) while Resync is waiting for them
+func (cs *ChainSubscription) collectIndex(indexMsg *SpecialMessage) {
+	cs.syncMu.Lock()
+	defer cs.syncMu.Unlock()
+	if cs.syncIndices != nil {
+		cs.syncIndices[indexMsg.Sender] = indexMsg.Index
+		cs.syncHashes[indexMsg.Sender] = indexMsg.Hash
+		cs.recordCheckpointVote(indexMsg)
+	}
+}
+
+/*forkPeer finds the peer to take the chain of when no peer is ahead of us: one that is at our
+tip but holds a block with a lower hash there. Ties go to the lowest peer id*/
+func forkPeer(tip *Block, peerIndices map[string]int, peerHashes map[string]string) (string, bool) {
+	best, bestHash := "", tip.Hash
+	for id, index := range peerIndices {
+		hash := peerHashes[id]
+		//an empty hash is a peer that has pruned the block or not answered with it
+		if index != tip.Index || len(hash) == 0 {
+			continue
+		}
+		if hash < bestHash || (hash == bestHash && len(best) > 0 && id < best) {
+			best, bestHash = id, hash
+		}
+	}
+	return best, len(best) > 0
+}
+
+//resyncChain applies a chain reply (type 4) from the peer Resync is reading from and asks for the next batch
+func (cs *ChainSubscription) resyncChain(chainMsg *SpecialMessage) {
+	cs.syncMu.Lock()
+	defer cs.syncMu.Unlock()
+	if len(cs.syncPeer) == 0 || chainMsg.Sender != cs.syncPeer {
+		return
+	}
+
+	next, more, err := cs.applyChainPage(chainMsg)
+	if err != nil && !cs.syncFull {
+		//our tip is not on the chain of the peer, so take its whole chain
+		log.Printf("Block %d is not on the chain of %s. Syncing the full chain", cs.Ledger.Latest().Index, chainMsg.SenderNick)
+		cs.syncFull = true
+		next, more, err = cs.fullSyncFrom(), true, nil
+	}
+	if err == nil && more {
+		err = cs.RequestMaxBlockChain(chainMsg.Sender, next)
+		if err == nil {
+			return
+		}
+	}
+	cs.syncPeer = ""
+	cs.syncDone <- err
+	cs.syncDone = nil
+}
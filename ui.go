@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -18,13 +17,33 @@ import (
 type TerminalUI struct {
 	cs              *ChainSubscription
 	app             *tview.Application
-	peersList       *tview.TextView
+	peersTable      *tview.Table
+	transactions    *tview.Table
+	cardView        *tview.TextView
+	statusBar       *tview.TextView
+	pages           *tview.Pages
+	inputField      *tview.InputField
 	chainViewWriter io.Writer
 	inputCh         chan string
+	lookupCh        chan int
+	confirmCh       chan pendingTransaction
 	doneCh          chan struct{}
+	receiptFolder   string
+	exportFolder    string
+
+	//owned by the event loop of the app
+	dialogs int
+
+	//owned by handleEvents
+	lookupCard int
+	submitted  []Block
+	peerStates map[string]string
+	netState   string
 }
 
-func NewTerminalUI(cs *ChainSubscription) *TerminalUI {
+/*NewTerminalUI creates the UI of a terminal. Receipts of the transactions made on it are
+saved to receiptFolder, unless it is empty, and /export writes to exportFolder*/
+func NewTerminalUI(cs *ChainSubscription, receiptFolder string, exportFolder string) *TerminalUI {
 	//create a new application
 	app := tview.NewApplication()
 
@@ -47,9 +66,27 @@ func NewTerminalUI(cs *ChainSubscription) *TerminalUI {
 		SetFieldWidth(0).
 		SetFieldBackgroundColor(tcell.ColorBlack)
 
+	//the card lookup pane has its own input field, tab moves between the two
+	lookupCh := make(chan int, 1)
+	cardField := tview.NewInputField().
+		SetLabel("Card: ").
+		SetFieldWidth(0).
+		SetFieldBackgroundColor(tcell.ColorBlack).
+		SetAcceptanceFunc(tview.InputFieldInteger)
+	cardView := tview.NewTextView()
+	cardView.SetDynamicColors(true)
+	cardView.SetText("Press tab and type a card id to look it up")
+	cardPanel := tview.NewFlex().SetDirection(tview.FlexRow).AddItem(cardField, 1, 1, false).AddItem(cardView, 0, 1, false)
+	cardPanel.SetBorder(true)
+	cardPanel.SetTitle("Card Lookup")
+
 	//SetDoneFunc function is called when is called when user hits enter or tab
 	inputField.SetDoneFunc(func(key tcell.Key) {
-		//if not tab don't do anything
+		if key == tcell.KeyTab {
+			app.SetFocus(cardField)
+			return
+		}
+		//if not enter don't do anything
 		if key != tcell.KeyEnter {
 			return
 		}
@@ -60,35 +97,69 @@ func NewTerminalUI(cs *ChainSubscription) *TerminalUI {
 			return
 		}
 
-		if line == "/quit" {
-			app.Stop()
-			return
-		}
-
 		//in other cases, send the line to the input channel and clear the input field
 		inputCh <- line
 		inputField.SetText("")
 	})
 
-	//another text view to show the list of peers
-	peersListView := tview.NewTextView()
-	peersListView.SetBorder(true)
-	peersListView.SetTitle("Peers")
+	cardField.SetDoneFunc(func(key tcell.Key) {
+		if key != tcell.KeyEnter {
+			app.SetFocus(inputField)
+			return
+		}
+		cardId, err := strconv.Atoi(cardField.GetText())
+		if err != nil || cardId < 1 {
+			cardView.SetText(withColor("red", "Invalid card id"))
+			return
+		}
+		select {
+		case lookupCh <- cardId:
+		default:
+		}
+	})
+
+	//transactions of the chain, newest first
+	transactionsTable := tview.NewTable().SetFixed(1, 0)
+	transactionsTable.SetBorder(true)
+	transactionsTable.SetTitle("Transactions")
 
-	chainAndPeersPanel := tview.NewFlex().AddItem(chainTextView, 0, 1, false).AddItem(peersListView, 20, 1, false)
+	//peers table, with what we have heard of each peer
+	peersTable := tview.NewTable().SetFixed(1, 0)
+	peersTable.SetBorder(true)
+	peersTable.SetTitle("Peers")
 
-	fullPanel := tview.NewFlex().SetDirection(tview.FlexRow).AddItem(chainAndPeersPanel, 0, 1, false).AddItem(inputField, 1, 1, true)
+	statusBar := tview.NewTextView()
+	statusBar.SetDynamicColors(true)
 
-	//set the full panel as the root of the UI
-	app.SetRoot(fullPanel, true)
+	chainPanel := tview.NewFlex().SetDirection(tview.FlexRow).AddItem(chainTextView, 0, 3, false).AddItem(transactionsTable, 0, 2, false)
+	sidePanel := tview.NewFlex().SetDirection(tview.FlexRow).AddItem(cardPanel, 0, 1, false).AddItem(peersTable, 0, 1, false)
+	dashboard := tview.NewFlex().AddItem(chainPanel, 0, 1, false).AddItem(sidePanel, 68, 1, false)
+
+	fullPanel := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(dashboard, 0, 1, false).
+		AddItem(statusBar, 1, 1, false).
+		AddItem(inputField, 1, 1, true)
+
+	//set the full panel as the root of the UI, with pages so that dialogs can be shown over it
+	pages := tview.NewPages().AddPage("dashboard", fullPanel, true, true)
+	app.SetRoot(pages, true)
 
 	return &TerminalUI{
 		cs:              cs,
 		app:             app,
-		peersList:       peersListView,
+		peersTable:      peersTable,
+		transactions:    transactionsTable,
+		cardView:        cardView,
+		statusBar:       statusBar,
+		pages:           pages,
+		inputField:      inputField,
 		chainViewWriter: chainTextView,
 		inputCh:         inputCh,
+		lookupCh:        lookupCh,
+		confirmCh:       make(chan pendingTransaction, 1),
 		doneCh:          make(chan struct{}, 1),
+		receiptFolder:   receiptFolder,
+		exportFolder:    exportFolder,
 	}
 }
 
@@ -97,18 +168,6 @@ func (ui *TerminalUI) end() {
 	ui.doneCh <- struct{}{}
 }
 
-//pulls the list of peers currently subscribed to the chain and displays
-func (ui *TerminalUI) refreshPeers() {
-	peers := ui.cs.ListPeers()
-	idStrs := make([]string, len(peers))
-	for i, p := range peers {
-		idStrs[i] = p.Pretty()[36:]
-	}
-
-	ui.peersList.SetText(strings.Join(idStrs, "\n"))
-	ui.app.Draw()
-}
-
 // withColor wraps a string with color tags for display in the messages text box.
 func withColor(color, msg string) string {
 	return fmt.Sprintf("[%s]%s[-]", color, msg)
@@ -121,12 +180,31 @@ func (ui *TerminalUI) displayBlock(block *Block) {
 
 func (ui *TerminalUI) displayOwnBlock(block *Block) {
 	prompt := withColor("blue", fmt.Sprintf("<%s>:", ui.cs.nickName))
-	fmt.Fprintf(ui.chainViewWriter, "%s %s \n Current Balance on Card: %f\n", prompt, block.pretty(), ui.cs.balance[block.CardId])
+	fmt.Fprintf(ui.chainViewWriter, "%s %s \n Current Balance on Card: %f\n", prompt, block.pretty(), ui.cs.Ledger.Balance(block.CardId))
 }
 
 func (ui *TerminalUI) displayBalance(cardId int) {
 	prompt := withColor("yellow", fmt.Sprintf("<SYSTEM>:"))
-	fmt.Fprintf(ui.chainViewWriter, "%s Current Balance on Card: %f\n", prompt, ui.cs.balance[cardId])
+	fmt.Fprintf(ui.chainViewWriter, "%s Current Balance on Card: %f\n", prompt, ui.cs.Ledger.Balance(cardId))
+}
+
+//DefaultHistoryLength is the number of transactions shown by /history unless a count is given
+const DefaultHistoryLength = 10
+
+//displayHistory shows the statement of a card
+func (ui *TerminalUI) displayHistory(statement CardStatement) {
+	prompt := withColor("yellow", "<SYSTEM>:")
+	fmt.Fprintf(ui.chainViewWriter, "%s Statement of Card %d, opening balance %f\n", prompt, statement.CardId, statement.OpeningBalance)
+	for _, tx := range statement.Transactions {
+		fmt.Fprintf(ui.chainViewWriter, "  Block %d; %s; Terminal: %s; Amount: %f; Balance: %f\n", tx.Index, tx.Timestamp, tx.Terminal, tx.Amount, tx.Balance)
+	}
+	fmt.Fprintf(ui.chainViewWriter, "  Current Balance on Card: %f\n", statement.Balance)
+}
+
+//displayInfo shows the output of a command
+func (ui *TerminalUI) displayInfo(message string) {
+	prompt := withColor("yellow", "<SYSTEM>:")
+	fmt.Fprintf(ui.chainViewWriter, "%s %s\n", prompt, message)
 }
 
 func (ui *TerminalUI) displaySystemMessage(message string) {
@@ -134,103 +212,171 @@ func (ui *TerminalUI) displaySystemMessage(message string) {
 	fmt.Fprintf(ui.chainViewWriter, "%s %s \n", prompt, message)
 }
 
-func getBlockFromInputString(input string, cs *ChainSubscription) (*Block, error) {
+//displayTransactionError explains why a transaction was not made
+func (ui *TerminalUI) displayTransactionError(err error) {
+	switch err {
+	case ErrZeroAmount:
+		ui.displaySystemMessage("Problem with transaction: Amount must be non-zero. Use /balance <CARD_ID> to see the balance on a card")
+	case ErrCashDeduction:
+		ui.displaySystemMessage("Problem with transaction: Amount cannot be deducted from card on a Cash type POS terminal")
+	case ErrRetailCredit:
+		ui.displaySystemMessage("Problem with transaction: Amount cannot be added to card on a Retail type POS terminal")
+	case ErrInvalidCard, ErrInvalidTransaction:
+		ui.displaySystemMessage("Problem with transaction: Insufficient balance on card, card invalid or other internal problem. See system logs for more detail.")
+	case ErrRateLimited:
+		ui.displaySystemMessage("Problem with transaction: Too many transactions in a short time. Wait a moment and try again")
+	default:
+		printErr("Publish Err: %s", err)
+	}
+}
+
+//parseTransaction reads a transaction typed as <CARD_ID> <AMOUNT>
+func parseTransaction(input string) (int, float32, error) {
 	splits := strings.Split(input, " ")
 	if len(splits) != 2 {
-		return nil, errors.New("Invalid Input Format")
+		return 0, 0, errors.New("Invalid Input Format")
 	}
 
 	cardId, err := strconv.Atoi(splits[0])
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
 
 	amount, err := strconv.ParseFloat(splits[1], 32)
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
 
-	latestBlock := cs.GetLatestBlock()
-
-	var block Block
-	block.Index = latestBlock.Index + 1
-	block.PrevHash = latestBlock.Hash
-	block.Timestamp = time.Now().String()
-	block.CardId = cardId
-	block.Amount = float32(amount)
-	block.Hash = calculateBlockHash(block)
-	block.Sender = cs.self.Pretty()
-	block.SenderNick = cs.nickName
-
-	return &block, nil
+	return cardId, float32(amount), nil
 }
 
-//log the block chain contents to file
-func (ui *TerminalUI) logBlockChain() {
-	file, err := os.Create(fmt.Sprintf("Chains/%s.txt", ui.cs.nickName))
-	if err != nil {
-		panic("Error opening Chain log files")
+//checkPeers alerts the user when the terminal loses the network and to the peers that have fallen behind, gone silent, disconnected or recovered, and refreshes the peers table
+func (ui *TerminalUI) checkPeers() {
+	state, _ := ui.cs.NetworkState()
+	if state != ui.netState && (len(ui.netState) > 0 || state != NetOnline) {
+		switch state {
+		case NetIsolated:
+			ui.displaySystemMessage("Lost all peers. Balances and history are served from the local chain, but transactions made now may be dropped when the terminal catches up with the network")
+		case NetPartitioned:
+			ui.displaySystemMessage("Lost most peers, the network may be split. Transactions made now may be dropped when the terminal catches up with the network")
+		case NetOnline:
+			ui.displayInfo("Back online, catching up with the network")
+		}
 	}
-	for _, blk := range ui.cs.Chain {
-		fmt.Fprintf(file, blk.pretty()+"\n")
+	ui.netState = state
+
+	health := ui.cs.PeerHealth()
+	var alerts []peerAlert
+	alerts, ui.peerStates = healthAlerts(ui.peerStates, health)
+	for _, alert := range alerts {
+		if alert.Problem {
+			ui.displaySystemMessage(tview.Escape(alert.Message))
+		} else {
+			ui.displayInfo(tview.Escape(alert.Message))
+		}
 	}
+	ui.renderPeers(health)
 }
 
-//handleEvents runs an event loop that sends user input to the chat room and displays the messages received from the chat room.
-//It also periodically refreshes the list of the peers on the UI
+//handleEvents runs an event loop that sends user input to the chat room and displays the blocks reported by the ledger.
+//It also keeps the tables, the card lookup pane and the sync status bar of the dashboard up to date
 func (ui *TerminalUI) handleEvents() {
 	peerRefreshTicker := time.NewTicker(time.Second)
 	defer peerRefreshTicker.Stop()
+	//a sync can add thousands of blocks at once, so the tables are redrawn at most this often
+	tableRefreshTicker := time.NewTicker(250 * time.Millisecond)
+	defer tableRefreshTicker.Stop()
+
+	events, stop := ui.cs.Ledger.Subscribe()
+	defer func() { stop() }()
+
+	ui.renderTransactions()
+	ui.checkPeers()
+	transactionsChanged, cardChanged := false, false
 
 	for {
 		select {
 		case input := <-ui.inputCh:
-			block, err := getBlockFromInputString(input, ui.cs)
+			if strings.HasPrefix(input, "/") {
+				ui.runCommand(input)
+				continue
+			}
+			cardId, amount, err := parseTransaction(input)
 			if err != nil {
 				log.Printf("%s", err)
-				ui.displaySystemMessage("Problem with transaction format: Valid format is <CARD_ID (int)> <AMOUNT (float)>.")
+				ui.displaySystemMessage("Problem with transaction format: Valid format is <CARD_ID (int)> <AMOUNT (float)>. Type /help for the list of commands.")
 				continue
 			}
-			if block.Amount < 0 && ui.cs.typePos == "cash" {
-				ui.displaySystemMessage("Problem with transaction: Amount cannot be deducted from card on a Cash type POS terminal")
+			//a transaction is only published once the user has confirmed it
+			err = ui.cs.checkTransaction(cardId, amount)
+			if err == nil && ui.cs.Ledger.Balance(cardId)+amount < 0 {
+				err = ErrInvalidTransaction
+			}
+			if err != nil {
+				ui.displayTransactionError(err)
 				continue
 			}
-			if block.Amount > 0 && ui.cs.typePos == "retail" {
-				ui.displaySystemMessage("Problem with transaction: Amount cannot be added to card on a Retail type POS terminal")
+			ui.confirmTransaction(pendingTransaction{CardId: cardId, Amount: amount})
+
+		case tx := <-ui.confirmCh:
+			if !tx.Confirmed {
+				ui.displaySystemMessage("Transaction cancelled")
 				continue
 			}
-			//when the user inputs a transaction, publish it to the chat room and print it to the message window
-			if ui.cs.ValidateBlockAddition(block) == true {
-				if block.Amount != 0 {
-					err = ui.cs.Publish(block)
-					if err != nil {
-						printErr("Publish Err: %s", err)
-					}
-					ui.cs.balance[block.CardId] += block.Amount
-					ui.cs.Chain = append(ui.cs.Chain, *block)
-					ui.displayOwnBlock(block)
-					ui.logBlockChain()
+			//when the user confirms a transaction, publish it to the chat room and print its receipt
+			//the new block is displayed when the ledger reports it
+			block, err := ui.cs.SubmitTransaction(tx.CardId, tx.Amount)
+			if err != nil {
+				ui.displayTransactionError(err)
+				continue
+			}
+			//kept to show the transaction as dropped if a sync takes it off the chain
+			ui.submitted = append(ui.submitted, *block)
+			if len(ui.submitted) > TransactionTableSize {
+				ui.submitted = ui.submitted[1:]
+			}
+			ui.printReceipt(block)
+
+		case ev, ok := <-events:
+			if !ok {
+				//we fell behind the ledger, pick up from its current state
+				events, stop = ui.cs.Ledger.Subscribe()
+				continue
+			}
+			transactionsChanged = true
+			cardChanged = cardChanged || ev.Type == EventChainReplaced || ev.Block.CardId == ui.lookupCard
+			switch ev.Type {
+			case EventBlockAdded:
+				if ev.Block.Sender == ui.cs.self.Pretty() {
+					ui.displayOwnBlock(&ev.Block)
 				} else {
-					ui.displayBalance(block.CardId)
+					ui.displayBlock(&ev.Block)
 				}
-			} else {
+			case EventBlockRejected:
 				ui.displaySystemMessage("Problem with transaction: Insufficient balance on card, card invalid or other internal problem. See system logs for more detail.")
+			case EventChainReplaced:
+				ui.displaySystemMessage(fmt.Sprintf("Synced chain up to block %d", ev.Block.Index))
 			}
 
-		case blk := <-ui.cs.Blocks:
-			if ui.cs.ValidateBlockAddition(blk) == true {
-				ui.cs.Chain = append(ui.cs.Chain, *blk)
-				ui.cs.balance[blk.CardId] += blk.Amount
-				ui.displayBlock(blk)
-				ui.logBlockChain()
-			} else {
-				ui.displaySystemMessage("Problem with transaction: Insufficient balance on card, card invalid or other internal problem. See system logs for more detail.")
+		case cardId := <-ui.lookupCh:
+			ui.lookupCard = cardId
+			ui.renderCard()
+
+		case <-tableRefreshTicker.C:
+			if transactionsChanged {
+				ui.renderTransactions()
+			}
+			if cardChanged {
+				ui.renderCard()
 			}
+			transactionsChanged, cardChanged = false, false
 
 		case <-peerRefreshTicker.C:
-			ui.refreshPeers()
+			ui.checkPeers()
 
 		case <-ui.cs.ctx.Done():
+			//the terminal is shutting down, e.g. on SIGTERM
+			ui.app.Stop()
 			return
 
 		case <-ui.doneCh:
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+//errors returned by checkMessage for a message that gossipsub should drop
+var (
+	ErrMessageFormat  = errors.New("neither a block nor a known special message")
+	ErrMessageSender  = errors.New("sender does not match the peer that signed the message")
+	ErrBlockFields    = errors.New("block has an invalid index or no prev hash")
+	ErrBlockTimestamp = errors.New("block timestamp is not a time")
+	ErrBlockSender    = errors.New("block sender or nickname holds control characters or separators")
+	ErrPresenceRecord = errors.New("presence announcement without a record of its sender")
+)
+
+//InvalidMessagePenalty is the score weight of every invalid message a peer has sent, squared
+const InvalidMessagePenalty = -100
+
+//InvalidMessageDecay is how long it takes for a penalty for invalid messages to wear off
+const InvalidMessageDecay = time.Hour
+
+//blockMessage is the message type of a new block, which has no Type field unlike special messages
+const blockMessage = 0
+
+/*validate is the topic validator of a chain. It runs in the gossipsub router before a message
+is delivered to us or forwarded to anyone else, so a message that fails checkMessage is dropped
+at the first honest terminal it reaches and the peer that sent it is penalised. Gossipsub has
+already checked the signature of the message, so its author is known. Whether a valid block
+fits our chain is still left to the ledger, since peers may be at different heights. Valid
+messages over the rate limits of their author are ignored, without penalising the peer that
+forwarded them*/
+func (f *messageFilter) validate(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	author := msg.GetFrom()
+	specialMsg, err := checkMessage(author, msg.Data)
+	if err != nil {
+		f.drop(author.Pretty(), DropInvalid)
+		log.Printf("Rejected message from %s relayed by %s: %s", author.Pretty(), from.Pretty(), err)
+		return pubsub.ValidationReject
+	}
+	if author == f.self {
+		return pubsub.ValidationAccept
+	}
+
+	typ, req := blockMessage, (*SpecialMessage)(nil)
+	if specialMsg != nil {
+		typ = specialMsg.Type
+		if typ == 1 || typ == 2 {
+			req = specialMsg
+		}
+	}
+	if reason := f.admit(author.Pretty(), typ, req, time.Now()); len(reason) > 0 {
+		f.drop(author.Pretty(), reason)
+		return pubsub.ValidationIgnore
+	}
+	return pubsub.ValidationAccept
+}
+
+/*checkMessage checks the structure, hashes and signatures of a message published by author.
+It returns the message if it is a special message, or nil if it is a block*/
+func checkMessage(author peer.ID, data []byte) (*SpecialMessage, error) {
+	block := new(Block)
+	err := json.Unmarshal(data, block)
+	if err == nil && len(block.PrevHash) > 0 {
+		//the author of a new block is the terminal that made it
+		if block.Sender != author.Pretty() {
+			return nil, ErrMessageSender
+		}
+		return nil, checkBlockFields(block)
+	}
+
+	specialMsg := new(SpecialMessage)
+	err = json.Unmarshal(data, specialMsg)
+	if err != nil {
+		return nil, ErrMessageFormat
+	}
+	if specialMsg.Type < 1 || specialMsg.Type > 5 {
+		return nil, ErrMessageFormat
+	}
+	if specialMsg.Sender != author.Pretty() {
+		return nil, ErrMessageSender
+	}
+	switch specialMsg.Type {
+	case 3:
+		if cp := specialMsg.Checkpoint; cp != nil {
+			err = cp.VerifySignature(specialMsg.Sender)
+		}
+	case 4:
+		err = checkChainReply(specialMsg)
+	case 5:
+		if specialMsg.Presence == nil || specialMsg.Presence.PeerId != author.Pretty() {
+			err = ErrPresenceRecord
+		} else {
+			err = specialMsg.Presence.Verify()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return specialMsg, nil
+}
+
+/*checkChainReply checks the blocks of a chain reply (type 4) and the links between them. The
+genesis block has a placeholder hash and is not checked, and the first block of a reply that
+starts at a checkpoint or a later block links to a block that is not in it*/
+func checkChainReply(specialMsg *SpecialMessage) error {
+	blocks := specialMsg.Blockchain
+	for i := range blocks {
+		if blocks[i].Index == 0 {
+			continue
+		}
+		err := checkBlockFields(&blocks[i])
+		if err != nil {
+			return fmt.Errorf("block %d: %s", blocks[i].Index, err)
+		}
+		if i == 0 {
+			continue
+		}
+		if blocks[i].Index != blocks[i-1].Index+1 {
+			return fmt.Errorf("block %d: %s", blocks[i].Index, ErrBlockIndex)
+		}
+		if blocks[i].PrevHash != blocks[i-1].Hash {
+			return fmt.Errorf("block %d: %s", blocks[i].Index, ErrPrevHash)
+		}
+	}
+	if cp := specialMsg.Checkpoint; cp != nil {
+		if err := cp.VerifySignature(specialMsg.Sender); err != nil {
+			return err
+		}
+		if err := cp.Verify(); err != nil {
+			return err
+		}
+		if len(blocks) > 0 && (blocks[0].Index != cp.Index || blocks[0].Hash != cp.BlockHash) {
+			return ErrCheckpoint
+		}
+	}
+	return nil
+}
+
+/*peerScoreOptions turns on gossipsub peer scoring for the topic of a chain. Every invalid
+message a peer sends counts against it: after one, we stop gossiping with it, after three
+we stop publishing to it, and after four its messages are ignored altogether until the
+penalty wears off*/
+func peerScoreOptions(topicName string) pubsub.Option {
+	return pubsub.WithPeerScore(
+		&pubsub.PeerScoreParams{
+			Topics: map[string]*pubsub.TopicScoreParams{
+				topicName: {
+					TopicWeight:                    1,
+					TimeInMeshQuantum:              time.Second,
+					InvalidMessageDeliveriesWeight: InvalidMessagePenalty,
+					InvalidMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(InvalidMessageDecay),
+				},
+			},
+			AppSpecificScore: func(peer.ID) float64 { return 0 },
+			DecayInterval:    pubsub.DefaultDecayInterval,
+			DecayToZero:      pubsub.DefaultDecayToZero,
+			RetainScore:      InvalidMessageDecay,
+		},
+		&pubsub.PeerScoreThresholds{
+			GossipThreshold:   -50,
+			PublishThreshold:  -500,
+			GraylistThreshold: -1000,
+		},
+	)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+//marshal encodes a message the way a terminal publishes it
+func marshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCheckMessage(t *testing.T) {
+	key, author := newPeerId(t)
+	otherKey, other := newPeerId(t)
+
+	genesis := GetGenesisBlock()
+	first := nextBlock(genesis, 1, 100, "first")
+	first.Sender = author.Pretty()
+	second := nextBlock(*first, 1, -30, "first")
+	second.Sender = author.Pretty()
+
+	//the sender of a block is not covered by its hash, only by the signature of the message
+	forged := *first
+	forged.Sender = other.Pretty()
+	tampered := *first
+	tampered.Amount = 1000
+	zero := *nextBlock(genesis, 1, 0, "first")
+	zero.Sender = author.Pretty()
+	noCard := *nextBlock(genesis, 0, 5, "first")
+	noCard.Sender = author.Pretty()
+	badTime := *nextBlock(genesis, 1, 5, "first")
+	badTime.Sender = author.Pretty()
+	badTime.Timestamp += "\nIndex: 9"
+	badTime.Hash = calculateBlockHash(badTime)
+	badNick := *nextBlock(genesis, 1, 5, "first; Hash: forged")
+	badNick.Sender = author.Pretty()
+	unlinked := *nextBlock(genesis, 1, -30, "first")
+	unlinked.Index = 2
+	unlinked.Hash = calculateBlockHash(unlinked)
+
+	rec, err := NewPresenceRecord(key, "first", "cash", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRec, err := NewPresenceRecord(otherKey, "other", "cash", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lying := *rec
+	lying.Height = 100
+
+	special := func(typ int, blocks ...Block) SpecialMessage {
+		return SpecialMessage{Type: typ, Sender: author.Pretty(), Blockchain: blocks}
+	}
+	announce := func(rec *PresenceRecord) SpecialMessage {
+		return SpecialMessage{Type: 5, Sender: author.Pretty(), Presence: rec}
+	}
+	checks := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"block", marshal(t, first), ""},
+		{"forged sender", marshal(t, forged), ErrMessageSender.Error()},
+		{"tampered block", marshal(t, tampered), ErrBlockHash.Error()},
+		//the ledger takes zero amounts, which older terminals made, so the router passes them on
+		{"zero amount", marshal(t, zero), ""},
+		{"invalid card", marshal(t, noCard), ErrInvalidCard.Error()},
+		{"timestamp with a new line", marshal(t, badTime), ErrBlockTimestamp.Error()},
+		{"nick with separators", marshal(t, badNick), ErrBlockSender.Error()},
+		{"garbage", []byte("not json"), ErrMessageFormat.Error()},
+		{"unknown type", marshal(t, special(9)), ErrMessageFormat.Error()},
+		{"index request", marshal(t, special(1)), ""},
+		{"forged request", marshal(t, SpecialMessage{Type: 1, Sender: other.Pretty()}), ErrMessageSender.Error()},
+		{"chain", marshal(t, special(4, genesis, *first, *second)), ""},
+		{"tampered chain", marshal(t, special(4, genesis, tampered, *second)), "block 1: " + ErrBlockHash.Error()},
+		{"unlinked chain", marshal(t, special(4, genesis, *first, unlinked)), "block 2: " + ErrPrevHash.Error()},
+		{"presence", marshal(t, announce(rec)), ""},
+		{"presence of another peer", marshal(t, announce(otherRec)), ErrPresenceRecord.Error()},
+		{"tampered presence", marshal(t, announce(&lying)), ErrPresenceSignature.Error()},
+	}
+	for _, c := range checks {
+		_, err := checkMessage(author, c.data)
+		if got := fmt.Sprint(err); (err == nil) != (c.err == "") || (err != nil && got != c.err) {
+			t.Errorf("%s: expected %q, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestValidatorDropsInvalidMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn, hosts := newMockHosts(t, ctx, 2)
+	honest, attacker := hosts[0], hosts[1]
+
+	var mu sync.Mutex
+	scores := make(map[peer.ID]float64)
+	inspect := func(s map[peer.ID]float64) {
+		mu.Lock()
+		defer mu.Unlock()
+		scores = s
+	}
+	honestPS, err := pubsub.NewGossipSub(ctx, honest, peerScoreOptions(testChainName), pubsub.WithPeerScoreInspect(inspect, 100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = honestPS.RegisterTopicValidator(testChainName, newMessageFilter(honest.ID()).validate); err != nil {
+		t.Fatal(err)
+	}
+	//the attacker does not validate what it publishes
+	attackerPS, err := pubsub.NewGossipSub(ctx, attacker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mn.ConnectPeers(honest.ID(), attacker.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	honestTopic, err := honestPS.Join(testChainName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := honestTopic.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	attackerTopic, err := attackerPS.Join(testChainName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(attackerTopic.ListPeers()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("attacker did not find the honest peer on the topic")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//a block in the name of the honest terminal, blocks with fields a chain file or log could be
+	//garbled by, then a valid block in its own name
+	forged := nextBlock(GetGenesisBlock(), 1, 100, "attacker")
+	forged.Sender = honest.ID().Pretty()
+	badTime := nextBlock(GetGenesisBlock(), 1, 100, "attacker")
+	badTime.Sender = attacker.ID().Pretty()
+	badTime.Timestamp = "2021-05-04 10:00:00; Hash: forged;\n"
+	badTime.Hash = calculateBlockHash(*badTime)
+	badNick := nextBlock(GetGenesisBlock(), 1, 100, "attacker\x1b[2J")
+	badNick.Sender = attacker.ID().Pretty()
+	valid := nextBlock(GetGenesisBlock(), 2, 50, "attacker")
+	valid.Sender = attacker.ID().Pretty()
+	for _, block := range []*Block{forged, badTime, badNick, valid} {
+		if err = attackerTopic.Publish(ctx, marshal(t, block)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readCtx, readCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer readCancel()
+	msg, err := sub.Next(readCtx)
+	if err != nil {
+		t.Fatalf("valid block not delivered: %s", err)
+	}
+	var got Block
+	if err = json.Unmarshal(msg.Data, &got); err != nil || got.Hash != valid.Hash {
+		t.Errorf("expected only the valid block to be delivered, got %s", msg.Data)
+	}
+
+	//the attacker is penalised for the forged block
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		score := scores[attacker.ID()]
+		mu.Unlock()
+		if score < 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("attacker has score %f after an invalid message", score)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
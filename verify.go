@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+//ChainProblem is the first inconsistency found in a chain
+type ChainProblem struct {
+	//Position is the position of the block in the chain, which is its index in a consistent chain
+	Position int
+	Block    Block
+	Err      error
+	Detail   string
+}
+
+//VerifyReport is the result of checking a persisted chain from genesis
+type VerifyReport struct {
+	Blocks   int
+	Balances map[int]float32
+	Problem  *ChainProblem
+}
+
+/*VerifyChain recomputes the hash of every block, checks index and prev hash continuity and
+replays the card balances, stopping at the first block that is not consistent. Balances are
+those of the chain up to that block*/
+func VerifyChain(chain []Block) VerifyReport {
+	return VerifyChainFrom(nil, chain)
+}
+
+/*VerifyChainFrom is VerifyChain for a chain pruned at a checkpoint, which starts at the block
+of the checkpoint and is replayed from the balances of the checkpoint. A nil checkpoint
+verifies the chain from genesis*/
+func VerifyChainFrom(cp *Checkpoint, chain []Block) VerifyReport {
+	report := VerifyReport{
+		Blocks:   len(chain),
+		Balances: make(map[int]float32),
+	}
+	if len(chain) == 0 {
+		return report
+	}
+
+	if cp != nil {
+		first := chain[0]
+		switch {
+		case cp.Verify() != nil:
+			report.Problem = &ChainProblem{
+				Position: 0,
+				Block:    first,
+				Err:      ErrCheckpoint,
+				Detail:   fmt.Sprintf("checkpoint at block %d has balances hash %s, computed %s", cp.Index, cp.BalancesHash, calculateBalancesHash(cp.Balances)),
+			}
+		case first.Index != cp.Index || first.Hash != cp.BlockHash:
+			report.Problem = &ChainProblem{
+				Position: 0,
+				Block:    first,
+				Err:      ErrBlockHash,
+				Detail:   fmt.Sprintf("chain starts at block %d with hash %s, checkpoint is at block %d with hash %s", first.Index, first.Hash, cp.Index, cp.BlockHash),
+			}
+		default:
+			for cardId, balance := range cp.Balances {
+				report.Balances[cardId] = balance
+			}
+		}
+		if report.Problem != nil {
+			return report
+		}
+	} else if genesis := chain[0]; genesis.Index != 0 || genesis.Hash != GetGenesisBlock().Hash {
+		report.Problem = &ChainProblem{
+			Position: 0,
+			Block:    genesis,
+			Err:      ErrBlockHash,
+			Detail:   fmt.Sprintf("chain does not start with a genesis block (index %d, hash %s)", genesis.Index, genesis.Hash),
+		}
+		return report
+	}
+
+	verifyBlocks(&report, chain[0], chain[1:], 1)
+	return report
+}
+
+//verifyBlocks checks blocks that follow prev, replaying the balances of the report. pos is the position of the first of them in the chain
+func verifyBlocks(report *VerifyReport, prev Block, blocks []Block, pos int) {
+	for i := range blocks {
+		blk := &blocks[i]
+		balance := report.Balances[blk.CardId]
+		err := checkBlock(&prev, balance, blk)
+		if err != nil {
+			report.Problem = &ChainProblem{
+				Position: pos + i,
+				Block:    *blk,
+				Err:      err,
+				Detail:   describeProblem(err, &prev, blk, balance),
+			}
+			return
+		}
+		report.Balances[blk.CardId] += blk.Amount
+		prev = *blk
+	}
+}
+
+/*Verify checks the chain a ledger holds like VerifyChainFrom, a page at a time so that a long
+chain never has to be in memory. Blocks appended while it runs are not checked*/
+func (l *Ledger) Verify() VerifyReport {
+	latest := l.Latest().Index
+	page := l.Page(0, SyncBatchSize)
+	report := VerifyChainFrom(page.Checkpoint, page.Blocks)
+	for report.Problem == nil && len(page.Blocks) > 0 {
+		prev := page.Blocks[len(page.Blocks)-1]
+		if prev.Index >= latest {
+			break
+		}
+		page = l.Page(prev.Index+1, SyncBatchSize)
+		verifyBlocks(&report, prev, page.Blocks, report.Blocks)
+		report.Blocks += len(page.Blocks)
+	}
+	return report
+}
+
+//describeProblem explains exactly why checkBlock rejected a block
+func describeProblem(err error, prev *Block, blk *Block, balance float32) string {
+	switch err {
+	case ErrBlockIndex:
+		return fmt.Sprintf("expected index %d after block %d, found %d", prev.Index+1, prev.Index, blk.Index)
+	case ErrPrevHash:
+		return fmt.Sprintf("prev hash %s does not match hash %s of block %d", blk.PrevHash, prev.Hash, prev.Index)
+	case ErrBlockHash:
+		return fmt.Sprintf("stored hash %s, computed %s", blk.Hash, calculateBlockHash(*blk))
+	case ErrInsufficientBalance:
+		return fmt.Sprintf("card %d has a balance of %f and cannot take %f", blk.CardId, balance, blk.Amount)
+	case ErrInvalidCard:
+		return fmt.Sprintf("card id %d is not valid", blk.CardId)
+	}
+	return err.Error()
+}
+
+//printVerifyReport writes a report for one chain file
+func printVerifyReport(w io.Writer, path string, report VerifyReport) {
+	if report.Problem != nil {
+		p := report.Problem
+		fmt.Fprintf(w, "%s: FAILED at block %d (position %d of %d): %s\n", path, p.Block.Index, p.Position, report.Blocks, p.Err)
+		fmt.Fprintf(w, "  %s\n", p.Detail)
+		fmt.Fprintf(w, "  %s", p.Block.pretty())
+		fmt.Fprintf(w, "  balances replayed up to block %d:\n", p.Position-1)
+	} else {
+		fmt.Fprintf(w, "%s: OK, %d blocks\n", path, report.Blocks)
+		fmt.Fprintf(w, "  balances:\n")
+	}
+
+	var cardIds []int
+	for cardId := range report.Balances {
+		cardIds = append(cardIds, cardId)
+	}
+	sort.Ints(cardIds)
+	for _, cardId := range cardIds {
+		fmt.Fprintf(w, "    card %d: %f\n", cardId, report.Balances[cardId])
+	}
+}
+
+/*runVerify implements the verify subcommand. It checks the given chain files, or every
+file in the chains folder of the config if none are given, and returns the exit code*/
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	configFlag := fs.String("config", "", "config file to read the chains folder from. SPIRIT_CONFIG if left empty")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify [-config=FILE] [CHAIN_FILE...]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Checks persisted ledgers, by default every file in the chains folder of the config.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		dirs, err := configDirs(*configFlag, os.LookupEnv)
+		if err != nil {
+			printErr("%s\n", err)
+			return 2
+		}
+		paths, _ = filepath.Glob(filepath.Join(dirs.Chains, "*.txt"))
+		if len(paths) == 0 {
+			printErr("no chain files found in %s\n", dirs.Chains)
+			return 2
+		}
+	}
+
+	code := 0
+	for _, path := range paths {
+		chain, err := ReadChainFile(path)
+		if err != nil {
+			printErr("%s\n", err)
+			code = 1
+			continue
+		}
+		//a pruned ledger is verified from the checkpoint kept next to it
+		var cp *Checkpoint
+		if chain[0].Index > 0 {
+			cp, err = ReadCheckpointFile(path + CheckpointFileSuffix)
+			if err != nil {
+				printErr("%s: chain is pruned at block %d but its checkpoint cannot be read: %s\n", path, chain[0].Index, err)
+				code = 1
+				continue
+			}
+		}
+		report := VerifyChainFrom(cp, chain)
+		printVerifyReport(os.Stdout, path, report)
+		if report.Problem != nil {
+			code = 1
+		}
+	}
+	return code
+}
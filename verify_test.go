@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//testChain builds a consistent chain of transactions on cards 1 and 2
+func testChain() []Block {
+	chain := []Block{GetGenesisBlock()}
+	for _, tx := range []struct {
+		cardId int
+		amount float32
+	}{{1, 100}, {2, 20}, {1, -35.5}, {2, -20}} {
+		chain = append(chain, *nextBlock(chain[len(chain)-1], tx.cardId, tx.amount, "test"))
+	}
+	return chain
+}
+
+//writeChainFile persists a chain the way a ledger does and returns the path
+func writeChainFile(t *testing.T, chain []Block) string {
+	dir, err := ioutil.TempDir("", "chains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "test.txt")
+	store, err := newFileStore(path, RecentBlockCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	err = store.Reset(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestChainFileRoundTrip(t *testing.T) {
+	chain := testChain()
+	//fields that hold the separators of the old format, or new lines, read back as they were written
+	chain[2].Timestamp = "2021-05-04 10:00:00; Hash: forged;\nIndex: 9"
+	chain[2].SenderNick = "till: 1; Amount: 100\n\x00"
+	chain[2].Hash = calculateBlockHash(chain[2])
+	chain[3].PrevHash = chain[2].Hash
+	read, err := ReadChainFile(writeChainFile(t, chain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(chain) {
+		t.Fatalf("read %d blocks, wrote %d", len(read), len(chain))
+	}
+	for i := range chain {
+		if read[i] != chain[i] {
+			t.Errorf("block %d changed:\n%s%s", i, chain[i].pretty(), read[i].pretty())
+		}
+	}
+
+	//the chain files of older terminals are still read
+	path := filepath.Join(t.TempDir(), "old.txt")
+	var old strings.Builder
+	for _, blk := range testChain() {
+		old.WriteString(blk.pretty() + "\n")
+	}
+	if err = ioutil.WriteFile(path, []byte(old.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if read, err = ReadChainFile(path); err != nil || len(read) != len(chain) {
+		t.Errorf("read %d blocks of an old chain file, %v", len(read), err)
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	report := VerifyChain(testChain())
+	if report.Problem != nil {
+		t.Fatalf("consistent chain failed: %s", report.Problem.Detail)
+	}
+	if report.Balances[1] != 64.5 || report.Balances[2] != 0 {
+		t.Errorf("unexpected balances %v", report.Balances)
+	}
+
+	tampered := testChain()
+	tampered[3].Amount = 35.5
+	report = VerifyChain(tampered)
+	if report.Problem == nil || report.Problem.Position != 3 || report.Problem.Err != ErrBlockHash {
+		t.Fatalf("expected hash problem at block 3, got %+v", report.Problem)
+	}
+	if report.Balances[1] != 100 {
+		t.Errorf("expected balances replayed up to block 2, got %v", report.Balances)
+	}
+
+	broken := testChain()
+	broken = append(broken[:2], broken[3:]...)
+	report = VerifyChain(broken)
+	if report.Problem == nil || report.Problem.Err != ErrBlockIndex {
+		t.Fatalf("expected index problem, got %+v", report.Problem)
+	}
+}
+
+func TestLedgerVerify(t *testing.T) {
+	ledger := NewLedger("")
+	for i := 0; i < 2*SyncBatchSize+10; i++ {
+		err := ledger.Append(nextBlock(ledger.Latest(), 1+i%5, 3, "test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//the ledger is read in several pages
+	report := ledger.Verify()
+	if report.Problem != nil {
+		t.Fatalf("unexpected problem %+v", report.Problem)
+	}
+	if report.Blocks != 2*SyncBatchSize+11 {
+		t.Errorf("verified %d blocks, expected %d", report.Blocks, 2*SyncBatchSize+11)
+	}
+	if report.Balances[1] != ledger.Balance(1) {
+		t.Errorf("replayed balance %f on card 1, ledger has %f", report.Balances[1], ledger.Balance(1))
+	}
+}